@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"context"
 	"net/http"
 	"regexp"
 	"strings"
@@ -18,12 +19,13 @@ type AuthInfo struct {
 	Repo string
 
 	// Are we pushing or fetching ?
+	// (Git LFS uploads and lock changes are pushes, downloads fetches)
 	Push  bool
 	Fetch bool
 }
 
 var (
-	repoNameRegex = regexp.MustCompile("^/?(.*?)/(HEAD|git-upload-pack|git-receive-pack|info/refs|objects/.*)$")
+	repoNameRegex = regexp.MustCompile("^/?(.*?)/(HEAD|git-upload-pack|git-receive-pack|info/refs|info/lfs/.*|objects/.*)$")
 )
 
 func Authenticator(authf func(AuthInfo) (bool, error)) func(http.Handler) http.Handler {
@@ -63,18 +65,33 @@ func Authenticator(authf func(AuthInfo) (bool, error)) func(http.Handler) http.H
 				return
 			}
 
-			// Access granted
-			handler.ServeHTTP(w, req)
+			// Access granted, pass on who was granted access
+			info.Password = ""
+			handler.ServeHTTP(w, req.WithContext(NewContext(req.Context(), info)))
 		})
 	}
 }
 
+type contextKey struct{}
+
+// NewContext returns a context carrying info
+func NewContext(ctx context.Context, info AuthInfo) context.Context {
+	return context.WithValue(ctx, contextKey{}, info)
+}
+
+// FromContext returns the AuthInfo of an authenticated request,
+// as set by Authenticator (without the password)
+func FromContext(ctx context.Context) (AuthInfo, bool) {
+	info, ok := ctx.Value(contextKey{}).(AuthInfo)
+	return info, ok
+}
+
 func isFetch(req *http.Request) bool {
-	return isService("upload-pack", req)
+	return isService("upload-pack", req) || isLFSFetch(req)
 }
 
 func isPush(req *http.Request) bool {
-	return isService("receive-pack", req)
+	return isService("receive-pack", req) || isLFSPush(req)
 }
 
 func isService(service string, req *http.Request) bool {
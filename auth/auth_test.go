@@ -1,6 +1,9 @@
 package auth
 
 import (
+	"io"
+	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -13,3 +16,38 @@ func TestRepoName(t *testing.T) {
 		t.Errorf("Should have been 'aarono/gogo-proxy' is '%s'", x)
 	}
 }
+
+func TestLFSRequests(t *testing.T) {
+	const oid = "4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393"
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+
+		push  bool
+		fetch bool
+	}{
+		{"POST", "/org/repo.git/info/lfs/objects/batch", `{"operation":"upload","objects":[]}`, true, false},
+		{"POST", "/org/repo.git/info/lfs/objects/batch", `{"operation":"download","objects":[]}`, false, true},
+		{"PUT", "/org/repo.git/info/lfs/objects/" + oid, "", true, false},
+		{"GET", "/org/repo.git/info/lfs/objects/" + oid, "", false, true},
+		{"POST", "/org/repo.git/info/lfs/objects/verify", "", true, false},
+		{"GET", "/org/repo.git/info/lfs/locks", "", false, true},
+		{"POST", "/org/repo.git/info/lfs/locks/verify", "", true, false},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/vnd.git-lfs+json")
+		if push, fetch := isPush(req), isFetch(req); push != tt.push || fetch != tt.fetch {
+			t.Errorf("%s %s: got push %v fetch %v, want %v %v", tt.method, tt.path, push, fetch, tt.push, tt.fetch)
+		}
+		if body, _ := io.ReadAll(req.Body); string(body) != tt.body {
+			t.Errorf("%s %s: body altered to %q", tt.method, tt.path, body)
+		}
+		if repo := repoName(tt.path); repo != "org/repo.git" {
+			t.Errorf("%s: got repo %q", tt.path, repo)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+)
+
+// Git LFS endpoints, under <repo>/info/lfs/
+var (
+	lfsObjectRegex = regexp.MustCompile("/info/lfs/objects/[0-9a-f]{64}$")
+	lfsBatchRegex  = regexp.MustCompile("/info/lfs/objects/batch$")
+	lfsVerifyRegex = regexp.MustCompile("/info/lfs/objects/verify$")
+	lfsLocksRegex  = regexp.MustCompile("/info/lfs/locks(/.*)?$")
+)
+
+// Largest batch request read to tell uploads from downloads
+const maxLFSBatchSize = 10 << 20
+
+// isLFSPush tells whether a Git LFS request writes to the repo:
+// uploads, verifications of uploads and lock changes
+func isLFSPush(req *http.Request) bool {
+	path := req.URL.Path
+	switch {
+	case lfsObjectRegex.MatchString(path):
+		return req.Method == "PUT"
+	case lfsVerifyRegex.MatchString(path):
+		return true
+	case lfsBatchRegex.MatchString(path):
+		return lfsBatchOperation(req) == "upload"
+	case lfsLocksRegex.MatchString(path):
+		return req.Method == "POST"
+	}
+	return false
+}
+
+// isLFSFetch tells whether a Git LFS request reads from the repo
+func isLFSFetch(req *http.Request) bool {
+	path := req.URL.Path
+	switch {
+	case lfsObjectRegex.MatchString(path):
+		return req.Method == "GET"
+	case lfsBatchRegex.MatchString(path):
+		return lfsBatchOperation(req) != "upload"
+	case lfsLocksRegex.MatchString(path):
+		return req.Method == "GET"
+	}
+	return false
+}
+
+// lfsBatchOperation returns the operation of a batch request
+// (upload or download), leaving the request's body unread
+func lfsBatchOperation(req *http.Request) string {
+	if req.Body == nil {
+		return ""
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxLFSBatchSize))
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+	if err != nil {
+		return ""
+	}
+
+	var batch struct {
+		Operation string `json:"operation"`
+	}
+	json.Unmarshal(body, &batch)
+	return batch.Operation
+}
@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limit is a token bucket: Burst requests can be made at once,
+// after which they are allowed at Rate requests per second
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+type RateLimitConfig struct {
+	// Limits of fetches and pushes (as told by AuthInfo's Fetch
+	// and Push), other requests aren't limited. A zero Limit
+	// doesn't limit. A clone or push takes several requests.
+	Fetch Limit
+	Push  Limit
+
+	// Store keeps the buckets, a MemoryStore if nil
+	Store Store
+}
+
+// Store keeps the token buckets of clients, possibly
+// shared between several servers
+type Store interface {
+	// Take takes a token from the bucket under key. If there was
+	// none left, it returns false and how long to wait for one.
+	Take(key string, limit Limit, now time.Time) (ok bool, retryAfter time.Duration, err error)
+}
+
+// RateLimiter limits the rate of fetches and pushes of each user.
+// Placed behind an Authenticator, users are told apart by their
+// username, otherwise (and for anonymous requests) by remote IP:
+//
+//	limit := auth.RateLimiter(auth.RateLimitConfig{
+//		Fetch: auth.Limit{Rate: 1, Burst: 20},
+//		Push:  auth.Limit{Rate: 0.2, Burst: 5},
+//	})
+//	http.Handle("/", auth.Authenticator(authf)(limit(git)))
+//
+// Requests over the limit get a 429 with a Retry-After header.
+func RateLimiter(config RateLimitConfig) func(http.Handler) http.Handler {
+	store := config.Store
+	if store == nil {
+		store = NewMemoryStore()
+	}
+
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			kind, limit := "", Limit{}
+			if isPush(req) {
+				kind, limit = "push", config.Push
+			} else if isFetch(req) {
+				kind, limit = "fetch", config.Fetch
+			}
+			if kind == "" || limit.Rate <= 0 {
+				handler.ServeHTTP(w, req)
+				return
+			}
+
+			ok, retryAfter, err := store.Take(kind+":"+clientKey(req), limit, time.Now())
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			if !ok {
+				seconds := int(math.Ceil(retryAfter.Seconds()))
+				if seconds < 1 {
+					seconds = 1
+				}
+				w.Header().Set("Retry-After", strconv.Itoa(seconds))
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				return
+			}
+
+			handler.ServeHTTP(w, req)
+		})
+	}
+}
+
+// clientKey identifies the client making a request
+func clientKey(req *http.Request) string {
+	if info, ok := FromContext(req.Context()); ok && info.Username != "" {
+		return "user:" + info.Username
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// MemoryStore keeps token buckets in memory, for a single server
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	takes   int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+
+	// Time at which the bucket will be full again
+	full time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: map[string]*bucket{}}
+}
+
+func (s *MemoryStore) Take(key string, limit Limit, now time.Time) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	s.prune(now)
+
+	b := s.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: burst, last: now}
+		s.buckets[key] = b
+	}
+
+	// Refill the bucket for the time elapsed
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed*limit.Rate)
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		wait := (1 - b.tokens) / limit.Rate
+		return false, time.Duration(wait * float64(time.Second)), nil
+	}
+
+	b.tokens--
+	b.full = now.Add(time.Duration((burst - b.tokens) / limit.Rate * float64(time.Second)))
+	return true, 0, nil
+}
+
+// prune drops the buckets that are full again every so often,
+// so they don't pile up
+func (s *MemoryStore) prune(now time.Time) {
+	if s.takes++; s.takes < 1024 {
+		return
+	}
+	s.takes = 0
+
+	for key, b := range s.buckets {
+		if !b.full.After(now) {
+			delete(s.buckets, key)
+		}
+	}
+}
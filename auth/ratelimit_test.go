@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	limit := Limit{Rate: 2, Burst: 2}
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _, _ := s.Take("a", limit, now); !ok {
+			t.Fatalf("take %d should be allowed", i)
+		}
+	}
+	ok, retryAfter, _ := s.Take("a", limit, now)
+	if ok || retryAfter != 500*time.Millisecond {
+		t.Fatalf("got %v, %v, want false, 500ms", ok, retryAfter)
+	}
+	if ok, _, _ := s.Take("b", limit, now); !ok {
+		t.Fatalf("buckets should be separate")
+	}
+	if ok, _, _ := s.Take("a", limit, now.Add(500*time.Millisecond)); !ok {
+		t.Fatalf("bucket should have been refilled")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	limiter := RateLimiter(RateLimitConfig{
+		Fetch: Limit{Rate: 0.5, Burst: 1},
+		Push:  Limit{Rate: 0.5, Burst: 1},
+	})(handler)
+
+	serve := func(method, path, user string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if user != "" {
+			r = r.WithContext(NewContext(r.Context(), AuthInfo{Username: user}))
+		}
+		w := httptest.NewRecorder()
+		limiter.ServeHTTP(w, r)
+		return w
+	}
+
+	tests := []struct {
+		method, path, user string
+		code               int
+	}{
+		{"GET", "/repo.git/info/refs?service=git-upload-pack", "", 200},
+		{"POST", "/repo.git/git-upload-pack", "", 429},
+		{"POST", "/repo.git/git-receive-pack", "", 200},
+		{"POST", "/repo.git/git-upload-pack", "alice", 200},
+		{"POST", "/repo.git/git-upload-pack", "alice", 429},
+		{"POST", "/repo.git/git-upload-pack", "bob", 200},
+		{"GET", "/repo.git/HEAD", "", 200},
+	}
+
+	for _, tt := range tests {
+		w := serve(tt.method, tt.path, tt.user)
+		if w.Code != tt.code {
+			t.Errorf("%s %s as %q: got %d, want %d", tt.method, tt.path, tt.user, w.Code, tt.code)
+		}
+		if w.Code == 429 && w.Header().Get("Retry-After") != "2" {
+			t.Errorf("%s %s: got Retry-After %q", tt.method, tt.path, w.Header().Get("Retry-After"))
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package githttp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"time"
+)
+
+// Backend serves the smart protocol services of the repos,
+// the dir passed to its methods being the directory of the repo.
+// proto is the client's Git-Protocol header, e.g. "version=2".
+type Backend interface {
+	// AdvertiseRefs returns the ref advertisement of service ("upload-pack"
+	// or "receive-pack"), as "git <service> --advertise-refs" prints it
+	AdvertiseRefs(ctx context.Context, dir string, service string, proto string) ([]byte, error)
+
+	// UploadPack and ReceivePack serve a stateless-rpc
+	// request read from in, writing the response to out
+	UploadPack(ctx context.Context, dir string, proto string, in io.Reader, out io.Writer) error
+	ReceivePack(ctx context.Context, dir string, proto string, in io.Reader, out io.Writer) error
+}
+
+// backend returns the Backend serving requests, spawning git if none
+// is set and the repos are on disk. A GoBackend without Storage gets
+// the Storage of g.
+func (g *GitHttp) backend() Backend {
+	if b, ok := g.Backend.(*GoBackend); ok && b.Storage == nil && g.Storage != nil {
+		withStorage := *b
+		withStorage.Storage = g.Storage
+		return &withStorage
+	}
+	if g.Backend != nil {
+		return g.Backend
+	}
+	if !onDisk(g.storage()) {
+		return &GoBackend{Storage: g.Storage}
+	}
+	return execBackend{g}
+}
+
+// repoStorage returns the Storage the backend reads the repos from
+func (g *GitHttp) repoStorage() Storage {
+	if b, ok := g.backend().(*GoBackend); ok {
+		return b.storage()
+	}
+	return g.storage()
+}
+
+// execBackend runs the services with the git binary at GitBinPath
+type execBackend struct {
+	g *GitHttp
+}
+
+func (b execBackend) AdvertiseRefs(ctx context.Context, dir string, service string, proto string) ([]byte, error) {
+	return b.g.gitCommandEnv(ctx, dir, gitEnv(proto), service, "--stateless-rpc", "--advertise-refs", ".")
+}
+
+func (b execBackend) UploadPack(ctx context.Context, dir string, proto string, in io.Reader, out io.Writer) error {
+	return b.run(ctx, dir, "upload-pack", proto, in, out)
+}
+
+func (b execBackend) ReceivePack(ctx context.Context, dir string, proto string, in io.Reader, out io.Writer) error {
+	return b.run(ctx, dir, "receive-pack", proto, in, out)
+}
+
+func (b execBackend) run(ctx context.Context, dir string, rpc string, proto string, in io.Reader, out io.Writer) error {
+	args := []string{rpc, "--stateless-rpc", "."}
+	cmd := b.g.newCommand(ctx, dir, args...)
+	cmd.Env = gitEnv(proto)
+	cmd.Stdin = in
+	cmd.Stdout = out
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	b.g.Metrics.processStarted()
+
+	err := cmd.Wait()
+	b.g.Metrics.processDone(args, time.Since(start))
+	b.g.logCommand(ctx, dir, args, start, cmd.ProcessState.ExitCode(), err)
+
+	return err
+}
+
+// isExitError reports whether err is a git process exiting unsuccessfully
+func isExitError(err error) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr)
+}
@@ -0,0 +1,251 @@
+package githttp
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Commit is a commit introduced by a push
+type Commit struct {
+	// SHA of commit
+	Id string `json:"id"`
+
+	Author    Signature `json:"author"`
+	Committer Signature `json:"committer"`
+	Message   string    `json:"message"`
+
+	// Files changed compared to the first parent
+	Changes []FileChange `json:"changes,omitempty"`
+}
+
+type Signature struct {
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	When  time.Time `json:"when"`
+}
+
+// FileChange is a path changed by a commit
+type FileChange struct {
+	// Status letter as shown by "git log --name-status"
+	// (e.g. A, M, D or R for renames)
+	Status string `json:"status"`
+	Path   string `json:"path"`
+
+	// Previous path of renamed or copied files
+	OldPath string `json:"old_path,omitempty"`
+}
+
+// defaultMaxPushCommits is the number of commits
+// listed per ref update if MaxPushCommits is zero
+const defaultMaxPushCommits = 100
+
+// commitLogFormat separates commits by a record separator
+// and their fields by NULs
+const commitLogFormat = "--format=%x1e%H%x00%an%x00%ae%x00%at%x00%cn%x00%ce%x00%ct%x00%B%x00"
+
+// attachCommits adds the commits introduced by each successful ref update
+// to its event. Commits of newly created refs are those that weren't
+// reachable from any ref before the push. Repos served by a GoBackend
+// are read in process.
+func (g *GitHttp) attachCommits(ctx context.Context, dir string, rpcReader *RpcReader, rejected map[string]string) {
+	max := g.MaxPushCommits
+	if max <= 0 {
+		max = defaultMaxPushCommits
+	}
+
+	if b, ok := g.backend().(*GoBackend); ok {
+		g.attachPushedCommits(ctx, b, dir, rpcReader, rejected, max)
+		return
+	}
+
+	// Refs updated by this push are only excluded
+	// through the commits they pointed to before
+	var exclude []string
+	for _, u := range rpcReader.Updates {
+		if u.Kind != REF_CREATE {
+			exclude = append(exclude, u.Old)
+		}
+		exclude = append(exclude, "--exclude="+u.Ref)
+	}
+
+	for i, e := range rpcReader.Events {
+		u := e.Update
+		if u == nil || u.Kind == REF_DELETE {
+			continue
+		}
+		if _, ok := rejected[u.Ref]; ok {
+			continue
+		}
+
+		args := []string{"log", commitLogFormat, "--name-status", "-M", "-n", strconv.Itoa(max + 1), u.New, "--not"}
+		if u.Kind == REF_UPDATE {
+			args = append(args, u.Old)
+		} else {
+			args = append(append(args, exclude...), "--glob=refs/*")
+		}
+
+		out, err := g.gitCommand(ctx, dir, args...)
+		if err != nil {
+			continue
+		}
+
+		commits := parseCommitLog(string(out))
+		if len(commits) > max {
+			commits = commits[:max]
+			rpcReader.Events[i].CommitsTruncated = true
+		}
+		rpcReader.Events[i].Commits = commits
+	}
+}
+
+// attachPushedCommits is attachCommits, reading the commits
+// in process from the Storage of b
+func (g *GitHttp) attachPushedCommits(ctx context.Context, b *GoBackend, dir string, rpcReader *RpcReader, rejected map[string]string, max int) {
+	db, err := openObjectDB(b.storage(), dir)
+	if err != nil {
+		return
+	}
+	defer db.close()
+
+	// The commits of new refs are those not reachable from the other
+	// refs, or from those this push updated before it did
+	var haves []string
+	var refs []ref
+	updated := map[string]bool{}
+	for _, u := range rpcReader.Updates {
+		if u.Kind != REF_CREATE {
+			haves = append(haves, u.Old)
+		}
+		updated[u.Ref] = true
+	}
+
+	for i, e := range rpcReader.Events {
+		u := e.Update
+		if u == nil || u.Kind == REF_DELETE {
+			continue
+		}
+		if _, ok := rejected[u.Ref]; ok {
+			continue
+		}
+
+		updateHaves := []string{u.Old}
+		if u.Kind != REF_UPDATE {
+			if refs == nil {
+				if refs, err = listRefs(b.storage(), dir); err != nil {
+					return
+				}
+				for _, r := range refs {
+					if !updated[r.name] {
+						haves = append(haves, r.id)
+					}
+				}
+			}
+			updateHaves = haves
+		}
+
+		walked, err := db.pushedCommits(ctx, u.New, updateHaves)
+		if err != nil {
+			continue
+		}
+		if len(walked) > max {
+			walked = walked[:max]
+			rpcReader.Events[i].CommitsTruncated = true
+		}
+
+		var commits []Commit
+		for _, c := range walked {
+			commit, err := readPushedCommit(ctx, db, c)
+			if err != nil {
+				commits = nil
+				break
+			}
+			commits = append(commits, commit)
+		}
+		rpcReader.Events[i].Commits = commits
+	}
+}
+
+// readPushedCommit reads a commit for events, along with
+// the files it changed detecting exact renames
+func readPushedCommit(ctx context.Context, db *objectDB, c *walkCommit) (Commit, error) {
+	data, err := db.readType(c.id, objCommit)
+	if err != nil {
+		return Commit{}, err
+	}
+	commit := Commit{Id: c.id}
+
+	// Headers end with a blank line, followed by the message
+	headers, message, _ := strings.Cut(string(data), "\n\n")
+	commit.Message = message
+	for _, line := range strings.Split(headers, "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "author":
+			commit.Author = parseSignature(value)
+		case "committer":
+			commit.Committer = parseSignature(value)
+		}
+	}
+
+	commit.Changes, err = db.commitChanges(ctx, c, true)
+	return commit, err
+}
+
+// parseSignature parses the "<name> <<email>> <date> <timezone>"
+// of an author or committer
+func parseSignature(s string) Signature {
+	var sig Signature
+	lt := strings.IndexByte(s, '<')
+	gt := strings.LastIndexByte(s, '>')
+	if lt < 0 || gt < lt {
+		return sig
+	}
+	sig.Name = strings.TrimSpace(s[:lt])
+	sig.Email = s[lt+1 : gt]
+	if fields := strings.Fields(s[gt+1:]); len(fields) > 0 {
+		sig.When = parseUnixTime(fields[0])
+	}
+	return sig
+}
+
+// parseCommitLog parses the output of git log with commitLogFormat
+// and --name-status
+func parseCommitLog(out string) []Commit {
+	var commits []Commit
+	for _, record := range strings.Split(out, "\x1e") {
+		fields := strings.SplitN(record, "\x00", 9)
+		if len(fields) != 9 {
+			continue
+		}
+
+		c := Commit{
+			Id:        fields[0],
+			Author:    Signature{fields[1], fields[2], parseUnixTime(fields[3])},
+			Committer: Signature{fields[4], fields[5], parseUnixTime(fields[6])},
+			Message:   fields[7],
+		}
+
+		for _, line := range strings.Split(fields[8], "\n") {
+			parts := strings.Split(line, "\t")
+			switch len(parts) {
+			case 2:
+				c.Changes = append(c.Changes, FileChange{Status: parts[0], Path: parts[1]})
+			case 3:
+				c.Changes = append(c.Changes, FileChange{Status: parts[0][:1], Path: parts[2], OldPath: parts[1]})
+			}
+		}
+
+		commits = append(commits, c)
+	}
+	return commits
+}
+
+func parseUnixTime(s string) time.Time {
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0).UTC()
+}
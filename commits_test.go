@@ -0,0 +1,138 @@
+package githttp
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCommitLog(t *testing.T) {
+	out := "\x1e" + "3da295397738f395c2ca5fd5570f01a9fcea3be3\x00Jane\x00jane@example.com\x001700000000\x00" +
+		"John\x00john@example.com\x001700000100\x00Rename things\n\nWith a body.\n\x00\n" +
+		"R100\told.txt\tnew.txt\nM\tREADME.md\n\n" +
+		"\x1e" + "92eef6dcb9cc198bc3ac6010c108fa482773f116\x00Jane\x00jane@example.com\x001600000000\x00" +
+		"Jane\x00jane@example.com\x001600000000\x00Initial commit\n\x00\n" +
+		"A\told.txt\n"
+
+	want := []Commit{
+		{
+			Id:        "3da295397738f395c2ca5fd5570f01a9fcea3be3",
+			Author:    Signature{"Jane", "jane@example.com", time.Unix(1700000000, 0).UTC()},
+			Committer: Signature{"John", "john@example.com", time.Unix(1700000100, 0).UTC()},
+			Message:   "Rename things\n\nWith a body.\n",
+			Changes: []FileChange{
+				{Status: "R", Path: "new.txt", OldPath: "old.txt"},
+				{Status: "M", Path: "README.md"},
+			},
+		},
+		{
+			Id:        "92eef6dcb9cc198bc3ac6010c108fa482773f116",
+			Author:    Signature{"Jane", "jane@example.com", time.Unix(1600000000, 0).UTC()},
+			Committer: Signature{"Jane", "jane@example.com", time.Unix(1600000000, 0).UTC()},
+			Message:   "Initial commit\n",
+			Changes: []FileChange{
+				{Status: "A", Path: "old.txt"},
+			},
+		},
+	}
+
+	if got := parseCommitLog(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("\n got: %#v\nwant: %#v", got, want)
+	}
+}
+
+func TestGoBackendPushCommits(t *testing.T) {
+	r := makeTestRepo(t)
+
+	// Rename b.txt, change a.txt and add a directory,
+	// then add a file
+	src := t.TempDir()
+	makeBareRepo(t, src, true)
+	blobC := writeObject(t, src, objBlob, []byte("c\n"))
+	dir := writeObject(t, src, objTree, treeData(treeEntry{"100644", "d.txt", blobC}))
+	tree3 := writeObject(t, src, objTree, treeData(
+		treeEntry{"100644", "a.txt", blobC},
+		treeEntry{"100644", "c.txt", r.blobB},
+		treeEntry{"40000", "dir", dir},
+	))
+	tree4 := writeObject(t, src, objTree, treeData(
+		treeEntry{"100644", "a.txt", blobC},
+		treeEntry{"100644", "c.txt", r.blobB},
+		treeEntry{"40000", "dir", dir},
+		treeEntry{"100644", "e.txt", r.blobA},
+	))
+	commit3 := writeObject(t, src, objCommit, []byte("tree "+tree3+"\nparent "+r.commit2+"\n"+
+		"author Jane <jane@example.com> 1700000000 +0100\ncommitter John <john@example.com> 1700000100 +0100\n\nRename things\n"))
+	commit4 := writeObject(t, src, objCommit, []byte("tree "+tree4+"\nparent "+commit3+"\n"+
+		"author Jane <jane@example.com> 1700000200 +0100\ncommitter Jane <jane@example.com> 1700000200 +0100\n\nAdd e\n"))
+
+	var paths []string
+	var events []Event
+	g := &GitHttp{
+		ProjectRoot: filepath.Dir(r.dir),
+		Backend:     &GoBackend{},
+		ReceivePack: true,
+		PushCommits: true,
+		PreReceive: func(ctx context.Context, updates []RefUpdate) error {
+			info, _ := HookInfoFromContext(ctx)
+			var err error
+			paths, err = info.ChangedPaths(ctx, updates[0])
+			return err
+		},
+		EventHandler: func(ev Event) {
+			events = append(events, ev)
+		},
+	}
+
+	body := pushRequest(t, src, []string{
+		r.commit2 + " " + commit4 + " refs/heads/master\x00report-status",
+		zeroId + " " + commit4 + " refs/heads/feature",
+	}, []string{blobC, dir, tree3, tree4, commit3, commit4})
+	req := httptest.NewRequest("POST", "/"+filepath.Base(r.dir)+"/git-receive-pack", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-git-receive-pack-request")
+	g.ServeHTTP(httptest.NewRecorder(), req)
+
+	if want := []string{"e.txt", "a.txt", "b.txt", "c.txt", "dir/d.txt"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("changed paths: got %q, want %q", paths, want)
+	}
+
+	want := []Commit{
+		{
+			Id:        commit4,
+			Author:    Signature{"Jane", "jane@example.com", time.Unix(1700000200, 0).UTC()},
+			Committer: Signature{"Jane", "jane@example.com", time.Unix(1700000200, 0).UTC()},
+			Message:   "Add e\n",
+			Changes:   []FileChange{{Status: "A", Path: "e.txt"}},
+		},
+		{
+			Id:        commit3,
+			Author:    Signature{"Jane", "jane@example.com", time.Unix(1700000000, 0).UTC()},
+			Committer: Signature{"John", "john@example.com", time.Unix(1700000100, 0).UTC()},
+			Message:   "Rename things\n",
+			Changes: []FileChange{
+				{Status: "M", Path: "a.txt"},
+				{Status: "R", Path: "c.txt", OldPath: "b.txt"},
+				{Status: "A", Path: "dir/d.txt"},
+			},
+		},
+	}
+
+	// The new branch only brings in commits master didn't have
+	found := 0
+	for _, ev := range events {
+		if ev.Update == nil {
+			continue
+		}
+		found++
+		if !reflect.DeepEqual(ev.Commits, want) {
+			t.Errorf("%s:\n got: %#v\nwant: %#v", ev.Update.Ref, ev.Commits, want)
+		}
+	}
+	if found != 2 {
+		t.Errorf("got %d ref update events, want 2", found)
+	}
+}
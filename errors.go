@@ -2,6 +2,9 @@ package githttp
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 )
 
 type ErrorNoAccess struct {
@@ -12,3 +15,93 @@ type ErrorNoAccess struct {
 func (e *ErrorNoAccess) Error() string {
 	return fmt.Sprintf("Could not access repo at '%s'", e.Dir)
 }
+
+type ErrorRepoNotFound struct {
+	// repo component of URL
+	Repo string
+
+	// Path the repo would have if it existed,
+	// empty if it can't be created there
+	Dir string
+}
+
+func (e *ErrorRepoNotFound) Error() string {
+	return fmt.Sprintf("Could not find repo '%s'", e.Repo)
+}
+
+// ErrorInvalidRequest is returned for git requests whose
+// pkt-lines don't parse, which aren't relayed to git
+type ErrorInvalidRequest struct {
+	// Git command requested (e.g. receive-pack)
+	Rpc string
+
+	Reason string
+}
+
+func (e *ErrorInvalidRequest) Error() string {
+	return fmt.Sprintf("Invalid git %s request: %s", e.Rpc, e.Reason)
+}
+
+// ErrorRefsRejected is returned by a PreReceive hook
+// to reject some of the ref updates of a push
+type ErrorRefsRejected struct {
+	// Reason for rejecting each ref, by full ref name
+	Refs map[string]string
+}
+
+func (e *ErrorRefsRejected) Error() string {
+	var refs []string
+	for ref, reason := range e.Refs {
+		refs = append(refs, fmt.Sprintf("%s (%s)", ref, reason))
+	}
+	sort.Strings(refs)
+	return "Rejected " + strings.Join(refs, ", ")
+}
+
+// ErrorRefHidden is reported for fetches wanting an object
+// only reachable from refs hidden from the user by CanReadRef
+type ErrorRefHidden struct {
+	// Object wanted
+	Id string
+}
+
+func (e *ErrorRefHidden) Error() string {
+	return fmt.Sprintf("Object %s isn't reachable from a visible ref", e.Id)
+}
+
+// ErrorCanceled is reported when a git process was killed before
+// completing, or a request stopped waiting for its turn to run git,
+// because the client went away or a timeout expired
+type ErrorCanceled struct {
+	// Git command that was killed (e.g. upload-pack),
+	// empty if it wasn't running yet
+	Rpc string
+
+	// context.Canceled or context.DeadlineExceeded
+	Err error
+}
+
+func (e *ErrorCanceled) Error() string {
+	if e.Rpc == "" {
+		return fmt.Sprintf("Stopped waiting to run git: %s", e.Err)
+	}
+	return fmt.Sprintf("git %s was killed: %s", e.Rpc, e.Err)
+}
+
+func (e *ErrorCanceled) Unwrap() error {
+	return e.Err
+}
+
+// ErrorBusy is returned by a Limiter when a request
+// can't get to run git because the server is too busy
+type ErrorBusy struct {
+	// Path to directory of repo accessed
+	Dir string
+
+	// Delay after which the client should retry
+	RetryAfter time.Duration
+}
+
+func (e *ErrorBusy) Error() string {
+	return fmt.Sprintf("Too many git processes running for repo at '%s'", e.Dir)
+}
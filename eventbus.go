@@ -0,0 +1,197 @@
+package githttp
+
+import (
+	"context"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+)
+
+// EventBus delivers events to a handler asynchronously, so slow
+// handlers don't hold up git clients. Its Publish method is meant
+// to be used as GitHttp's EventHandler:
+//
+//	bus := githttp.NewEventBus(handler, githttp.EventBusConfig{Workers: 4})
+//	git.EventHandler = bus.Publish
+//	defer bus.Close(ctx)
+//
+// Events are delivered after the request they were triggered by
+// has completed, so handlers should not read the request's body.
+type EventBus struct {
+	handler func(Event)
+	policy  OverflowPolicy
+	queue   chan Event
+	logger  *slog.Logger
+
+	// Closed by Close, unblocking publishers. The queue is only
+	// closed once the publishers that got in before are done.
+	mu         sync.RWMutex
+	closed     bool
+	closing    chan struct{}
+	publishing sync.WaitGroup
+
+	workers   sync.WaitGroup
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
+	panics    atomic.Uint64
+}
+
+type EventBusConfig struct {
+	// Number of events that can be waiting for delivery (1024 if zero)
+	QueueSize int
+
+	// Number of goroutines delivering events (1 if zero).
+	// With more than one, events may be delivered out of order.
+	Workers int
+
+	// What to do with events published while the queue is full
+	Overflow OverflowPolicy
+
+	// Logger receives the panics of the handler, discarded if nil
+	Logger *slog.Logger
+}
+
+type OverflowPolicy int
+
+// Possible overflow policies
+const (
+	// Drop the event (and count it as dropped)
+	OVERFLOW_DROP OverflowPolicy = iota
+
+	// Wait for room in the queue, holding up the request
+	OVERFLOW_BLOCK
+)
+
+// EventBusStats are counters on the events handled by an EventBus
+type EventBusStats struct {
+	// Events waiting for delivery
+	Queued int
+
+	// Events passed to the handler
+	Delivered uint64
+
+	// Events dropped because the queue was full or the bus closed
+	Dropped uint64
+
+	// Events the handler panicked on
+	Panics uint64
+}
+
+// NewEventBus starts an EventBus delivering events to handler
+func NewEventBus(handler func(Event), config EventBusConfig) *EventBus {
+	if config.QueueSize <= 0 {
+		config.QueueSize = 1024
+	}
+	if config.Workers <= 0 {
+		config.Workers = 1
+	}
+
+	if config.Logger == nil {
+		config.Logger = discardLogger
+	}
+
+	b := &EventBus{
+		handler: handler,
+		policy:  config.Overflow,
+		queue:   make(chan Event, config.QueueSize),
+		logger:  config.Logger,
+		closing: make(chan struct{}),
+	}
+
+	b.workers.Add(config.Workers)
+	for i := 0; i < config.Workers; i++ {
+		go b.work()
+	}
+
+	return b
+}
+
+// Publish queues an event for delivery. With OVERFLOW_BLOCK,
+// it waits for room in the queue until the bus is closed.
+func (b *EventBus) Publish(e Event) {
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		b.dropped.Add(1)
+		return
+	}
+	b.publishing.Add(1)
+	b.mu.RUnlock()
+	defer b.publishing.Done()
+
+	if b.policy == OVERFLOW_BLOCK {
+		select {
+		case b.queue <- e:
+		case <-b.closing:
+			b.dropped.Add(1)
+		}
+		return
+	}
+
+	select {
+	case b.queue <- e:
+	default:
+		b.dropped.Add(1)
+	}
+}
+
+// Close stops accepting events and waits for the queued ones to be
+// delivered. If ctx is done first, its error is returned and the
+// remaining events are delivered in the background.
+func (b *EventBus) Close(ctx context.Context) error {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.closing)
+		go func() {
+			b.publishing.Wait()
+			close(b.queue)
+		}()
+	}
+	b.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		b.workers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stats returns the bus' current counters
+func (b *EventBus) Stats() EventBusStats {
+	return EventBusStats{
+		Queued:    len(b.queue),
+		Delivered: b.delivered.Load(),
+		Dropped:   b.dropped.Load(),
+		Panics:    b.panics.Load(),
+	}
+}
+
+func (b *EventBus) work() {
+	defer b.workers.Done()
+	for e := range b.queue {
+		b.deliver(e)
+	}
+}
+
+// deliver passes an event to the handler,
+// a panicking handler doesn't stop the worker
+func (b *EventBus) deliver(e Event) {
+	defer func() {
+		if p := recover(); p != nil {
+			b.panics.Add(1)
+			b.logger.Error("event handler panicked", "event", e.Type.String(), "panic", p, "stack", string(debug.Stack()))
+		}
+	}()
+
+	b.delivered.Add(1)
+	b.handler(e)
+}
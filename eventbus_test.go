@@ -0,0 +1,137 @@
+package githttp_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AaronO/go-git-http"
+)
+
+func TestEventBusDrain(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+
+	bus := githttp.NewEventBus(func(e githttp.Event) {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		got = append(got, e.Commit)
+		mu.Unlock()
+	}, githttp.EventBusConfig{QueueSize: 10})
+
+	for _, c := range []string{"a", "b", "c"} {
+		bus.Publish(githttp.Event{Type: githttp.PUSH, Commit: c})
+	}
+
+	if err := bus.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 3 || got[0] != "a" || got[2] != "c" {
+		t.Errorf("got events %v, want [a b c]", got)
+	}
+
+	// Events published after closing are dropped
+	bus.Publish(githttp.Event{Type: githttp.PUSH})
+	if stats := bus.Stats(); stats.Delivered != 3 || stats.Dropped != 1 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
+
+func TestEventBusOverflow(t *testing.T) {
+	release := make(chan struct{})
+	bus := githttp.NewEventBus(func(e githttp.Event) {
+		<-release
+	}, githttp.EventBusConfig{QueueSize: 2, Overflow: githttp.OVERFLOW_DROP})
+
+	// One event is being handled, two are queued
+	// and the remaining ones are dropped
+	bus.Publish(githttp.Event{})
+	for bus.Stats().Delivered == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 5; i++ {
+		bus.Publish(githttp.Event{})
+	}
+
+	if stats := bus.Stats(); stats.Queued != 2 || stats.Dropped != 3 {
+		t.Errorf("got stats %+v", stats)
+	}
+
+	close(release)
+	bus.Close(context.Background())
+}
+
+func TestEventBusCloseTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	bus := githttp.NewEventBus(func(e githttp.Event) {
+		<-release
+	}, githttp.EventBusConfig{})
+	bus.Publish(githttp.Event{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := bus.Close(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestEventBusCloseBlocked(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	bus := githttp.NewEventBus(func(e githttp.Event) {
+		<-release
+	}, githttp.EventBusConfig{QueueSize: 1, Overflow: githttp.OVERFLOW_BLOCK})
+
+	// One event is being handled, one is queued
+	// and the last publisher waits for room
+	bus.Publish(githttp.Event{})
+	for bus.Stats().Delivered == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	bus.Publish(githttp.Event{})
+	published := make(chan struct{})
+	go func() {
+		bus.Publish(githttp.Event{})
+		close(published)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := bus.Close(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// Closing unblocks the publisher, dropping its event
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("publisher still blocked")
+	}
+	bus.Publish(githttp.Event{})
+	if stats := bus.Stats(); stats.Dropped != 2 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
+
+func TestEventBusPanics(t *testing.T) {
+	bus := githttp.NewEventBus(func(e githttp.Event) {
+		if e.Commit == "panic" {
+			panic("handler failed")
+		}
+	}, githttp.EventBusConfig{})
+
+	bus.Publish(githttp.Event{Commit: "panic"})
+	bus.Publish(githttp.Event{Commit: "ok"})
+	if err := bus.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if stats := bus.Stats(); stats.Delivered != 2 || stats.Panics != 1 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
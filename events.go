@@ -1,15 +1,26 @@
 package githttp
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"time"
 )
 
 // An event (triggered on push/pull)
 type Event struct {
-	// One of tag/push/fetch
+	// Unique id of the event
+	Id string `json:"id"`
+
+	// One of tag/push/fetch/create
 	Type EventType `json:"type"`
 
+	// Time the event was published
+	Time time.Time `json:"time"`
+
 	////
 	// Set for pushes and pulls
 	////
@@ -17,8 +28,11 @@ type Event struct {
 	// SHA of commit
 	Commit string `json:"commit"`
 
+	// repo component of URL
+	Repo string `json:"repo,omitempty"`
+
 	// Path to bare repo
-	Dir string
+	Dir string `json:"dir"`
 
 	////
 	// Set for pushes or tagging
@@ -27,12 +41,78 @@ type Event struct {
 	Last   string `json:"last,omitempty"`
 	Branch string `json:"branch,omitempty"`
 
+	// Ref update of a push, set for all refs including
+	// deletions and refs other than branches and tags
+	Update *RefUpdate `json:"update,omitempty"`
+
+	// Capabilities requested by the client
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	// Commits introduced by a push, if GitHttp.PushCommits is set.
+	// CommitsTruncated tells whether there were more than listed.
+	Commits          []Commit `json:"commits,omitempty"`
+	CommitsTruncated bool     `json:"commits_truncated,omitempty"`
+
 	// Error contains the error that happened (if any)
-	// during this action/event
-	Error error
+	// during this action/event. In JSON, only its message is kept.
+	Error error `json:"-"`
+
+	// Http stuff, Request itself isn't kept in JSON
+	RemoteAddr string        `json:"remote_addr,omitempty"`
+	User       string        `json:"user,omitempty"`
+	Request    *http.Request `json:"-"`
+}
+
+// jsonEvent is the JSON representation of Event
+type jsonEvent struct {
+	*eventFields
+	Error string `json:"error,omitempty"`
+}
+
+// eventFields has Event's fields without its methods
+type eventFields Event
+
+func (e Event) MarshalJSON() ([]byte, error) {
+	j := jsonEvent{eventFields: (*eventFields)(&e)}
+	if e.Error != nil {
+		j.Error = e.Error.Error()
+	}
+	return json.Marshal(j)
+}
 
-	// Http stuff
-	Request *http.Request
+func (e *Event) UnmarshalJSON(data []byte) error {
+	j := jsonEvent{eventFields: (*eventFields)(e)}
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	if j.Error != "" {
+		e.Error = errors.New(j.Error)
+	}
+	return nil
+}
+
+// stamp fills in the id, time and client details of an event
+// that's being published, its user being who g tells made the request
+func (e *Event) stamp(g *GitHttp) {
+	if e.Id == "" {
+		var b [16]byte
+		rand.Read(b[:])
+		e.Id = hex.EncodeToString(b[:])
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	r := e.Request
+	if r == nil {
+		return
+	}
+	if e.RemoteAddr == "" {
+		e.RemoteAddr = r.RemoteAddr
+	}
+	if e.User == "" {
+		e.User = g.RequestAuthInfo(r).Username
+	}
 }
 
 type EventType int
@@ -43,6 +123,7 @@ const (
 	PUSH
 	FETCH
 	PUSH_FORCE
+	CREATE
 )
 
 func (e EventType) String() string {
@@ -55,6 +136,8 @@ func (e EventType) String() string {
 		return "push-force"
 	case FETCH:
 		return "fetch"
+	case CREATE:
+		return "create"
 	}
 	return "unknown"
 }
@@ -63,19 +146,24 @@ func (e EventType) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprintf(`"%s"`, e)), nil
 }
 
-func (e EventType) UnmarshalJSON(data []byte) error {
-	str := string(data[:])
+func (e *EventType) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
 	switch str {
 	case "tag":
-		e = TAG
+		*e = TAG
 	case "push":
-		e = PUSH
+		*e = PUSH
 	case "push-force":
-		e = PUSH_FORCE
+		*e = PUSH_FORCE
 	case "fetch":
-		e = FETCH
+		*e = FETCH
+	case "create":
+		*e = CREATE
 	default:
-		return fmt.Errorf("'%s' is not a known git event type")
+		return fmt.Errorf("'%s' is not a known git event type", str)
 	}
 	return nil
 }
@@ -0,0 +1,108 @@
+package githttp_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/AaronO/go-git-http"
+	"github.com/AaronO/go-git-http/auth"
+)
+
+func TestEventJSON(t *testing.T) {
+	e := githttp.Event{
+		Id:     "6f1ed002ab5595859014ebf0951522d9",
+		Type:   githttp.PUSH_FORCE,
+		Time:   time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Commit: "3da295397738f395c2ca5fd5570f01a9fcea3be3",
+		Repo:   "/org/repo.git",
+		Dir:    "/srv/git/org/repo.git",
+		Last:   "92eef6dcb9cc198bc3ac6010c108fa482773f116",
+		Branch: "master",
+		Update: &githttp.RefUpdate{
+			Old:    "92eef6dcb9cc198bc3ac6010c108fa482773f116",
+			New:    "3da295397738f395c2ca5fd5570f01a9fcea3be3",
+			Ref:    "refs/heads/master",
+			Kind:   githttp.REF_UPDATE,
+			Forced: true,
+		},
+		Error:      errors.New("hook declined"),
+		RemoteAddr: "192.0.2.1:1234",
+		User:       "jane",
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]interface{}
+	json.Unmarshal(data, &fields)
+	if fields["type"] != "push-force" || fields["error"] != "hook declined" || fields["dir"] != e.Dir {
+		t.Errorf("unexpected JSON: %s", data)
+	}
+
+	var got githttp.Event
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Error == nil || got.Error.Error() != e.Error.Error() {
+		t.Errorf("got error %v, want %v", got.Error, e.Error)
+	}
+	got.Error, e.Error = nil, nil
+	if !reflect.DeepEqual(got, e) {
+		t.Errorf("\n got: %#v\nwant: %#v", got, e)
+	}
+}
+
+func TestEventTypeJSON(t *testing.T) {
+	for _, typ := range []githttp.EventType{githttp.TAG, githttp.PUSH, githttp.FETCH, githttp.PUSH_FORCE, githttp.CREATE} {
+		data, _ := json.Marshal(typ)
+
+		var got githttp.EventType
+		if err := json.Unmarshal(data, &got); err != nil || got != typ {
+			t.Errorf("%s: got %v, %v", data, got, err)
+		}
+	}
+
+	var got githttp.EventType
+	if err := json.Unmarshal([]byte(`"pull"`), &got); err == nil {
+		t.Errorf("unknown event types should generate errors")
+	}
+}
+
+func TestEventUser(t *testing.T) {
+	var user string
+	g := githttp.New(t.TempDir())
+	g.AutoCreate = true
+	g.TrustedUserHeader = "X-Remote-User"
+	g.EventHandler = func(ev githttp.Event) {
+		user = ev.User
+	}
+
+	tests := []struct {
+		repo string
+		set  func(r *http.Request) *http.Request
+		want string
+	}{
+		// Basic auth usernames nobody checked aren't trusted
+		{"forged", func(r *http.Request) *http.Request { r.SetBasicAuth("alice", "forged"); return r }, ""},
+		{"proxied", func(r *http.Request) *http.Request { r.Header.Set("X-Remote-User", "bob"); return r }, "bob"},
+		{"authenticated", func(r *http.Request) *http.Request {
+			return r.WithContext(auth.NewContext(r.Context(), auth.AuthInfo{Username: "carol"}))
+		}, "carol"},
+	}
+
+	for _, tt := range tests {
+		user = "unset"
+		r := httptest.NewRequest("GET", "/"+tt.repo+".git/info/refs?service=git-receive-pack", nil)
+		g.ServeHTTP(httptest.NewRecorder(), tt.set(r))
+		if user != tt.want {
+			t.Errorf("%s: got user %q, want %q", tt.repo, user, tt.want)
+		}
+	}
+}
@@ -1,28 +1,126 @@
 package githttp
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"io/fs"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
 	"path"
+	"runtime/debug"
 	"strings"
+	"time"
+
+	"github.com/AaronO/go-git-http/auth"
 )
 
 type GitHttp struct {
 	// Root directory to serve repos from
 	ProjectRoot string
 
+	// Storage holds the repos, directories on the local disk if nil.
+	// Repos are then found under ProjectRoot in the Storage, and
+	// served by a GoBackend unless Backend is set.
+	Storage Storage
+
+	// Resolver maps URLs to repositories,
+	// repos are served from ProjectRoot if nil
+	Resolver RepoResolver
+
+	// Strict only serves bare git repositories, and keeps
+	// repos resolved from ProjectRoot inside of it
+	Strict bool
+
+	// AutoCreate creates missing repos when they are pushed to.
+	// AllowCreate, if set, decides whether a repo may be created.
+	AutoCreate  bool
+	AllowCreate func(r *http.Request, repo string) (bool, error)
+
+	// Template directory and initial branch of created repos,
+	// git's defaults are used if empty
+	TemplateDir   string
+	DefaultBranch string
+
 	// Path to git binary
 	GitBinPath string
 
+	// Backend serves upload-pack and receive-pack,
+	// spawning the git binary at GitBinPath if nil
+	Backend Backend
+
 	// Access rules
 	UploadPack  bool
 	ReceivePack bool
 
-	// Event handling functions
+	// CanReadRef, if set, decides whether the user making a request
+	// may see a ref of a repo, user being what auth.Authenticator let
+	// through, with an empty Username for anonymous requests. Hidden
+	// refs are left out of ref advertisements and can't be pushed to,
+	// and objects only reachable from them can't be fetched. Fetches
+	// are then served over protocol v0.
+	CanReadRef func(r *http.Request, user auth.AuthInfo, repo string, ref string) (bool, error)
+
+	// RefRules, if set, restrict which refs users may push to and how
+	RefRules *RefRules
+
+	// TrustedUserHeader, if set, names the header a reverse proxy
+	// authenticating users passes their name in, e.g. "X-Remote-User".
+	// CanReadRef and RefRules then see requests no auth.Authenticator
+	// let through as made by that user. The proxy must strip the
+	// header from the requests of clients.
+	TrustedUserHeader string
+
+	// Maximum run time of spawned git processes, no limit if zero.
+	// Processes are killed as well when the client goes away.
+	UploadPackTimeout  time.Duration
+	ReceivePackTimeout time.Duration
+	AdvertiseTimeout   time.Duration
+
+	// Logger receives an access log entry per request, the errors
+	// of requests and, at debug level, a trace of the git processes
+	// spawned. Nothing is logged if nil.
+	Logger *slog.Logger
+
+	// LFS, if set, handles the Git LFS requests made
+	// under <repo>/info/lfs/, e.g. an lfs.Server
+	LFS http.Handler
+
+	// Limiter, if set, bounds the number of upload-pack
+	// and receive-pack processes running at once
+	Limiter *Limiter
+
+	// PackCache, if set, answers identical fetches
+	// with the response git gave to the first one
+	PackCache *PackCache
+
+	// Metrics, if set, collects counters and histograms
+	// on the requests served and git processes spawned
+	Metrics *Metrics
+
+	// Event handling functions, called synchronously from the request.
+	// Use an EventBus for slow handlers.
 	EventHandler func(ev Event)
+
+	// PushCommits lists the commits introduced by pushes in their events,
+	// up to MaxPushCommits per ref update (100 if zero)
+	PushCommits    bool
+	MaxPushCommits int
+
+	// PreReceive is called with the ref updates of a push before git
+	// receives the pack. Returning an *ErrorRefsRejected rejects the
+	// listed refs only, any other error rejects the whole push.
+	// Details on the push, including the files it changes, are
+	// available through HookInfoFromContext.
+	PreReceive func(ctx context.Context, updates []RefUpdate) error
+
+	// MaxPackSize is the size the pack of a push, spooled to disk
+	// for PreReceive and RefRules to read, may not exceed (4 GiB
+	// if zero). Pushes with larger packs are rejected.
+	MaxPackSize int64
 }
 
 // Implement the http.Handler interface
@@ -43,18 +141,38 @@ func New(root string) *GitHttp {
 
 // Build root directory if doesn't exist
 func (g *GitHttp) Init() (*GitHttp, error) {
+	if !onDisk(g.storage()) {
+		return g, nil
+	}
 	if err := os.MkdirAll(g.ProjectRoot, os.ModePerm); err != nil {
 		return nil, err
 	}
 	return g, nil
 }
 
+// Size pushed packs may not exceed by default
+const defaultMaxPackSize = 4 << 30
+
+func (g *GitHttp) maxPackSize() int64 {
+	if g.MaxPackSize > 0 {
+		return g.MaxPackSize
+	}
+	return defaultMaxPackSize
+}
+
+// storage returns the Storage holding the repos
+func (g *GitHttp) storage() Storage {
+	if g.Storage != nil {
+		return g.Storage
+	}
+	return FileStorage{}
+}
+
 // Publish event if EventHandler is set
 func (g *GitHttp) event(e Event) {
 	if g.EventHandler != nil {
+		e.stamp(g)
 		g.EventHandler(e)
-	} else {
-		fmt.Printf("EVENT: %q\n", e)
 	}
 }
 
@@ -79,67 +197,233 @@ func (g *GitHttp) serviceRpc(hr HandlerReq) error {
 	}
 	defer reader.Close()
 
+	// Forward the requested protocol version to git, the Go
+	// backend and ref filtering only speaking protocol v0
+	proto := gitProtocol(r)
+	filter := g.refFilter(hr)
+	if _, ok := g.backend().(*GoBackend); ok || filter != nil {
+		proto = ""
+	}
+
+	// Key fetches that may be answered from the cache
+	var body io.Reader = reader
+	var cacheKey string
+	if rpc == "upload-pack" && g.PackCache != nil {
+		body, cacheKey, err = g.PackCache.requestKey(dir, protocolVersion(proto), reader)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Reader that scans for events
 	rpcReader := &RpcReader{
-		Reader: reader,
+		Reader: body,
 		Rpc:    rpc,
 	}
 
+	// Tell the protocol version to scan fetches with
+	if rpc == "upload-pack" {
+		rpcReader.ProtocolVersion = protocolVersion(proto)
+	}
+
+	// Commands and wants are only relayed to git once they parsed,
+	// for hooks and ref filtering to see all of those git would
+	var input io.Reader = rpcReader
+	var header []byte
+	if rpc == "receive-pack" || filter != nil {
+		header, err = rpcReader.readHeader()
+		if err != nil {
+			return err
+		}
+		input = io.MultiReader(bytes.NewReader(header), rpcReader)
+	}
+
+	// Let the PreReceive hook vet the ref updates, refusing
+	// those of hidden refs and those RefRules disallow
+	var rejected map[string]string
+	if rpc == "receive-pack" && (g.PreReceive != nil || filter != nil || g.RefRules != nil) {
+		var cleanup func()
+		input, rejected, cleanup, err = g.preReceive(hr, rpcReader, header, filter)
+		defer cleanup()
+		if err != nil {
+			return err
+		}
+	}
+
 	// Set content type
 	w.Header().Set("Content-Type", fmt.Sprintf("application/x-git-%s-result", rpc))
 
-	args := []string{rpc, "--stateless-rpc", "."}
-	cmd := exec.Command(g.GitBinPath, args...)
-	cmd.Dir = dir
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		return err
+	// Only objects reachable from visible refs may be fetched
+	if rpc == "upload-pack" && filter != nil {
+		hidden, err := filter.hiddenWant(r.Context(), dir, rpcReader)
+		if err != nil {
+			return err
+		}
+		if hidden != "" {
+			w.Write(packetWrite("ERR upload-pack: not our ref " + hidden + "\n"))
+			g.fireEvents(hr, rpcReader, nil, &ErrorRefHidden{hidden})
+			return nil
+		}
 	}
 
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return err
+	// Every ref update was rejected, don't bother git
+	if input == nil {
+		writeReportStatus(w, rpcReader.Capabilities, rejectionLines(rpcReader.Updates, rejected))
+		g.fireEvents(hr, rpcReader, rejected, nil)
+		return nil
 	}
-	defer stdout.Close()
 
-	err = cmd.Start()
-	if err != nil {
-		return err
+	// Replay the response to an identical fetch
+	if cacheKey != "" {
+		if f, ok := g.PackCache.open(cacheKey); ok {
+			defer f.Close()
+			if hr.stats != nil {
+				hr.stats.cacheHit = true
+			}
+			io.Copy(io.Discard, rpcReader)
+			if _, err := io.Copy(w, f); err != nil {
+				g.logger().WarnContext(r.Context(), "copying cached response", "repo", hr.Repo, "rpc", rpc, "error", err)
+			}
+			g.fireEvents(hr, rpcReader, nil, nil)
+			return nil
+		}
+	}
+
+	// Wait for our turn to run git
+	if g.Limiter != nil {
+		g.Metrics.watchLimiter(g.Limiter)
+		release, err := g.Limiter.Acquire(r.Context(), dir)
+		if err != nil {
+			return err
+		}
+		defer release()
 	}
 
+	// Bind git to the request, so it doesn't outlive the client
+	ctx, cancel := g.commandContext(r, g.rpcTimeout(rpc))
+	defer cancel()
+
+	// Run the service, its output being piped to the response
+	backend := g.backend()
+	output, pipe := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		defer func() {
+			// A panicking backend fails the request, not the server
+			if p := recover(); p != nil {
+				err = fmt.Errorf("%s panicked: %v", rpc, p)
+				g.logger().ErrorContext(r.Context(), "backend panicked", "repo", hr.Repo, "rpc", rpc, "panic", p, "stack", string(debug.Stack()))
+			}
+			pipe.Close()
+			done <- err
+		}()
+		if rpc == "upload-pack" {
+			err = backend.UploadPack(ctx, dir, proto, input, pipe)
+		} else {
+			err = backend.ReceivePack(ctx, dir, proto, input, pipe)
+		}
+	}()
+
 	// Scan's git command's output for errors
+	var outputSize int64
 	gitReader := &GitReader{
-		Reader: stdout,
+		Reader: countingReader{output, &outputSize},
 	}
 
-	// Copy input to git binary
-	io.Copy(stdin, rpcReader)
-	stdin.Close()
+	// Keep the response to a cacheable fetch as it's sent
+	var out io.Writer = w
+	var cacheWriter *packCacheWriter
+	if cacheKey != "" {
+		cacheWriter = g.PackCache.create(dir, cacheKey)
+		if cacheWriter != nil {
+			out = io.MultiWriter(w, cacheWriter)
+		}
+	}
 
-	// Write git binary's output to http response
-	io.Copy(w, gitReader)
+	// Write git binary's output to http response,
+	// reporting refs rejected by the PreReceive hook
+	if len(rejected) > 0 {
+		err = relayReportStatus(w, gitReader, rpcReader.Capabilities, rejectionLines(rpcReader.Updates, rejected))
+	} else {
+		_, err = io.Copy(out, gitReader)
+	}
+	copyErr := err
+	if err != nil {
+		g.logger().WarnContext(r.Context(), "copying git output to response", "repo", hr.Repo, "rpc", rpc, "error", err)
+	}
 
 	// Wait till command has completed
-	mainError := cmd.Wait()
-
-	if mainError == nil {
+	output.Close()
+	mainError := <-done
+	hr.stats.serviceDone(backend, mainError)
+
+	// The service couldn't be started, or was killed
+	// before sending anything, nothing was sent yet
+	started := outputSize > 0 || mainError == nil || isExitError(mainError)
+
+	if ctx.Err() != nil {
+		mainError = &ErrorCanceled{rpc, ctx.Err()}
+		started = outputSize > 0
+	} else if mainError == nil {
 		mainError = gitReader.GitError
 	}
 
-	// Fire events
+	if !started {
+		if cacheWriter != nil {
+			cacheWriter.abort()
+		}
+		g.fireEvents(hr, rpcReader, rejected, mainError)
+		return mainError
+	}
+
+	if cacheWriter != nil {
+		if mainError == nil && copyErr == nil {
+			cacheWriter.commit()
+		} else {
+			cacheWriter.abort()
+		}
+	}
+
+	// Cached fetches may no longer match the repo
+	if rpc == "receive-pack" && g.PackCache != nil {
+		g.PackCache.Invalidate(dir)
+	}
+
+	// Tell fast-forwards from history rewrites
+	if rpc == "receive-pack" && mainError == nil {
+		g.detectForcePushes(ctx, dir, rpcReader, rejected)
+		if g.PushCommits {
+			g.attachCommits(ctx, dir, rpcReader, rejected)
+		}
+	}
+
+	g.fireEvents(hr, rpcReader, rejected, mainError)
+
+	// Because a response was already written,
+	// the header cannot be changed
+	return nil
+}
+
+// fireEvents publishes the events picked up by rpcReader.
+// Events of refs rejected by the PreReceive hook carry the rejection.
+func (g *GitHttp) fireEvents(hr HandlerReq, rpcReader *RpcReader, rejected map[string]string, mainError error) {
 	for _, e := range rpcReader.Events {
 		// Set directory to current repo
-		e.Dir = dir
+		e.Repo = hr.Repo
+		e.Dir = hr.Dir
 		e.Request = hr.r
 		e.Error = mainError
 
+		if e.Update != nil {
+			if reason, ok := rejected[e.Update.Ref]; ok {
+				e.Error = &ErrorRefsRejected{map[string]string{e.Update.Ref: reason}}
+			}
+		}
+
 		// Fire event
 		g.event(e)
 	}
-
-	// Because a response was already written,
-	// the header cannot be changed
-	return nil
 }
 
 func (g *GitHttp) getInfoRefs(hr HandlerReq) error {
@@ -150,23 +434,53 @@ func (g *GitHttp) getInfoRefs(hr HandlerReq) error {
 		return err
 	}
 
+	ctx, cancel := g.commandContext(r, g.AdvertiseTimeout)
+	defer cancel()
+
 	if !access {
-		g.updateServerInfo(dir)
+		// The dumb protocol can still be served from stale info
+		// files, which git can only update for repos on disk
+		if onDisk(g.storage()) {
+			if _, err := g.updateServerInfo(ctx, dir); err != nil {
+				g.logger().WarnContext(r.Context(), "updating server info", "repo", hr.Repo, "error", err)
+			}
+		}
 		hdrNocache(w)
-		return sendFile("text/plain; charset=utf-8", hr)
+		return g.sendFile("text/plain; charset=utf-8", hr)
 	}
 
-	args := []string{service_name, "--stateless-rpc", "--advertise-refs", "."}
-	refs, err := g.gitCommand(dir, args...)
+	// Refs are only filtered in protocol v0 advertisements
+	proto := gitProtocol(r)
+	filter := g.refFilter(hr)
+	if filter != nil {
+		proto = ""
+	}
+
+	backend := g.backend()
+	refs, err := backend.AdvertiseRefs(ctx, dir, service_name, proto)
+	hr.stats.serviceDone(backend, err)
+	if ctx.Err() != nil {
+		return &ErrorCanceled{service_name, ctx.Err()}
+	}
 	if err != nil {
 		return err
 	}
+	if filter != nil {
+		if refs, err = filter.filterAdvertisement(refs); err != nil {
+			return err
+		}
+	}
 
 	hdrNocache(w)
 	w.Header().Set("Content-Type", fmt.Sprintf("application/x-git-%s-advertisement", service_name))
 	w.WriteHeader(http.StatusOK)
-	w.Write(packetWrite("# service=git-" + service_name + "\n"))
-	w.Write(packetFlush())
+
+	// A protocol v2 capability advertisement is sent as is,
+	// without the service announcement (like git http-backend)
+	if !isV2Advertisement(refs) {
+		w.Write(packetWrite("# service=git-" + service_name + "\n"))
+		w.Write(packetFlush())
+	}
 	w.Write(refs)
 
 	return nil
@@ -174,67 +488,198 @@ func (g *GitHttp) getInfoRefs(hr HandlerReq) error {
 
 func (g *GitHttp) getInfoPacks(hr HandlerReq) error {
 	hdrCacheForever(hr.w)
-	return sendFile("text/plain; charset=utf-8", hr)
+	return g.sendFile("text/plain; charset=utf-8", hr)
 }
 
 func (g *GitHttp) getLooseObject(hr HandlerReq) error {
+	if err := g.checkObjectFormat(hr); err != nil {
+		return err
+	}
 	hdrCacheForever(hr.w)
-	return sendFile("application/x-git-loose-object", hr)
+	return g.sendFile("application/x-git-loose-object", hr)
 }
 
 func (g *GitHttp) getPackFile(hr HandlerReq) error {
+	if err := g.checkObjectFormat(hr); err != nil {
+		return err
+	}
 	hdrCacheForever(hr.w)
-	return sendFile("application/x-git-packed-objects", hr)
+	return g.sendFile("application/x-git-packed-objects", hr)
 }
 
 func (g *GitHttp) getIdxFile(hr HandlerReq) error {
+	if err := g.checkObjectFormat(hr); err != nil {
+		return err
+	}
 	hdrCacheForever(hr.w)
-	return sendFile("application/x-git-packed-objects-toc", hr)
+	return g.sendFile("application/x-git-packed-objects-toc", hr)
 }
 
 func (g *GitHttp) getTextFile(hr HandlerReq) error {
 	hdrNocache(hr.w)
-	return sendFile("text/plain", hr)
+	return g.sendFile("text/plain", hr)
 }
 
 // Logic helping functions
 
-func sendFile(content_type string, hr HandlerReq) error {
+func (g *GitHttp) sendFile(content_type string, hr HandlerReq) error {
 	w, r := hr.w, hr.r
-	req_file := path.Join(hr.Dir, hr.File)
+	if !fs.ValidPath(hr.File) {
+		return os.ErrNotExist
+	}
+
+	f, err := g.storage().Open(hr.Dir, hr.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
-	f, err := os.Stat(req_file)
+	fi, err := f.Stat()
 	if err != nil {
 		return err
 	}
+	if fi.IsDir() {
+		return os.ErrNotExist
+	}
 
 	w.Header().Set("Content-Type", content_type)
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", f.Size()))
-	w.Header().Set("Last-Modified", f.ModTime().Format(http.TimeFormat))
-	http.ServeFile(w, r, req_file)
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", fi.Size()))
+	w.Header().Set("Last-Modified", fi.ModTime().Format(http.TimeFormat))
+	http.ServeContent(w, r, path.Base(hr.File), fi.ModTime(), f)
 
 	return nil
 }
 
-func (g *GitHttp) getGitDir(file_path string) (string, error) {
-	root := g.ProjectRoot
+// checkObjectFormat makes sure the object or pack requested
+// is named by an id of the repo's object format
+func (g *GitHttp) checkObjectFormat(hr HandlerReq) error {
+	if len(fileObjectId(hr.File)) != repoObjectFormat(g.storage(), hr.Dir).HexSize() {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// ResolveRepo returns the directory of the repo named by the repo
+// component of a request's URL, as GitHttp's own handlers would
+func (g *GitHttp) ResolveRepo(r *http.Request, repo string) (string, error) {
+	return g.getGitDir(r, repo)
+}
+
+func (g *GitHttp) getGitDir(r *http.Request, repo string) (string, error) {
+	resolver := g.Resolver
+	if resolver == nil {
+		resolver = RootResolver{g.ProjectRoot, g.Strict, g.Storage}
+	}
+
+	dir, err := resolver.Resolve(r.Context(), r, repo)
+	if err != nil {
+		return "", err
+	}
+
+	if g.Strict && !isBareRepo(g.storage(), dir) {
+		return "", &ErrorRepoNotFound{repo, ""}
+	}
+
+	return dir, nil
+}
+
+// detectForcePushes marks branch updates that weren't fast-forwards
+// as forced and turns their events into PUSH_FORCE events
+func (g *GitHttp) detectForcePushes(ctx context.Context, dir string, rpcReader *RpcReader, rejected map[string]string) {
+	for i, e := range rpcReader.Events {
+		u := e.Update
+		if u == nil || u.Kind != REF_UPDATE || !u.IsBranch() {
+			continue
+		}
+		if _, ok := rejected[u.Ref]; ok {
+			continue
+		}
+
+		forced, err := g.isForced(ctx, dir, *u)
+		if err != nil || !forced {
+			continue
+		}
+
+		u.Forced = true
+		rpcReader.Events[i].Type = PUSH_FORCE
+	}
+}
+
+// isForced reports whether the ref was updated to
+// a commit that doesn't descend from its old commit
+func (g *GitHttp) isForced(ctx context.Context, dir string, u RefUpdate) (bool, error) {
+	if b, ok := g.backend().(*GoBackend); ok {
+		return b.isForced(ctx, dir, u)
+	}
+
+	args := []string{"merge-base", "--is-ancestor", u.Old, u.New}
+	_, err := g.gitCommand(ctx, dir, args...)
+	if err == nil {
+		return false, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+		return false, err
+	}
 
-	if root == "" {
-		cwd, err := os.Getwd()
+	// Git may have refused the update itself
+	args = []string{"rev-parse", "--verify", "--quiet", u.Ref}
+	out, err := g.gitCommand(ctx, dir, args...)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(out)) == u.New, nil
+}
 
+// createRepo creates the missing repo a push is targeting
+// in dir with "git init --bare", if AutoCreate allows it
+func (g *GitHttp) createRepo(r *http.Request, repo string, dir string) error {
+	if g.AllowCreate != nil {
+		allowed, err := g.AllowCreate(r, repo)
 		if err != nil {
-			return "", err
+			return err
 		}
+		if !allowed {
+			return &ErrorNoAccess{dir}
+		}
+	}
 
-		root = cwd
+	// Git can only create repos on disk,
+	// without template in other storages
+	if s := g.storage(); !onDisk(s) {
+		err := initRepo(s, dir, g.DefaultBranch)
+		g.event(Event{
+			Type:    CREATE,
+			Repo:    repo,
+			Dir:     dir,
+			Error:   err,
+			Request: r,
+		})
+		return err
 	}
 
-	f := path.Join(root, file_path)
-	if _, err := os.Stat(f); os.IsNotExist(err) {
-		return "", err
+	args := []string{"init", "--bare", "--quiet"}
+	if g.TemplateDir != "" {
+		args = append(args, "--template="+g.TemplateDir)
+	}
+	if g.DefaultBranch != "" {
+		args = append(args, "--initial-branch="+g.DefaultBranch)
 	}
+	args = append(args, "--", dir)
+
+	ctx, cancel := g.commandContext(r, g.AdvertiseTimeout)
+	defer cancel()
+
+	_, err := g.gitCommand(ctx, "", args...)
 
-	return f, nil
+	g.event(Event{
+		Type:    CREATE,
+		Repo:    repo,
+		Dir:     dir,
+		Error:   err,
+		Request: r,
+	})
+
+	return err
 }
 
 func (g *GitHttp) hasAccess(r *http.Request, dir string, rpc string, check_content_type bool) (bool, error) {
@@ -254,12 +699,12 @@ func (g *GitHttp) hasAccess(r *http.Request, dir string, rpc string, check_conte
 		return g.UploadPack, nil
 	}
 
-	return g.getConfigSetting(rpc, dir)
+	return g.getConfigSetting(r.Context(), rpc, dir)
 }
 
-func (g *GitHttp) getConfigSetting(service_name string, dir string) (bool, error) {
+func (g *GitHttp) getConfigSetting(ctx context.Context, service_name string, dir string) (bool, error) {
 	service_name = strings.Replace(service_name, "-", "", -1)
-	setting, err := g.getGitConfig("http."+service_name, dir)
+	setting, err := g.getGitConfig(ctx, "http."+service_name, dir)
 	if err != nil {
 		return false, nil
 	}
@@ -271,23 +716,85 @@ func (g *GitHttp) getConfigSetting(service_name string, dir string) (bool, error
 	return setting == "true", nil
 }
 
-func (g *GitHttp) getGitConfig(config_name string, dir string) (string, error) {
+func (g *GitHttp) getGitConfig(ctx context.Context, config_name string, dir string) (string, error) {
+	// Only the exec backend relies on git being installed
+	if _, ok := g.backend().(execBackend); !ok {
+		i := strings.LastIndex(config_name, ".")
+		value, ok := readConfig(g.storage(), dir, config_name[:i], config_name[i+1:])
+		if !ok {
+			return "", os.ErrNotExist
+		}
+		return value, nil
+	}
+
 	args := []string{"config", config_name}
-	out, err := g.gitCommand(dir, args...)
+	out, err := g.gitCommand(ctx, dir, args...)
 	if err != nil {
 		return "", err
 	}
 	return string(out)[0 : len(out)-1], nil
 }
 
-func (g *GitHttp) updateServerInfo(dir string) ([]byte, error) {
+func (g *GitHttp) updateServerInfo(ctx context.Context, dir string) ([]byte, error) {
 	args := []string{"update-server-info"}
-	return g.gitCommand(dir, args...)
+	return g.gitCommand(ctx, dir, args...)
+}
+
+func (g *GitHttp) gitCommand(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	return g.gitCommandEnv(ctx, dir, nil, args...)
+}
+
+func (g *GitHttp) gitCommandEnv(ctx context.Context, dir string, env []string, args ...string) ([]byte, error) {
+	command := g.newCommand(ctx, dir, args...)
+	command.Env = env
+
+	start := time.Now()
+	g.Metrics.processStarted()
+	out, err := command.Output()
+	g.Metrics.processDone(args, time.Since(start))
+	g.logCommand(ctx, dir, args, start, command.ProcessState.ExitCode(), err)
+
+	return out, err
 }
 
-func (g *GitHttp) gitCommand(dir string, args ...string) ([]byte, error) {
-	command := exec.Command(g.GitBinPath, args...)
+// newCommand returns a git command that is killed, along with
+// any processes it spawned, once ctx is done
+func (g *GitHttp) newCommand(ctx context.Context, dir string, args ...string) *exec.Cmd {
+	command := exec.CommandContext(ctx, g.GitBinPath, args...)
 	command.Dir = dir
+	command.WaitDelay = killWaitDelay
+	setProcessGroup(command)
 
-	return command.Output()
+	return command
+}
+
+// killWaitDelay bounds how long to wait for a killed
+// git process' output to be closed
+const killWaitDelay = 5 * time.Second
+
+// commandContext returns the context to run git in for a request
+func (g *GitHttp) commandContext(r *http.Request, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(r.Context(), timeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
+func (g *GitHttp) rpcTimeout(rpc string) time.Duration {
+	switch rpc {
+	case "upload-pack":
+		return g.UploadPackTimeout
+	case "receive-pack":
+		return g.ReceivePackTimeout
+	}
+	return 0
+}
+
+// gitEnv returns the environment for a spawned git process,
+// passing on the client's Git-Protocol header as GIT_PROTOCOL
+func gitEnv(proto string) []string {
+	if proto == "" {
+		return nil
+	}
+	return append(os.Environ(), "GIT_PROTOCOL="+proto)
 }
@@ -0,0 +1,485 @@
+package githttp
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// GoBackend serves fetches and pushes in process, reading and writing
+// the refs and objects of repos straight from their Storage, so that
+// git doesn't need to be installed:
+//
+//	git.Backend = &githttp.GoBackend{}
+//
+// It speaks protocol v0, which clients asking for v2 fall back to,
+// without shallow fetches, and sends packs without deltas. Pushed
+// packs are kept as they are, with their index. Only exact renames
+// are detected in the Changes of PushCommits.
+type GoBackend struct {
+	// Storage holds the repos, the Storage of the GitHttp
+	// it's the backend of if nil, or else the local disk
+	Storage Storage
+
+	// MaxObjectSize is the size pushed objects may not exceed,
+	// deltas being resolved (1 GiB if zero)
+	MaxObjectSize int64
+
+	// MaxPackSize is the size pushed packs, spooled to disk
+	// before they're stored, may not exceed (4 GiB if zero)
+	MaxPackSize int64
+}
+
+func (b *GoBackend) storage() Storage {
+	if b.Storage != nil {
+		return b.Storage
+	}
+	return FileStorage{}
+}
+
+func (b *GoBackend) maxObjectSize() int64 {
+	if b.MaxObjectSize > 0 {
+		return b.MaxObjectSize
+	}
+	return 1 << 30
+}
+
+func (b *GoBackend) maxPackSize() int64 {
+	if b.MaxPackSize > 0 {
+		return b.MaxPackSize
+	}
+	return defaultMaxPackSize
+}
+
+// Capabilities advertised for upload-pack,
+// along with symref, object-format and agent
+var goUploadPackCapabilities = []string{
+	"multi_ack_detailed",
+	"side-band-64k",
+	"side-band",
+	"no-progress",
+}
+
+func (b *GoBackend) AdvertiseRefs(ctx context.Context, dir string, service string, proto string) ([]byte, error) {
+	db, err := openObjectDB(b.storage(), dir)
+	if err != nil {
+		return nil, err
+	}
+	defer db.close()
+
+	refs, err := listRefs(b.storage(), dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only fetches care about HEAD
+	var caps []string
+	head, headId, hasHead := readHead(b.storage(), dir, refs)
+	if service == "upload-pack" {
+		caps = append(caps, goUploadPackCapabilities...)
+		if head != "" && hasHead {
+			caps = append(caps, "symref=HEAD:"+head)
+		}
+	} else {
+		caps = append(caps, goReceivePackCapabilities...)
+		hasHead = false
+	}
+	caps = append(caps, "object-format="+string(db.format), "agent=go-git-http/"+VERSION)
+
+	// Capabilities follow the first ref
+	var buf bytes.Buffer
+	writeRef := func(id string, name string) {
+		line := id + " " + name
+		if buf.Len() == 0 {
+			line += "\x00" + strings.Join(caps, " ")
+		}
+		buf.Write(packetWrite(line + "\n"))
+	}
+
+	if hasHead {
+		writeRef(headId, "HEAD")
+	}
+	for _, r := range refs {
+		writeRef(r.id, r.name)
+
+		// Annotated tags are followed by the object they point to
+		if service != "upload-pack" {
+			continue
+		}
+		if typ, _, err := db.read(r.id); err == nil && typ == objTag {
+			if peeled, _, err := db.peel(r.id); err == nil {
+				writeRef(peeled, r.name+"^{}")
+			}
+		}
+	}
+	if buf.Len() == 0 {
+		writeRef(strings.Repeat("0", db.format.HexSize()), "capabilities^{}")
+	}
+	buf.Write(packetFlush())
+
+	return buf.Bytes(), nil
+}
+
+// uploadRequest is a round of negotiation of a stateless fetch
+type uploadRequest struct {
+	wants []string
+	caps  []string
+	haves []string
+
+	// Whether the client is done negotiating
+	// and waiting for the pack
+	done bool
+}
+
+func readUploadRequest(r *bufio.Reader) (*uploadRequest, error) {
+	req := &uploadRequest{}
+
+	// Wants, up to a flush-pkt
+	for {
+		pkt, err := readPacket(r)
+		if err == io.EOF && len(req.wants) == 0 {
+			return req, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if pkt == nil {
+			break
+		}
+
+		fields := strings.Fields(string(pkt))
+		if len(fields) < 2 || fields[0] != "want" || !isObjectId(fields[1]) {
+			return nil, fmt.Errorf("unexpected line '%s'", strings.TrimSpace(string(pkt)))
+		}
+		if len(req.wants) == 0 {
+			req.caps = fields[2:]
+		}
+		req.wants = append(req.wants, strings.ToLower(fields[1]))
+	}
+
+	// Haves, up to a flush-pkt or "done"
+	for {
+		pkt, err := readPacket(r)
+		if err == io.EOF {
+			return req, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if pkt == nil {
+			return req, nil
+		}
+
+		line := strings.TrimSpace(string(pkt))
+		if line == "done" {
+			req.done = true
+			return req, nil
+		}
+		id, ok := strings.CutPrefix(line, "have ")
+		if !ok || !isObjectId(id) {
+			return nil, fmt.Errorf("unexpected line '%s'", line)
+		}
+		req.haves = append(req.haves, strings.ToLower(id))
+	}
+}
+
+func (b *GoBackend) UploadPack(ctx context.Context, dir string, proto string, in io.Reader, out io.Writer) error {
+	db, err := openObjectDB(b.storage(), dir)
+	if err != nil {
+		return err
+	}
+	defer db.close()
+
+	req, err := readUploadRequest(bufio.NewReader(in))
+	if err != nil {
+		return err
+	}
+	if len(req.wants) == 0 {
+		return nil
+	}
+
+	// Only advertised refs may be fetched
+	refs, err := listRefs(b.storage(), dir)
+	if err != nil {
+		return err
+	}
+	tips := map[string]bool{}
+	for _, r := range refs {
+		tips[r.id] = true
+	}
+	for _, want := range req.wants {
+		if !tips[want] {
+			out.Write(packetWrite("ERR upload-pack: not our ref " + want + "\n"))
+			return fmt.Errorf("not our ref %s", want)
+		}
+	}
+
+	// Acknowledge the objects we have in common, with the client
+	// resending them in later rounds since we don't keep state
+	multiAck := slices.Contains(req.caps, "multi_ack_detailed")
+	var common []string
+	for _, have := range req.haves {
+		if !db.has(have) {
+			continue
+		}
+		common = append(common, have)
+		if multiAck {
+			out.Write(packetWrite("ACK " + have + " common\n"))
+		} else if len(common) == 1 {
+			out.Write(packetWrite("ACK " + have + "\n"))
+		}
+	}
+
+	if !req.done {
+		if multiAck || len(common) == 0 {
+			out.Write(packetWrite("NAK\n"))
+		}
+		return nil
+	}
+	if len(common) == 0 {
+		out.Write(packetWrite("NAK\n"))
+	} else if multiAck {
+		out.Write(packetWrite("ACK " + common[len(common)-1] + "\n"))
+	}
+
+	objects, err := db.missingObjects(ctx, req.wants, common)
+	if err == nil {
+		err = writePackResponse(ctx, db, out, req.caps, objects)
+	}
+	return err
+}
+
+// writePackResponse writes the pack of objects,
+// multiplexed on side-band if the client asked for it
+func writePackResponse(ctx context.Context, db *objectDB, out io.Writer, caps []string, objects []string) error {
+	limit := sidebandLimit(caps)
+	if limit == 0 {
+		return db.writePack(ctx, out, objects)
+	}
+
+	bw := bufio.NewWriterSize(sidebandWriter{out, limit}, limit)
+	err := db.writePack(ctx, bw, objects)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		writeSideband(out, sidebandError, []byte("error: "+err.Error()+"\n"), limit)
+		return err
+	}
+	_, err = out.Write(packetFlush())
+	return err
+}
+
+// sidebandWriter sends data on the side-band data channel
+type sidebandWriter struct {
+	w     io.Writer
+	limit int
+}
+
+func (s sidebandWriter) Write(p []byte) (int, error) {
+	if err := writeSideband(s.w, sidebandData, p, s.limit); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// missingObjects returns the objects reachable from wants,
+// but not from the commits the client has
+func (db *objectDB) missingObjects(ctx context.Context, wants []string, haves []string) ([]string, error) {
+	// Tags, trees and blobs wanted, down to the commits
+	var objects, trees, commitWants []string
+	seen := map[string]bool{}
+	queue := append([]string{}, wants...)
+	for len(queue) > 0 {
+		id := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if seen[id] {
+			continue
+		}
+
+		typ, data, err := db.read(id)
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case objCommit:
+			commitWants = append(commitWants, id)
+		case objTree:
+			// Walked along with the trees of commits
+			trees = append(trees, id)
+		case objTag:
+			target, _, err := parseTag(data)
+			if err != nil {
+				return nil, fmt.Errorf("tag %s: %v", id, err)
+			}
+			seen[id] = true
+			objects = append(objects, id)
+			queue = append(queue, target)
+		case objBlob:
+			seen[id] = true
+			objects = append(objects, id)
+		}
+	}
+
+	// Commits the client lacks, and those on the
+	// boundary of what it has
+	commits, boundary, err := db.newCommits(ctx, commitWants, haves)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range commits {
+		seen[c.id] = true
+		objects = append(objects, c.id)
+		trees = append(trees, c.tree)
+	}
+
+	// Trees and blobs of the boundary are assumed to be
+	// on the client, those under wanted trees are sent
+	for _, id := range boundary {
+		data, err := db.readType(id, objCommit)
+		if err != nil {
+			return nil, err
+		}
+		c, err := parseCommit(data)
+		if err != nil {
+			return nil, fmt.Errorf("commit %s: %v", id, err)
+		}
+		if err := db.walkTree(ctx, c.tree, seen, nil); err != nil {
+			return nil, err
+		}
+	}
+	for _, id := range trees {
+		err := db.walkTree(ctx, id, seen, func(id string) {
+			objects = append(objects, id)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return objects, nil
+}
+
+// walkTree calls visit, if not nil, for a tree and the trees and blobs
+// under it, depth first. Objects in seen are skipped, visited ones are
+// added to it. The trees being walked are kept on a stack of their own,
+// so that deeply nested trees don't take a stack frame per level.
+func (db *objectDB) walkTree(ctx context.Context, id string, seen map[string]bool, visit func(id string)) error {
+	// Entries of the trees being walked, left to visit
+	var stack [][]treeEntry
+
+	enter := func(id string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		seen[id] = true
+		if visit != nil {
+			visit(id)
+		}
+
+		data, err := db.readType(id, objTree)
+		if err != nil {
+			return err
+		}
+		entries, err := parseTree(data, db.format.HexSize()/2)
+		if err != nil {
+			return fmt.Errorf("tree %s: %v", id, err)
+		}
+		stack = append(stack, entries)
+		return nil
+	}
+
+	if seen[id] {
+		return nil
+	}
+	if err := enter(id); err != nil {
+		return err
+	}
+
+	for len(stack) > 0 {
+		entries := stack[len(stack)-1]
+		if len(entries) == 0 {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		e := entries[0]
+		stack[len(stack)-1] = entries[1:]
+
+		switch {
+		case e.mode == gitlinkMode:
+			// Submodule commits aren't ours
+		case e.isTree():
+			if seen[e.id] {
+				continue
+			}
+			if err := enter(e.id); err != nil {
+				return err
+			}
+		case !seen[e.id]:
+			seen[e.id] = true
+			if visit != nil {
+				visit(e.id)
+			}
+		}
+	}
+	return nil
+}
+
+// writePack writes a version 2 pack of the objects, none being deltified
+func (db *objectDB) writePack(ctx context.Context, w io.Writer, objects []string) error {
+	h := db.newHash()
+	pw := io.MultiWriter(w, h)
+
+	var header [12]byte
+	copy(header[:], "PACK")
+	binary.BigEndian.PutUint32(header[4:], 2)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(objects)))
+	if _, err := pw.Write(header[:]); err != nil {
+		return err
+	}
+
+	zw := zlib.NewWriter(pw)
+	for _, id := range objects {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		typ, data, err := db.read(id)
+		if err != nil {
+			return err
+		}
+		if _, err := pw.Write(packEntryHeader(typ, int64(len(data)))); err != nil {
+			return err
+		}
+		zw.Reset(pw)
+		if _, err := zw.Write(data); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+
+	_, err := w.Write(h.Sum(nil))
+	return err
+}
+
+// packEntryHeader encodes the type and size of a pack entry
+func packEntryHeader(typ objectType, size int64) []byte {
+	c := byte(typ)<<4 | byte(size&15)
+	size >>= 4
+
+	var header []byte
+	for size > 0 {
+		header = append(header, c|0x80)
+		c = byte(size & 0x7f)
+		size >>= 7
+	}
+	return append(header, c)
+}
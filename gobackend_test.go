@@ -0,0 +1,397 @@
+package githttp
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writeObject writes a loose object to the repo in dir
+func writeObject(t *testing.T, dir string, typ objectType, data []byte) string {
+	db := &objectDB{format: SHA1}
+	id := db.hashObject(typ, data)
+
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write([]byte(typ.String() + " " + strconv.Itoa(len(data)) + "\x00"))
+	zw.Write(data)
+	zw.Close()
+
+	path := looseObjectPath(filepath.Join(dir, "objects"), id)
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func treeData(entries ...treeEntry) []byte {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		raw, _ := hex.DecodeString(e.id)
+		buf.WriteString(e.mode + " " + e.name + "\x00")
+		buf.Write(raw)
+	}
+	return buf.Bytes()
+}
+
+func commitData(tree string, parents ...string) []byte {
+	data := "tree " + tree + "\n"
+	for _, p := range parents {
+		data += "parent " + p + "\n"
+	}
+	return []byte(data + "author T <t@e> 0 +0000\ncommitter T <t@e> 0 +0000\n\nmessage\n")
+}
+
+// testRepo holds the objects of a repo with two commits,
+// the first tagged v1
+type testRepo struct {
+	dir              string
+	blobA, blobB     string
+	tree1, tree2     string
+	commit1, commit2 string
+	tag              string
+}
+
+func makeTestRepo(t *testing.T) testRepo {
+	r := testRepo{dir: t.TempDir()}
+	makeBareRepo(t, r.dir, true)
+
+	r.blobA = writeObject(t, r.dir, objBlob, []byte("a\n"))
+	r.blobB = writeObject(t, r.dir, objBlob, []byte("b\n"))
+	r.tree1 = writeObject(t, r.dir, objTree, treeData(treeEntry{"100644", "a.txt", r.blobA}))
+	r.tree2 = writeObject(t, r.dir, objTree, treeData(treeEntry{"100644", "a.txt", r.blobA}, treeEntry{"100644", "b.txt", r.blobB}))
+	r.commit1 = writeObject(t, r.dir, objCommit, commitData(r.tree1))
+	r.commit2 = writeObject(t, r.dir, objCommit, commitData(r.tree2, r.commit1))
+	r.tag = writeObject(t, r.dir, objTag, []byte("object "+r.commit1+"\ntype commit\ntag v1\ntagger T <t@e> 0 +0000\n\nv1\n"))
+
+	os.WriteFile(filepath.Join(r.dir, "refs", "heads", "master"), []byte(r.commit2+"\n"), 0644)
+	os.WriteFile(filepath.Join(r.dir, "packed-refs"), []byte("# pack-refs with: peeled fully-peeled sorted\n"+r.tag+" refs/tags/v1\n^"+r.commit1+"\n"), 0644)
+	return r
+}
+
+func TestGoBackendAdvertiseRefs(t *testing.T) {
+	r := makeTestRepo(t)
+
+	refs, err := (&GoBackend{}).AdvertiseRefs(context.Background(), r.dir, "upload-pack", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := readPackets(t, refs)
+	want := []string{
+		r.commit2 + " HEAD\x00multi_ack_detailed side-band-64k side-band no-progress symref=HEAD:refs/heads/master object-format=sha1 agent=go-git-http/" + VERSION + "\n",
+		r.commit2 + " refs/heads/master\n",
+		r.tag + " refs/tags/v1\n",
+		r.commit1 + " refs/tags/v1^{}\n",
+		"",
+	}
+	if strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Fatalf("got %q\nwant %q", lines, want)
+	}
+
+	// Empty repos only advertise capabilities
+	empty := t.TempDir()
+	makeBareRepo(t, empty, true)
+	refs, err = (&GoBackend{}).AdvertiseRefs(context.Background(), empty, "upload-pack", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(refs, []byte(zeroId+" capabilities^{}\x00multi_ack_detailed")) {
+		t.Fatalf("got %q", refs)
+	}
+}
+
+func TestGoBackendUploadPack(t *testing.T) {
+	r := makeTestRepo(t)
+
+	tests := []struct {
+		name    string
+		req     []byte
+		lines   []string
+		objects []string
+	}{
+		{
+			"clone",
+			fetchRequest("want "+r.commit2+" side-band-64k", "want "+r.tag, "", "done"),
+			[]string{"NAK\n"},
+			[]string{r.blobA, r.blobB, r.tree1, r.tree2, r.commit1, r.commit2, r.tag},
+		},
+		{
+			"fetch",
+			fetchRequest("want "+r.commit2+" multi_ack_detailed", "", "have "+r.commit1, "done"),
+			[]string{"ACK " + r.commit1 + " common\n", "ACK " + r.commit1 + "\n"},
+			[]string{r.blobB, r.tree2, r.commit2},
+		},
+		{
+			"negotiation",
+			fetchRequest("want "+r.commit2+" multi_ack_detailed", "", "have "+zeroId, "have "+r.commit1, ""),
+			[]string{"ACK " + r.commit1 + " common\n", "NAK\n"},
+			nil,
+		},
+		{
+			"no common commit",
+			fetchRequest("want "+r.commit2, "", "have "+zeroId, ""),
+			[]string{"NAK\n"},
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		err := (&GoBackend{}).UploadPack(context.Background(), r.dir, "", bytes.NewReader(tt.req), &out)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		br := bufio.NewReader(&out)
+		var lines []string
+		for range tt.lines {
+			pkt, err := readPacket(br)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			lines = append(lines, string(pkt))
+		}
+		if strings.Join(lines, "|") != strings.Join(tt.lines, "|") {
+			t.Errorf("%s: got %q, want %q", tt.name, lines, tt.lines)
+		}
+
+		rest, _ := io.ReadAll(br)
+		if tt.objects == nil {
+			if len(rest) > 0 {
+				t.Errorf("%s: unexpected pack %q", tt.name, rest)
+			}
+			continue
+		}
+		if bytes.Contains(tt.req, []byte("side-band-64k")) {
+			rest = demuxSideband(t, rest)
+		}
+
+		got := readPackIds(t, rest)
+		sort.Strings(got)
+		sort.Strings(tt.objects)
+		if strings.Join(got, " ") != strings.Join(tt.objects, " ") {
+			t.Errorf("%s: got objects %v, want %v", tt.name, got, tt.objects)
+		}
+	}
+}
+
+func TestGoBackendNotOurRef(t *testing.T) {
+	r := makeTestRepo(t)
+
+	var out bytes.Buffer
+	req := fetchRequest("want "+r.commit1, "", "done")
+	err := (&GoBackend{}).UploadPack(context.Background(), r.dir, "", bytes.NewReader(req), &out)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.HasSuffix(out.String(), "ERR upload-pack: not our ref "+r.commit1+"\n") {
+		t.Fatalf("got %q", out.String())
+	}
+}
+
+func TestMissingObjectsStopsEarly(t *testing.T) {
+	r := makeTestRepo(t)
+
+	// A long history on top of commit2, each commit newer than its parent
+	dated := func(tree string, date int, parents ...string) []byte {
+		data := "tree " + tree + "\n"
+		for _, p := range parents {
+			data += "parent " + p + "\n"
+		}
+		return []byte(fmt.Sprintf("%sauthor T <t@e> %d +0000\ncommitter T <t@e> %d +0000\n\nmessage\n", data, date, date))
+	}
+	history := []string{r.commit2}
+	for i := 1; i <= 50; i++ {
+		history = append(history, writeObject(t, r.dir, objCommit, dated(r.tree2, i, history[i-1])))
+	}
+	blobC := writeObject(t, r.dir, objBlob, []byte("c\n"))
+	tree3 := writeObject(t, r.dir, objTree, treeData(treeEntry{"100644", "a.txt", r.blobA}, treeEntry{"100644", "c.txt", blobC}))
+	tip := writeObject(t, r.dir, objCommit, dated(tree3, 51, history[50]))
+	merge := writeObject(t, r.dir, objCommit, dated(tree3, 52, tip, history[10]))
+
+	// The walk doesn't go down to the old history the client has
+	os.Chmod(looseObjectPath(filepath.Join(r.dir, "objects"), r.commit1), 0644)
+	os.WriteFile(looseObjectPath(filepath.Join(r.dir, "objects"), r.commit1), []byte("corrupt"), 0644)
+
+	db, err := openObjectDB(FileStorage{}, r.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	tests := []struct {
+		wants []string
+		want  []string
+	}{
+		{[]string{tip}, []string{blobC, tree3, tip}},
+		{[]string{merge}, []string{blobC, tree3, tip, merge}},
+		{[]string{history[50]}, nil},
+	}
+	for _, tt := range tests {
+		got, err := db.missingObjects(context.Background(), tt.wants, []string{history[50]})
+		if err != nil {
+			t.Fatalf("%v: %v", tt.wants, err)
+		}
+		sort.Strings(got)
+		sort.Strings(tt.want)
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%v: got %v, want %v", tt.wants, got, tt.want)
+		}
+	}
+}
+
+func TestApplyDelta(t *testing.T) {
+	base := []byte("hello world, hello git")
+	delta := []byte{
+		byte(len(base)), 17, // base and result sizes
+		0x91, 0, 6, // copy 6 bytes from offset 0
+		5, 't', 'h', 'e', 'r', 'e', // insert "there"
+		0x91, 11, 6, // copy 6 bytes from offset 11
+	}
+
+	got, err := applyDelta(base, delta, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello there, hell" {
+		t.Fatalf("got %q", got)
+	}
+
+	if _, err := applyDelta([]byte("short"), delta, 0); err == nil {
+		t.Fatal("expected an error for a wrong base")
+	}
+	if _, err := applyDelta(base, delta, 16); !errors.Is(err, errObjectTooLarge) {
+		t.Fatalf("got %v for a result over the max", err)
+	}
+
+	// Claimed sizes aren't allocated upfront
+	huge := append([]byte{byte(len(base)), 0x80, 0x80, 0x80, 0x80, 0x0f}, delta[2:]...)
+	if _, err := applyDelta(base, huge, 0); err == nil {
+		t.Fatal("expected an error for a wrong result size")
+	}
+}
+
+func TestDeepObjects(t *testing.T) {
+	r := makeTestRepo(t)
+
+	// Deeply nested trees are walked
+	tree := r.tree1
+	for i := 0; i < 1000; i++ {
+		tree = writeObject(t, r.dir, objTree, treeData(treeEntry{"40000", "d", tree}))
+	}
+	db, err := openObjectDB(FileStorage{}, r.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	visited := 0
+	if err := db.walkTree(context.Background(), tree, map[string]bool{}, func(id string) { visited++ }); err != nil || visited != 1002 {
+		t.Errorf("visited %d objects, %v", visited, err)
+	}
+	changes, err := db.diffTrees(context.Background(), "", tree, false)
+	if want := strings.Repeat("d/", 1000) + "a.txt"; err != nil || len(changes) != 1 || changes[0].Path != want {
+		t.Errorf("got changes %v, %v", changes, err)
+	}
+
+	// Delta chains are resolved up to maxDeltaDepth, each delta
+	// here keeping the last byte of its base and adding one
+	var pack bytes.Buffer
+	pack.WriteString("PACK\x00\x00\x00\x02\x00\x00\x00\x00")
+	entry := func(typ objectType, base int64, data []byte) int64 {
+		offset := int64(pack.Len())
+		pack.Write(packEntryHeader(typ, int64(len(data))))
+		if typ == objOfsDelta {
+			pack.WriteByte(byte(offset - base))
+		}
+		zw := zlib.NewWriter(&pack)
+		zw.Write(data)
+		zw.Close()
+		return offset
+	}
+	offsets := []int64{entry(objBlob, 0, []byte("ab"))}
+	for i := 1; i <= maxDeltaDepth+1; i++ {
+		delta := []byte{2, 2, 0x91, 1, 1, 1, byte('a' + i%26)}
+		offsets = append(offsets, entry(objOfsDelta, offsets[i-1], delta))
+	}
+	looping := entry(objOfsDelta, int64(pack.Len()), []byte{2, 2, 0x91, 1, 1, 1, 'x'})
+
+	path := filepath.Join(t.TempDir(), "deltas.pack")
+	os.WriteFile(path, pack.Bytes(), 0644)
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	packed := &packFile{path: path, file: f, hashSize: 20}
+
+	for _, offset := range []int64{offsets[maxDeltaDepth+1], looping} {
+		if _, _, err := db.readPacked(packed, offset); err == nil || !strings.Contains(err.Error(), "too long") {
+			t.Errorf("delta at %d: got %v", offset, err)
+		}
+	}
+	last := byte('a' + maxDeltaDepth%26)
+	if _, data, err := db.readPacked(packed, offsets[maxDeltaDepth]); err != nil || string(data) != string([]byte{last - 1, last}) {
+		t.Errorf("got %q, %v", data, err)
+	}
+}
+
+func readPackets(t *testing.T, data []byte) []string {
+	br := bufio.NewReader(bytes.NewReader(data))
+	var lines []string
+	for {
+		pkt, err := readPacket(br)
+		if err == io.EOF {
+			return lines
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(pkt))
+	}
+}
+
+func demuxSideband(t *testing.T, data []byte) []byte {
+	var out []byte
+	for _, pkt := range readPackets(t, data) {
+		if len(pkt) > 0 && pkt[0] == sidebandData {
+			out = append(out, pkt[1:]...)
+		}
+	}
+	return out
+}
+
+// readPackIds returns the ids of the objects in a pack without deltas
+func readPackIds(t *testing.T, pack []byte) []string {
+	if len(pack) < 12 || string(pack[:4]) != "PACK" {
+		t.Fatalf("not a pack: %q", pack)
+	}
+	db := &objectDB{format: SHA1}
+	r := bytes.NewReader(pack[12 : len(pack)-20])
+
+	var ids []string
+	for r.Len() > 0 {
+		typ, size, err := readEntryHeader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := inflate(r, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, db.hashObject(typ, data))
+	}
+	return ids
+}
@@ -0,0 +1,163 @@
+package githttp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// HookInfo describes the push a hook is called for.
+type HookInfo struct {
+	// repo component of URL
+	Repo string
+
+	// Path to bare repo
+	Dir string
+
+	// Http stuff
+	Request *http.Request
+
+	// Pushed objects, for ChangedPaths
+	quarantine *quarantine
+}
+
+type hookInfoKey struct{}
+
+// HookInfoFromContext returns the HookInfo of the push
+// a PreReceive hook was called for.
+func HookInfoFromContext(ctx context.Context) (*HookInfo, bool) {
+	info, ok := ctx.Value(hookInfoKey{}).(*HookInfo)
+	return info, ok
+}
+
+// preReceive vets the command list of a receive-pack request, read as
+// header, rejecting the updates of refs hidden by filter, if not nil,
+// and those RefRules disallow, and runs the PreReceive hook, if set, on
+// it. It returns the reasons for rejected refs and the input to relay to
+// git, which is nil when nothing is left to do. The returned cleanup
+// function must be called once git is done.
+func (g *GitHttp) preReceive(hr HandlerReq, rpcReader *RpcReader, header []byte, filter *refFilter) (io.Reader, map[string]string, func(), error) {
+	cleanup := func() {}
+
+	if len(rpcReader.Updates) == 0 {
+		return io.MultiReader(bytes.NewReader(header), rpcReader), nil, cleanup, nil
+	}
+
+	q := &quarantine{g: g, dir: hr.Dir, input: rpcReader}
+	cleanup = q.close
+
+	info := &HookInfo{
+		Repo:       hr.Repo,
+		Dir:        hr.Dir,
+		Request:    hr.r,
+		quarantine: q,
+	}
+	ctx := context.WithValue(hr.r.Context(), hookInfoKey{}, info)
+
+	rejected := map[string]string{}
+	if filter != nil {
+		if err := filter.rejectHidden(rpcReader.Updates, rejected); err != nil {
+			return nil, nil, cleanup, err
+		}
+	}
+	if g.RefRules != nil {
+		if err := g.RefRules.rejectDisallowed(ctx, hr, g.RequestAuthInfo(hr.r), q, rpcReader.Updates, rejected); err != nil {
+			return nil, nil, cleanup, err
+		}
+	}
+
+	var hookErr error
+	if g.PreReceive != nil {
+		hookErr = g.PreReceive(ctx, rpcReader.Updates)
+	}
+
+	// The pack was possibly spooled by the hook
+	rest := io.MultiReader(bytes.NewReader(header), q.reader())
+
+	switch err := hookErr.(type) {
+	case nil:
+	case *ErrorRefsRejected:
+		for _, u := range rpcReader.Updates {
+			if reason, ok := err.Refs[u.Ref]; ok && rejected[u.Ref] == "" {
+				rejected[u.Ref] = reason
+			}
+		}
+	default:
+		for _, u := range rpcReader.Updates {
+			if rejected[u.Ref] == "" {
+				rejected[u.Ref] = err.Error()
+			}
+		}
+	}
+
+	// Packs that couldn't be spooled whole, e.g. for being
+	// larger than MaxPackSize, can't be relayed to git
+	if err := q.spoolErr; err != nil {
+		for _, u := range rpcReader.Updates {
+			if rejected[u.Ref] == "" {
+				rejected[u.Ref] = err.Error()
+			}
+		}
+	}
+
+	if len(rejected) == 0 {
+		return rest, nil, cleanup, nil
+	}
+
+	// Atomic pushes either succeed or fail as a whole, and signed pushes
+	// can't have commands removed without breaking their signature
+	if len(rejected) < len(rpcReader.Updates) && (rpcReader.hasCapability("atomic") || rpcReader.isSigned()) {
+		for _, u := range rpcReader.Updates {
+			if _, ok := rejected[u.Ref]; !ok {
+				rejected[u.Ref] = "atomic push failure"
+			}
+		}
+	}
+
+	if len(rejected) == len(rpcReader.Updates) {
+		return nil, rejected, cleanup, nil
+	}
+
+	header = filterCommands(rpcReader.pktLineParser.Lines, rejected)
+	return io.MultiReader(bytes.NewReader(header), q.reader()), rejected, cleanup, nil
+}
+
+// filterCommands re-encodes the command list of a receive-pack request
+// without the commands updating rejected refs. The capability list
+// is moved to the first remaining command if necessary.
+func filterCommands(lines []string, rejected map[string]string) []byte {
+	var buf bytes.Buffer
+	caps := ""
+	for _, line := range lines {
+		cmd := line
+		if i := strings.IndexByte(line, 0); i >= 0 {
+			cmd, caps = line[:i], line[i:]
+		}
+
+		if u, ok := parseCommand(cmd); ok {
+			if _, ok := rejected[u.Ref]; ok {
+				continue
+			}
+		}
+
+		buf.Write(packetWrite(cmd + caps))
+		caps = ""
+	}
+	buf.Write(packetFlush())
+	return buf.Bytes()
+}
+
+// rejectionLines returns the report-status lines for rejected refs,
+// in the order the commands were sent
+func rejectionLines(updates []RefUpdate, rejected map[string]string) []string {
+	var lines []string
+	for _, u := range updates {
+		if reason, ok := rejected[u.Ref]; ok {
+			reason = strings.Join(strings.Fields(reason), " ")
+			lines = append(lines, "ng "+u.Ref+" "+reason+"\n")
+		}
+	}
+	return lines
+}
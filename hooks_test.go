@@ -0,0 +1,207 @@
+package githttp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	zeroId = "0000000000000000000000000000000000000000"
+	someId = "3da295397738f395c2ca5fd5570f01a9fcea3be3"
+)
+
+func TestFilterCommands(t *testing.T) {
+	lines := []string{
+		zeroId + " " + someId + " refs/heads/protected\x00 report-status side-band-64k",
+		zeroId + " " + someId + " refs/heads/master",
+		zeroId + " " + someId + " refs/heads/other",
+	}
+	rejected := map[string]string{"refs/heads/protected": "protected branch"}
+
+	got := string(filterCommands(lines, rejected))
+	want := string(packetWrite(zeroId+" "+someId+" refs/heads/master\x00 report-status side-band-64k")) +
+		string(packetWrite(zeroId+" "+someId+" refs/heads/other")) +
+		string(packetFlush())
+	if got != want {
+		t.Errorf("got %q\nwant %q", got, want)
+	}
+}
+
+func TestRelayReportStatus(t *testing.T) {
+	extra := []string{"ng refs/heads/protected protected branch\n"}
+
+	tests := []struct {
+		caps []string
+	}{
+		{[]string{"report-status"}},
+		{[]string{"report-status", "side-band-64k"}},
+	}
+
+	for _, tt := range tests {
+		var status bytes.Buffer
+		status.Write(packetWrite("unpack ok\n"))
+		status.Write(packetWrite("ok refs/heads/master\n"))
+		status.Write(packetFlush())
+
+		var in, want bytes.Buffer
+		if sidebandLimit(tt.caps) > 0 {
+			in.Write(packetWrite("\x02Resolving deltas: 100%\n"))
+			writeStatus(&in, tt.caps, status.Bytes())
+
+			want.Write(packetWrite("\x02Resolving deltas: 100%\n"))
+		} else {
+			in.Write(status.Bytes())
+		}
+
+		status.Truncate(status.Len() - len(packetFlush()))
+		status.Write(packetWrite(extra[0]))
+		status.Write(packetFlush())
+		writeStatus(&want, tt.caps, status.Bytes())
+
+		var out bytes.Buffer
+		if err := relayReportStatus(&out, &in, tt.caps, extra); err != nil {
+			t.Fatalf("%s: %v", strings.Join(tt.caps, " "), err)
+		}
+		if out.String() != want.String() {
+			t.Errorf("%s:\n got: %q\nwant: %q", strings.Join(tt.caps, " "), out.String(), want.String())
+		}
+	}
+}
+
+func TestPreReceiveRejection(t *testing.T) {
+	r := makeTestRepo(t)
+
+	src := t.TempDir()
+	makeBareRepo(t, src, true)
+	blobC := writeObject(t, src, objBlob, []byte("c\n"))
+	tree3 := writeObject(t, src, objTree, treeData(treeEntry{"100644", "a.txt", r.blobA}, treeEntry{"100644", "c.txt", blobC}))
+	commit3 := writeObject(t, src, objCommit, commitData(tree3, r.commit2))
+	objects := []string{blobC, tree3, commit3}
+
+	var hookErr error
+	var events []Event
+	g := New(filepath.Dir(r.dir))
+	g.PreReceive = func(ctx context.Context, updates []RefUpdate) error {
+		return hookErr
+	}
+	g.EventHandler = func(ev Event) {
+		events = append(events, ev)
+	}
+	push := func(commands []string) string {
+		events = nil
+		req := httptest.NewRequest("POST", "/"+filepath.Base(r.dir)+"/git-receive-pack", bytes.NewReader(pushRequest(t, src, commands, objects)))
+		req.Header.Set("Content-Type", "application/x-git-receive-pack-request")
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+		return strings.Join(readPackets(t, w.Body.Bytes()), "")
+	}
+
+	// Rejected refs are reported along with git's
+	// status, the other updates going through
+	hookErr = &ErrorRefsRejected{map[string]string{"refs/heads/feature": "frozen"}}
+	out := push([]string{
+		r.commit2 + " " + commit3 + " refs/heads/master\x00report-status",
+		zeroId + " " + commit3 + " refs/heads/feature",
+	})
+	for _, line := range []string{"unpack ok\n", "ok refs/heads/master\n", "ng refs/heads/feature frozen\n"} {
+		if !strings.Contains(out, line) {
+			t.Errorf("got %q, want %q", out, line)
+		}
+	}
+	if id := readRef(t, r.dir, "refs/heads/master"); id != commit3 {
+		t.Errorf("master is at %s, want %s", id, commit3)
+	}
+	if id := readRef(t, r.dir, "refs/heads/feature"); id != "" {
+		t.Errorf("feature was created at %s", id)
+	}
+	for _, ev := range events {
+		var rejected *ErrorRefsRejected
+		switch {
+		case ev.Update == nil:
+		case ev.Update.Ref == "refs/heads/master" && ev.Error != nil:
+			t.Errorf("master got error %v", ev.Error)
+		case ev.Update.Ref == "refs/heads/feature" && (!errors.As(ev.Error, &rejected) || rejected.Refs[ev.Update.Ref] != "frozen"):
+			t.Errorf("feature got error %v", ev.Error)
+		}
+	}
+	if len(events) != 2 {
+		t.Errorf("got %d events, want 2", len(events))
+	}
+
+	// When every update is rejected, git isn't even run
+	g.GitBinPath = filepath.Join(t.TempDir(), "missing")
+	hookErr = errors.New("repo is read-only")
+	out = push([]string{
+		commit3 + " " + r.commit2 + " refs/heads/master\x00report-status",
+		zeroId + " " + commit3 + " refs/heads/other",
+	})
+	want := "unpack ok\nng refs/heads/master repo is read-only\nng refs/heads/other repo is read-only\n"
+	if out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+	if id := readRef(t, r.dir, "refs/heads/master"); id != commit3 {
+		t.Errorf("master moved to %s", id)
+	}
+	if len(events) != 2 || events[0].Error == nil || events[1].Error == nil {
+		t.Errorf("got events %+v", events)
+	}
+
+	// Packs larger than allowed aren't spooled whole, nor relayed to git,
+	// even if the hook ignores the error reading them gives
+	g.GitBinPath = "/usr/bin/git"
+	g.MaxPackSize = 16
+	g.PreReceive = func(ctx context.Context, updates []RefUpdate) error {
+		info, _ := HookInfoFromContext(ctx)
+		info.ChangedPaths(ctx, updates[0])
+		return nil
+	}
+	out = push([]string{zeroId + " " + commit3 + " refs/heads/other\x00report-status"})
+	if want := "unpack ok\nng refs/heads/other pack too large\n"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+	if id := readRef(t, r.dir, "refs/heads/other"); id != "" {
+		t.Errorf("other was created at %s", id)
+	}
+}
+
+func TestMalformedCommands(t *testing.T) {
+	r := makeTestRepo(t)
+
+	// Git takes a delim-pkt for the end of the commands
+	pack := pushRequest(t, r.dir, nil, []string{})[len(packetFlush()):]
+	body := string(packetWrite(r.commit2+" "+r.commit1+" refs/heads/master\x00report-status\n")) + "0001" + string(pack)
+
+	hooks := map[string]func(context.Context, []RefUpdate) error{
+		"hook": func(ctx context.Context, updates []RefUpdate) error {
+			return errors.New("read-only")
+		},
+		"no hook": nil,
+	}
+	for name, hook := range hooks {
+		var events []Event
+		g := New(filepath.Dir(r.dir))
+		g.PreReceive = hook
+		g.EventHandler = func(ev Event) {
+			events = append(events, ev)
+		}
+
+		req := httptest.NewRequest("POST", "/"+filepath.Base(r.dir)+"/git-receive-pack", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-git-receive-pack-request")
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+		if w.Code != 400 {
+			t.Errorf("%s: got %d %q, want 400", name, w.Code, w.Body)
+		}
+		if id := readRef(t, r.dir, "refs/heads/master"); id != r.commit2 {
+			t.Fatalf("%s: master moved to %s", name, id)
+		}
+		if len(events) != 0 {
+			t.Errorf("%s: got events %+v", name, events)
+		}
+	}
+}
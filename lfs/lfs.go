@@ -0,0 +1,347 @@
+// Package lfs serves the Git LFS API for the repositories of a
+// githttp.GitHttp, with the basic transfer adapter:
+//
+//	server := lfs.New(git, nil)
+//	git.LFS = server
+//
+// Its endpoints live under <repo>/info/lfs/, where git-lfs looks
+// for them by default. Repos are resolved just like for git requests,
+// and access is left to the auth package, which tells LFS uploads
+// and lock changes from downloads in AuthInfo's Push and Fetch.
+//
+// Files can be locked with "git lfs lock", locks being attributed to
+// the authenticated user. To keep others from pushing changes to
+// locked files, the server must be GitHttp's PreReceive hook:
+//
+//	git.PreReceive = server.PreReceive
+package lfs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/AaronO/go-git-http"
+	"github.com/AaronO/go-git-http/auth"
+)
+
+const mediaType = "application/vnd.git-lfs+json"
+
+var (
+	oidRegex        = regexp.MustCompile("^[0-9a-f]{64}$")
+	lockUnlockRegex = regexp.MustCompile("^locks/([^/]+)/unlock$")
+)
+
+type Server struct {
+	// Git resolves the repositories, as it does for git requests
+	Git *githttp.GitHttp
+
+	// Store keeps the objects and Locks the file locks
+	Store ContentStore
+	Locks LockStore
+
+	// BaseURL is the URL of Git in the links handed to clients
+	// (e.g. "https://git.example.com"), taken from requests if empty
+	BaseURL string
+
+	// CanForceUnlock, if set, decides whether user may remove the lock
+	// of someone else when asked to force it. Only owners may remove
+	// their locks if nil.
+	CanForceUnlock func(r *http.Request, user auth.AuthInfo, repo string, lock Lock) (bool, error)
+}
+
+// New returns a Server for the repos of git, keeping objects in a
+// FileStore if store is nil and locks in a FileLockStore, both in
+// the Storage git has when they're used
+func New(git *githttp.GitHttp, store ContentStore) *Server {
+	if store == nil {
+		store = FileStore{Storage: gitStorage{git}}
+	}
+	return &Server{
+		Git:   git,
+		Store: store,
+		Locks: &FileLockStore{Storage: gitStorage{git}},
+	}
+}
+
+// Pointer names an object
+type Pointer struct {
+	Oid  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+type batchRequest struct {
+	Operation string    `json:"operation"`
+	Transfers []string  `json:"transfers,omitempty"`
+	Objects   []Pointer `json:"objects"`
+	HashAlgo  string    `json:"hash_algo,omitempty"`
+}
+
+type batchResponse struct {
+	Transfer string        `json:"transfer"`
+	Objects  []batchObject `json:"objects"`
+	HashAlgo string        `json:"hash_algo"`
+}
+
+type batchObject struct {
+	Pointer
+	Authenticated bool               `json:"authenticated,omitempty"`
+	Actions       map[string]*action `json:"actions,omitempty"`
+	Error         *objectError       `json:"error,omitempty"`
+}
+
+type action struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+type objectError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// lfsRequest is a request for a repo's LFS endpoint
+type lfsRequest struct {
+	w http.ResponseWriter
+	r *http.Request
+
+	// repo component of the URL, its directory
+	// and the endpoint's path under info/lfs/
+	Repo     string
+	Dir      string
+	Endpoint string
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	repo, endpoint, ok := strings.Cut(r.URL.Path, "/info/lfs/")
+	if !ok {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	dir, err := s.Git.ResolveRepo(r, repo)
+	if err != nil {
+		renderError(w, err)
+		return
+	}
+
+	lr := lfsRequest{w, r, repo, dir, endpoint}
+
+	// Uploads are pushes and downloads are fetches,
+	// as far as GitHttp's access rules are concerned
+	if !s.allowed(lr) {
+		writeError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	switch {
+	case endpoint == "objects/batch" && r.Method == "POST":
+		err = s.batch(lr)
+	case endpoint == "objects/verify" && r.Method == "POST":
+		err = s.verify(lr)
+	case endpoint == "locks" || strings.HasPrefix(endpoint, "locks/"):
+		err = s.lockRoute(lr)
+	case strings.HasPrefix(endpoint, "objects/") && oidRegex.MatchString(endpoint[len("objects/"):]):
+		switch r.Method {
+		case "GET":
+			err = s.download(lr)
+		case "PUT":
+			err = s.upload(lr)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		}
+	default:
+		writeError(w, http.StatusNotFound, "Not Found")
+	}
+
+	if err != nil {
+		renderError(w, err)
+	}
+}
+
+func (s *Server) allowed(lr lfsRequest) bool {
+	if lr.r.Method == "GET" || lr.Endpoint == "objects/batch" {
+		return s.Git.UploadPack || s.Git.ReceivePack
+	}
+	return s.Git.ReceivePack
+}
+
+// batch tells the client where to download or upload objects
+func (s *Server) batch(lr lfsRequest) error {
+	var req batchRequest
+	if err := json.NewDecoder(lr.r.Body).Decode(&req); err != nil {
+		writeError(lr.w, http.StatusUnprocessableEntity, "Invalid batch request: "+err.Error())
+		return nil
+	}
+	if req.HashAlgo != "" && req.HashAlgo != "sha256" {
+		writeError(lr.w, http.StatusConflict, "Unsupported hash algorithm: "+req.HashAlgo)
+		return nil
+	}
+	if req.Operation != "download" && req.Operation != "upload" {
+		writeError(lr.w, http.StatusUnprocessableEntity, "Invalid operation: "+req.Operation)
+		return nil
+	}
+	if req.Operation == "upload" && !s.Git.ReceivePack || req.Operation == "download" && !s.Git.UploadPack {
+		writeError(lr.w, http.StatusForbidden, "Forbidden")
+		return nil
+	}
+	if len(req.Transfers) > 0 && !contains(req.Transfers, "basic") {
+		writeError(lr.w, http.StatusUnprocessableEntity, "Only the basic transfer adapter is supported")
+		return nil
+	}
+
+	resp := batchResponse{Transfer: "basic", HashAlgo: "sha256", Objects: []batchObject{}}
+	for _, p := range req.Objects {
+		obj := batchObject{Pointer: p}
+		if !oidRegex.MatchString(p.Oid) || p.Size < 0 {
+			obj.Error = &objectError{http.StatusUnprocessableEntity, "Invalid object"}
+			resp.Objects = append(resp.Objects, obj)
+			continue
+		}
+
+		size, exists, err := s.Store.Stat(lr.r.Context(), lr.Dir, p.Oid)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case req.Operation == "download" && !exists:
+			obj.Error = &objectError{http.StatusNotFound, "Object does not exist"}
+		case req.Operation == "download":
+			obj.Size = size
+			obj.Authenticated = true
+			obj.Actions = map[string]*action{
+				"download": s.action(lr, "objects/"+p.Oid),
+			}
+		case !exists:
+			obj.Authenticated = true
+			obj.Actions = map[string]*action{
+				"upload": s.action(lr, "objects/"+p.Oid),
+				"verify": s.action(lr, "objects/verify"),
+			}
+		}
+		resp.Objects = append(resp.Objects, obj)
+	}
+
+	writeJSON(lr.w, http.StatusOK, resp)
+	return nil
+}
+
+// action returns a link to an endpoint of the repo, passing
+// on the request's credentials to the client's transfer
+func (s *Server) action(lr lfsRequest, endpoint string) *action {
+	base := s.BaseURL
+	if base == "" {
+		scheme := "http"
+		if lr.r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + lr.r.Host
+	}
+
+	a := &action{Href: strings.TrimSuffix(base, "/") + lr.Repo + "/info/lfs/" + endpoint}
+	if authorization := lr.r.Header.Get("Authorization"); authorization != "" {
+		a.Header = map[string]string{"Authorization": authorization}
+	}
+	return a
+}
+
+func (s *Server) download(lr lfsRequest) error {
+	oid := lr.Endpoint[len("objects/"):]
+
+	content, size, err := s.Store.Open(lr.r.Context(), lr.Dir, oid)
+	if errors.Is(err, fs.ErrNotExist) {
+		writeError(lr.w, http.StatusNotFound, "Object does not exist")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	lr.w.Header().Set("Content-Type", "application/octet-stream")
+	lr.w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
+	lr.w.WriteHeader(http.StatusOK)
+	io.Copy(lr.w, content)
+
+	return nil
+}
+
+func (s *Server) upload(lr lfsRequest) error {
+	oid := lr.Endpoint[len("objects/"):]
+
+	err := s.Store.Put(lr.r.Context(), lr.Dir, oid, lr.r.ContentLength, lr.r.Body)
+	if invalid, ok := err.(*ErrorInvalidObject); ok {
+		writeError(lr.w, http.StatusUnprocessableEntity, invalid.Error())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	lr.w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// verify confirms an upload was stored
+func (s *Server) verify(lr lfsRequest) error {
+	var p Pointer
+	if err := json.NewDecoder(lr.r.Body).Decode(&p); err != nil || !oidRegex.MatchString(p.Oid) {
+		writeError(lr.w, http.StatusUnprocessableEntity, "Invalid object")
+		return nil
+	}
+
+	size, exists, err := s.Store.Stat(lr.r.Context(), lr.Dir, p.Oid)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		writeError(lr.w, http.StatusNotFound, "Object does not exist")
+		return nil
+	}
+	if size != p.Size {
+		writeError(lr.w, http.StatusUnprocessableEntity, fmt.Sprintf("Object is %d bytes, not %d", size, p.Size))
+		return nil
+	}
+
+	writeJSON(lr.w, http.StatusOK, p)
+	return nil
+}
+
+// renderError writes the response for an error
+// returned while handling a request
+func renderError(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case *githttp.ErrorRepoNotFound:
+		writeError(w, http.StatusNotFound, "Repository not found")
+		return
+	case *githttp.ErrorNoAccess:
+		writeError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err.Error())
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"message": message})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", mediaType)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
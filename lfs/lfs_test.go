@@ -0,0 +1,194 @@
+package lfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AaronO/go-git-http"
+	"github.com/AaronO/go-git-http/auth"
+)
+
+func newServer(t *testing.T) (*githttp.GitHttp, *httptest.Server) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "org", "repo.git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	git := githttp.New(root)
+	git.LFS = New(git, nil)
+	srv := httptest.NewServer(authenticate(git))
+	t.Cleanup(srv.Close)
+	return git, srv
+}
+
+// authenticate lets through the users of requests with basic auth
+// whose password is "secret", as auth.Authenticator would
+func authenticate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); ok && pass == "secret" {
+			r = r.WithContext(auth.NewContext(r.Context(), auth.AuthInfo{Username: user}))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func request(t *testing.T, method string, url string, body string) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", mediaType)
+	req.Header.Set("Content-Type", mediaType)
+	req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp, data
+}
+
+func batch(t *testing.T, url string, operation string, p Pointer) batchObject {
+	body, _ := json.Marshal(batchRequest{Operation: operation, Transfers: []string{"basic"}, Objects: []Pointer{p}})
+	resp, data := request(t, "POST", url+"/objects/batch", string(body))
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != mediaType {
+		t.Fatalf("batch %s: got %d %s", operation, resp.StatusCode, data)
+	}
+
+	var br batchResponse
+	if err := json.Unmarshal(data, &br); err != nil || br.Transfer != "basic" || len(br.Objects) != 1 {
+		t.Fatalf("batch %s: unexpected response %s", operation, data)
+	}
+	return br.Objects[0]
+}
+
+func TestTransfer(t *testing.T) {
+	_, srv := newServer(t)
+	url := srv.URL + "/org/repo.git/info/lfs"
+
+	content := "large binary content"
+	sum := sha256.Sum256([]byte(content))
+	p := Pointer{hex.EncodeToString(sum[:]), int64(len(content))}
+
+	// Nothing to download yet
+	if obj := batch(t, url, "download", p); obj.Error == nil || obj.Error.Code != 404 {
+		t.Fatalf("download of missing object: got %+v", obj)
+	}
+
+	obj := batch(t, url, "upload", p)
+	upload, verify := obj.Actions["upload"], obj.Actions["verify"]
+	if upload == nil || verify == nil {
+		t.Fatalf("upload: missing actions in %+v", obj)
+	}
+	if upload.Href != url+"/objects/"+p.Oid || upload.Header["Authorization"] != "Basic dXNlcjpwYXNz" {
+		t.Errorf("upload: unexpected action %+v", upload)
+	}
+
+	// Content must match the oid
+	if resp, _ := request(t, "PUT", upload.Href, "something else"); resp.StatusCode != 422 {
+		t.Errorf("upload of wrong content: got %d", resp.StatusCode)
+	}
+	if resp, data := request(t, "PUT", upload.Href, content); resp.StatusCode != 200 {
+		t.Fatalf("upload: got %d %s", resp.StatusCode, data)
+	}
+
+	verifyBody, _ := json.Marshal(p)
+	if resp, data := request(t, "POST", verify.Href, string(verifyBody)); resp.StatusCode != 200 {
+		t.Errorf("verify: got %d %s", resp.StatusCode, data)
+	}
+	if resp, _ := request(t, "POST", verify.Href, `{"oid":"`+p.Oid+`","size":1}`); resp.StatusCode != 422 {
+		t.Errorf("verify of wrong size: got %d", resp.StatusCode)
+	}
+
+	// Already uploaded
+	if obj := batch(t, url, "upload", p); obj.Actions != nil || obj.Error != nil {
+		t.Errorf("upload of existing object: got %+v", obj)
+	}
+
+	obj = batch(t, url, "download", p)
+	download := obj.Actions["download"]
+	if download == nil {
+		t.Fatalf("download: missing action in %+v", obj)
+	}
+	resp, data := request(t, "GET", download.Href, "")
+	if resp.StatusCode != 200 || !bytes.Equal(data, []byte(content)) {
+		t.Errorf("download: got %d %q", resp.StatusCode, data)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	git, srv := newServer(t)
+	git.ReceivePack = false
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{"POST", "/missing.git/info/lfs/objects/batch", `{"operation":"download","objects":[]}`, 404},
+		{"POST", "/org/repo.git/info/lfs/objects/batch", `{"operation":"upload","objects":[]}`, 403},
+		{"POST", "/org/repo.git/info/lfs/objects/batch", `{"operation":"download","objects":[],"hash_algo":"sha512"}`, 409},
+		{"POST", "/org/repo.git/info/lfs/objects/batch", `{"operation":"delete","objects":[]}`, 422},
+		{"POST", "/org/repo.git/info/lfs/objects/batch", `{"operation":"download","objects":[]}`, 200},
+		{"PUT", "/org/repo.git/info/lfs/objects/" + strings.Repeat("a", 64), "", 403},
+		{"GET", "/org/repo.git/info/lfs/objects/" + strings.Repeat("a", 64), "", 404},
+		{"GET", "/org/repo.git/info/lfs/unknown", "", 404},
+	}
+
+	for _, tt := range tests {
+		if resp, data := request(t, tt.method, srv.URL+tt.path, tt.body); resp.StatusCode != tt.code {
+			t.Errorf("%s %s: got %d %s, want %d", tt.method, tt.path, resp.StatusCode, data, tt.code)
+		}
+	}
+}
+
+func TestStorage(t *testing.T) {
+	git, srv := newServer(t)
+	storage := githttp.NewMemoryStorage()
+	git.Storage = storage
+	dir := filepath.Join(git.ProjectRoot, "org", "repo.git")
+	storage.Write(dir, "HEAD", strings.NewReader("ref: refs/heads/master\n"))
+	url := srv.URL + "/org/repo.git/info/lfs"
+
+	content := "large binary content"
+	sum := sha256.Sum256([]byte(content))
+	oid := hex.EncodeToString(sum[:])
+	if resp, _ := request(t, "PUT", url+"/objects/"+oid, "something else"); resp.StatusCode != 422 {
+		t.Errorf("upload of wrong content: got %d", resp.StatusCode)
+	}
+	if resp, data := request(t, "PUT", url+"/objects/"+oid, content); resp.StatusCode != 200 {
+		t.Fatalf("upload: got %d %s", resp.StatusCode, data)
+	}
+	if code, out := call(t, "alice", "POST", url+"/locks", `{"path":"a.bin"}`); code != 201 {
+		t.Fatalf("lock: got %d %s", code, out)
+	}
+
+	// Objects and locks are kept along with the repo
+	names, err := storage.List(dir, "lfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "lfs/locks.json lfs/objects/" + oid[0:2] + "/" + oid[2:4] + "/" + oid; strings.Join(names, " ") != want {
+		t.Errorf("stored %v, want %s", names, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "lfs")); !os.IsNotExist(err) {
+		t.Errorf("wrote to disk: %v", err)
+	}
+
+	resp, data := request(t, "GET", url+"/objects/"+oid, "")
+	if resp.StatusCode != 200 || string(data) != content {
+		t.Errorf("download: got %d %q", resp.StatusCode, data)
+	}
+}
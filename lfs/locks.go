@@ -0,0 +1,417 @@
+package lfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AaronO/go-git-http"
+)
+
+// Lock keeps others from pushing changes to a file
+type Lock struct {
+	Id       string    `json:"id"`
+	Path     string    `json:"path"`
+	LockedAt time.Time `json:"locked_at"`
+	Owner    Owner     `json:"owner"`
+}
+
+type Owner struct {
+	Name string `json:"name"`
+}
+
+// LockStore keeps the locks of repositories, the dir
+// passed to its methods being the directory of the repository
+type LockStore interface {
+	// Create adds a lock. If its path is already locked,
+	// it returns an *ErrorLockExists with the existing lock.
+	Create(ctx context.Context, dir string, lock Lock) error
+
+	// List returns the locks of a repo, oldest first
+	List(ctx context.Context, dir string) ([]Lock, error)
+
+	// Delete removes a lock. It returns an error
+	// wrapping fs.ErrNotExist if there is no such lock.
+	Delete(ctx context.Context, dir string, id string) error
+}
+
+// ErrorLockExists is returned when locking a file that's already locked
+type ErrorLockExists struct {
+	Lock Lock
+}
+
+func (e *ErrorLockExists) Error() string {
+	return fmt.Sprintf("'%s' is already locked by %s", e.Lock.Path, e.Lock.Owner.Name)
+}
+
+// Number of locks listed at once, unless asked for less
+const maxLocksListed = 100
+
+type lockRequest struct {
+	Path string `json:"path"`
+}
+
+type unlockRequest struct {
+	Force bool `json:"force"`
+}
+
+type verifyLocksRequest struct {
+	Cursor string `json:"cursor,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+// lockRoute handles the requests under info/lfs/locks
+func (s *Server) lockRoute(lr lfsRequest) error {
+	switch {
+	case lr.Endpoint == "locks" && lr.r.Method == "GET":
+		return s.listLocks(lr)
+	case lr.Endpoint == "locks" && lr.r.Method == "POST":
+		return s.createLock(lr)
+	case lr.Endpoint == "locks/verify" && lr.r.Method == "POST":
+		return s.verifyLocks(lr)
+	case lr.r.Method == "POST" && lockUnlockRegex.MatchString(lr.Endpoint):
+		return s.unlock(lr, lockUnlockRegex.FindStringSubmatch(lr.Endpoint)[1])
+	}
+	writeError(lr.w, http.StatusNotFound, "Not Found")
+	return nil
+}
+
+func (s *Server) createLock(lr lfsRequest) error {
+	user, ok := s.requestUser(lr)
+	if !ok {
+		return nil
+	}
+
+	var req lockRequest
+	if err := json.NewDecoder(lr.r.Body).Decode(&req); err != nil || req.Path == "" {
+		writeError(lr.w, http.StatusUnprocessableEntity, "Invalid lock request")
+		return nil
+	}
+
+	var id [16]byte
+	rand.Read(id[:])
+	lock := Lock{
+		Id:       hex.EncodeToString(id[:]),
+		Path:     req.Path,
+		LockedAt: time.Now().UTC().Truncate(time.Second),
+		Owner:    Owner{user},
+	}
+
+	err := s.Locks.Create(lr.r.Context(), lr.Dir, lock)
+	if exists, ok := err.(*ErrorLockExists); ok {
+		writeJSON(lr.w, http.StatusConflict, map[string]interface{}{
+			"lock":    exists.Lock,
+			"message": "already created lock",
+		})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	writeJSON(lr.w, http.StatusCreated, map[string]interface{}{"lock": lock})
+	return nil
+}
+
+func (s *Server) listLocks(lr lfsRequest) error {
+	locks, err := s.Locks.List(lr.r.Context(), lr.Dir)
+	if err != nil {
+		return err
+	}
+
+	query := lr.r.URL.Query()
+	var matching []Lock
+	for _, lock := range locks {
+		if path := query.Get("path"); path != "" && lock.Path != path {
+			continue
+		}
+		if id := query.Get("id"); id != "" && lock.Id != id {
+			continue
+		}
+		matching = append(matching, lock)
+	}
+
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	page, next := paginate(matching, query.Get("cursor"), limit)
+
+	writeJSON(lr.w, http.StatusOK, map[string]interface{}{
+		"locks":       page,
+		"next_cursor": next,
+	})
+	return nil
+}
+
+// verifyLocks tells a pushing client which locks are its own
+func (s *Server) verifyLocks(lr lfsRequest) error {
+	user, ok := s.requestUser(lr)
+	if !ok {
+		return nil
+	}
+
+	var req verifyLocksRequest
+	if err := json.NewDecoder(lr.r.Body).Decode(&req); err != nil {
+		writeError(lr.w, http.StatusUnprocessableEntity, "Invalid verify request")
+		return nil
+	}
+
+	locks, err := s.Locks.List(lr.r.Context(), lr.Dir)
+	if err != nil {
+		return err
+	}
+	page, next := paginate(locks, req.Cursor, req.Limit)
+
+	ours, theirs := []Lock{}, []Lock{}
+	for _, lock := range page {
+		if lock.Owner.Name == user {
+			ours = append(ours, lock)
+		} else {
+			theirs = append(theirs, lock)
+		}
+	}
+
+	writeJSON(lr.w, http.StatusOK, map[string]interface{}{
+		"ours":        ours,
+		"theirs":      theirs,
+		"next_cursor": next,
+	})
+	return nil
+}
+
+func (s *Server) unlock(lr lfsRequest, id string) error {
+	user, ok := s.requestUser(lr)
+	if !ok {
+		return nil
+	}
+
+	var req unlockRequest
+	if err := json.NewDecoder(lr.r.Body).Decode(&req); err != nil {
+		writeError(lr.w, http.StatusUnprocessableEntity, "Invalid unlock request")
+		return nil
+	}
+
+	locks, err := s.Locks.List(lr.r.Context(), lr.Dir)
+	if err != nil {
+		return err
+	}
+
+	for _, lock := range locks {
+		if lock.Id != id {
+			continue
+		}
+		if lock.Owner.Name != user {
+			allowed := false
+			if req.Force && s.CanForceUnlock != nil {
+				info := s.Git.RequestAuthInfo(lr.r)
+				if allowed, err = s.CanForceUnlock(lr.r, info, lr.Repo, lock); err != nil {
+					return err
+				}
+			}
+			if !allowed {
+				writeError(lr.w, http.StatusForbidden, "Lock is owned by "+lock.Owner.Name)
+				return nil
+			}
+		}
+
+		err := s.Locks.Delete(lr.r.Context(), lr.Dir, id)
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		writeJSON(lr.w, http.StatusOK, map[string]interface{}{"lock": lock})
+		return nil
+	}
+
+	writeError(lr.w, http.StatusNotFound, "Lock not found")
+	return nil
+}
+
+// PreReceive rejects the ref updates of a push that change files locked
+// by someone other than the pusher. It's meant to be GitHttp's PreReceive:
+//
+//	git.PreReceive = server.PreReceive
+func (s *Server) PreReceive(ctx context.Context, updates []githttp.RefUpdate) error {
+	info, ok := githttp.HookInfoFromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	locks, err := s.Locks.List(ctx, info.Dir)
+	if err != nil {
+		return err
+	}
+
+	user := ""
+	if info.Request != nil {
+		user = s.Git.RequestAuthInfo(info.Request).Username
+	}
+	theirs := map[string]string{}
+	for _, lock := range locks {
+		if lock.Owner.Name != user {
+			theirs[lock.Path] = lock.Owner.Name
+		}
+	}
+	if len(theirs) == 0 {
+		return nil
+	}
+
+	rejected := map[string]string{}
+	for _, u := range updates {
+		paths, err := info.ChangedPaths(ctx, u)
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			if owner, ok := theirs[path]; ok {
+				rejected[u.Ref] = fmt.Sprintf("%s is locked by %s", path, owner)
+				break
+			}
+		}
+	}
+
+	if len(rejected) > 0 {
+		return &githttp.ErrorRefsRejected{Refs: rejected}
+	}
+	return nil
+}
+
+// requestUser returns the name of the user making a request, as
+// GitHttp.RequestAuthInfo tells it, answering with a 401 if it's anonymous
+func (s *Server) requestUser(lr lfsRequest) (string, bool) {
+	user := s.Git.RequestAuthInfo(lr.r).Username
+	if user == "" {
+		lr.w.Header().Set("WWW-Authenticate", `Basic realm="git server"`)
+		writeError(lr.w, http.StatusUnauthorized, "Locking requires authentication")
+		return "", false
+	}
+	return user, true
+}
+
+// paginate returns the locks from the cursor on (an offset), up to limit
+func paginate(locks []Lock, cursor string, limit int) ([]Lock, string) {
+	if limit <= 0 || limit > maxLocksListed {
+		limit = maxLocksListed
+	}
+	start, _ := strconv.Atoi(cursor)
+	if start < 0 || start > len(locks) {
+		start = len(locks)
+	}
+
+	end, next := start+limit, ""
+	if end < len(locks) {
+		next = strconv.Itoa(end)
+	} else {
+		end = len(locks)
+	}
+
+	page := locks[start:end]
+	if page == nil {
+		page = []Lock{}
+	}
+	return page, next
+}
+
+// FileLockStore keeps the locks of a repository
+// in the JSON file lfs/locks.json inside of it
+type FileLockStore struct {
+	// Storage holds the repos, the local disk if nil
+	Storage githttp.Storage
+
+	mu sync.Mutex
+}
+
+const locksFile = "lfs/locks.json"
+
+func (s *FileLockStore) storage() githttp.Storage {
+	if s.Storage != nil {
+		return s.Storage
+	}
+	return githttp.FileStorage{}
+}
+
+func (s *FileLockStore) Create(ctx context.Context, dir string, lock Lock) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	locks, err := s.read(dir)
+	if err != nil {
+		return err
+	}
+	for _, l := range locks {
+		if l.Path == lock.Path {
+			return &ErrorLockExists{l}
+		}
+	}
+
+	return s.write(dir, append(locks, lock))
+}
+
+func (s *FileLockStore) List(ctx context.Context, dir string) ([]Lock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.read(dir)
+}
+
+func (s *FileLockStore) Delete(ctx context.Context, dir string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	locks, err := s.read(dir)
+	if err != nil {
+		return err
+	}
+	for i, l := range locks {
+		if l.Id == id {
+			return s.write(dir, append(locks[:i], locks[i+1:]...))
+		}
+	}
+	return fs.ErrNotExist
+}
+
+func (s *FileLockStore) read(dir string) ([]Lock, error) {
+	f, err := s.storage().Open(dir, locksFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var locks []Lock
+	if err := json.Unmarshal(data, &locks); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(locks, func(i, j int) bool {
+		return locks[i].LockedAt.Before(locks[j].LockedAt)
+	})
+	return locks, nil
+}
+
+// write replaces the lock file, Storages only
+// showing it once it's completely written
+func (s *FileLockStore) write(dir string, locks []Lock) error {
+	data, err := json.MarshalIndent(locks, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.storage().Write(dir, locksFile, bytes.NewReader(data))
+}
@@ -0,0 +1,213 @@
+package lfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AaronO/go-git-http/auth"
+)
+
+func call(t *testing.T, user string, method string, url string, body string) (int, map[string]json.RawMessage) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mediaType)
+	if user != "" {
+		req.SetBasicAuth(user, "secret")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var out map[string]json.RawMessage
+	json.NewDecoder(resp.Body).Decode(&out)
+	return resp.StatusCode, out
+}
+
+func TestLocks(t *testing.T) {
+	git, srv := newServer(t)
+	url := srv.URL + "/org/repo.git/info/lfs/locks"
+
+	if code, _ := call(t, "", "POST", url, `{"path":"a.psd"}`); code != 401 {
+		t.Errorf("anonymous lock: got %d", code)
+	}
+
+	// Basic auth usernames nobody checked aren't trusted
+	req, _ := http.NewRequest("POST", url, strings.NewReader(`{"path":"a.psd"}`))
+	req.SetBasicAuth("alice", "forged")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != 401 {
+		t.Errorf("unauthenticated lock: got %v %v", resp.Status, err)
+	}
+
+	code, out := call(t, "alice", "POST", url, `{"path":"a.psd"}`)
+	if code != 201 {
+		t.Fatalf("lock: got %d", code)
+	}
+	var lock Lock
+	json.Unmarshal(out["lock"], &lock)
+	if lock.Id == "" || lock.Path != "a.psd" || lock.Owner.Name != "alice" {
+		t.Errorf("lock: got %+v", lock)
+	}
+
+	if code, out := call(t, "bob", "POST", url, `{"path":"a.psd"}`); code != 409 || out["lock"] == nil {
+		t.Errorf("lock of locked file: got %d", code)
+	}
+	call(t, "bob", "POST", url, `{"path":"b.psd"}`)
+
+	var locks []Lock
+	code, out = call(t, "", "GET", url+"?path=a.psd", "")
+	if json.Unmarshal(out["locks"], &locks); code != 200 || len(locks) != 1 || locks[0].Id != lock.Id {
+		t.Errorf("list: got %d %+v", code, locks)
+	}
+	code, out = call(t, "", "GET", url+"?limit=1", "")
+	if json.Unmarshal(out["locks"], &locks); code != 200 || len(locks) != 1 || string(out["next_cursor"]) != `"1"` {
+		t.Errorf("list page: got %d %+v %s", code, locks, out["next_cursor"])
+	}
+
+	var ours, theirs []Lock
+	code, out = call(t, "bob", "POST", url+"/verify", `{}`)
+	json.Unmarshal(out["ours"], &ours)
+	json.Unmarshal(out["theirs"], &theirs)
+	if code != 200 || len(ours) != 1 || ours[0].Path != "b.psd" || len(theirs) != 1 || theirs[0].Path != "a.psd" {
+		t.Errorf("verify: got %d %+v %+v", code, ours, theirs)
+	}
+
+	dir, _ := git.ResolveRepo(&http.Request{}, "/org/repo.git")
+	locks, _ = (&FileLockStore{}).List(context.Background(), dir)
+	if len(locks) != 2 {
+		t.Errorf("stored locks: got %+v", locks)
+	}
+
+	unlock := url + "/" + lock.Id + "/unlock"
+	if code, _ := call(t, "bob", "POST", unlock, `{}`); code != 403 {
+		t.Errorf("unlock of another's lock: got %d", code)
+	}
+	if code, _ := call(t, "bob", "POST", unlock, `{"force":true}`); code != 403 {
+		t.Errorf("force unlock without CanForceUnlock: got %d", code)
+	}
+
+	// Admins may break locks
+	git.LFS.(*Server).CanForceUnlock = func(r *http.Request, user auth.AuthInfo, repo string, lock Lock) (bool, error) {
+		return user.Username == "admin", nil
+	}
+	if code, _ := call(t, "bob", "POST", unlock, `{"force":true}`); code != 403 {
+		t.Errorf("force unlock by bob: got %d", code)
+	}
+	if code, _ := call(t, "admin", "POST", unlock, `{"force":true}`); code != 200 {
+		t.Errorf("force unlock by admin: got %d", code)
+	}
+	if code, _ := call(t, "alice", "POST", unlock, `{}`); code != 404 {
+		t.Errorf("unlock of missing lock: got %d", code)
+	}
+}
+
+// proxied sends a request as a reverse proxy would for user, naming
+// them in the X-Remote-User header
+func proxied(t *testing.T, user string, method string, url string, contentType string, body string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Remote-User", user)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+func runGit(t *testing.T, dir string, stdin string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Stdin = strings.NewReader(stdin)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git %s: %v", strings.Join(args, " "), err)
+	}
+	return string(out)
+}
+
+func pktLine(s string) string {
+	return fmt.Sprintf("%04x%s", len(s)+4, s)
+}
+
+func TestLockedPush(t *testing.T) {
+	git, srv := newServer(t)
+	git.TrustedUserHeader = "X-Remote-User"
+	git.PreReceive = git.LFS.(*Server).PreReceive
+	url := srv.URL + "/org/repo.git"
+
+	dir, _ := git.ResolveRepo(&http.Request{}, "/org/repo.git")
+	runGit(t, dir, "", "init", "-q", "--bare")
+
+	work := t.TempDir()
+	runGit(t, work, "", "init", "-q")
+	if err := os.WriteFile(filepath.Join(work, "a.psd"), []byte("layers"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, work, "", "add", "a.psd")
+	runGit(t, work, "", "-c", "user.name=alice", "-c", "user.email=alice@example.com", "commit", "-q", "-m", "Add a.psd")
+	id := strings.TrimSpace(runGit(t, work, "", "rev-parse", "HEAD"))
+	pack := runGit(t, work, "HEAD\n", "pack-objects", "-q", "--stdout", "--revs")
+
+	cmd := pktLine(strings.Repeat("0", 40) + " " + id + " refs/heads/master\x00report-status\n")
+	master := func() string {
+		return strings.TrimSpace(runGit(t, dir, "", "for-each-ref", "--format=%(objectname)", "refs/heads/master"))
+	}
+	push := func(user string, body string) (int, string) {
+		return proxied(t, user, "POST", url+"/git-receive-pack", "application/x-git-receive-pack-request", body)
+	}
+
+	// Users named by the proxy lock files
+	if code, _ := proxied(t, "", "POST", url+"/info/lfs/locks", mediaType, `{"path":"a.psd"}`); code != 401 {
+		t.Errorf("anonymous lock: got %d", code)
+	}
+	code, body := proxied(t, "alice", "POST", url+"/info/lfs/locks", mediaType, `{"path":"a.psd"}`)
+	var out map[string]json.RawMessage
+	var lock Lock
+	json.Unmarshal([]byte(body), &out)
+	if json.Unmarshal(out["lock"], &lock); code != 201 || lock.Owner.Name != "alice" {
+		t.Fatalf("lock: got %d %s", code, body)
+	}
+
+	code, body = push("bob", cmd+"0000"+pack)
+	if code != 200 || !strings.Contains(body, "ng refs/heads/master a.psd is locked by alice") || master() != "" {
+		t.Errorf("push to locked path: got %d %q, master %q", code, body, master())
+	}
+
+	// Command lists ended by a delim-pkt are refused, not pushed unchecked
+	if code, _ := push("bob", cmd+"0001"+pack); code != 400 || master() != "" {
+		t.Errorf("malformed push to locked path: got %d, master %q", code, master())
+	}
+
+	code, body = push("alice", cmd+"0000"+pack)
+	if code != 200 || !strings.Contains(body, "ok refs/heads/master") || master() != id {
+		t.Errorf("push by lock owner: got %d %q, master %q", code, body, master())
+	}
+
+	code, body = proxied(t, "alice", "POST", url+"/info/lfs/locks/verify", mediaType, `{}`)
+	var ours []Lock
+	json.Unmarshal([]byte(body), &out)
+	if json.Unmarshal(out["ours"], &ours); code != 200 || len(ours) != 1 {
+		t.Errorf("verify: got %d %s", code, body)
+	}
+	if code, _ := proxied(t, "alice", "POST", url+"/info/lfs/locks/"+lock.Id+"/unlock", mediaType, `{}`); code != 200 {
+		t.Errorf("unlock: got %d", code)
+	}
+}
@@ -0,0 +1,159 @@
+package lfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"path"
+
+	"github.com/AaronO/go-git-http"
+)
+
+// ContentStore keeps the Git LFS objects of repositories, the dir
+// passed to its methods being the directory of the repository
+type ContentStore interface {
+	// Stat returns the size of an object, ok is false if it's missing
+	Stat(ctx context.Context, dir string, oid string) (size int64, ok bool, err error)
+
+	// Open returns the content of an object and its size.
+	// It returns an error wrapping fs.ErrNotExist if it's missing.
+	Open(ctx context.Context, dir string, oid string) (io.ReadCloser, int64, error)
+
+	// Put stores the content of an object read from r. It returns an
+	// *ErrorInvalidObject, without storing it, if the content doesn't
+	// hash to oid or, when size isn't negative, isn't size bytes long.
+	Put(ctx context.Context, dir string, oid string, size int64, r io.Reader) error
+}
+
+// ErrorInvalidObject is returned when an uploaded object
+// doesn't match its oid or announced size
+type ErrorInvalidObject struct {
+	Oid    string
+	Reason string
+}
+
+func (e *ErrorInvalidObject) Error() string {
+	return fmt.Sprintf("Invalid object '%s': %s", e.Oid, e.Reason)
+}
+
+// FileStore keeps objects in the repository, under lfs/objects
+// (where the git-lfs client keeps them as well)
+type FileStore struct {
+	// Storage holds the repos, the local disk if nil
+	Storage githttp.Storage
+}
+
+func (s FileStore) storage() githttp.Storage {
+	if s.Storage != nil {
+		return s.Storage
+	}
+	return githttp.FileStorage{}
+}
+
+func (s FileStore) path(oid string) string {
+	return path.Join("lfs", "objects", oid[0:2], oid[2:4], oid)
+}
+
+func (s FileStore) Stat(ctx context.Context, dir string, oid string) (int64, bool, error) {
+	f, size, err := s.Open(ctx, dir, oid)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	f.Close()
+	return size, true, nil
+}
+
+func (s FileStore) Open(ctx context.Context, dir string, oid string) (io.ReadCloser, int64, error) {
+	f, err := s.storage().Open(dir, s.path(oid))
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+func (s FileStore) Put(ctx context.Context, dir string, oid string, size int64, r io.Reader) error {
+	// Storages only show files once they're written, which
+	// fails if the content turns out not to match
+	err := s.storage().Write(dir, s.path(oid), &verifyingReader{r: r, h: sha256.New(), oid: oid, size: size})
+	var invalid *ErrorInvalidObject
+	if errors.As(err, &invalid) {
+		return invalid
+	}
+	return err
+}
+
+// verifyingReader fails at the end of an object whose
+// content doesn't match its oid and size
+type verifyingReader struct {
+	r    io.Reader
+	h    hash.Hash
+	n    int64
+	oid  string
+	size int64
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	v.n += int64(n)
+
+	if v.size >= 0 && v.n > v.size {
+		return n, &ErrorInvalidObject{v.oid, fmt.Sprintf("got more than %d bytes", v.size)}
+	}
+	if err != io.EOF {
+		return n, err
+	}
+	if v.size >= 0 && v.n != v.size {
+		return n, &ErrorInvalidObject{v.oid, fmt.Sprintf("got %d bytes, expected %d", v.n, v.size)}
+	}
+	if hex.EncodeToString(v.h.Sum(nil)) != v.oid {
+		return n, &ErrorInvalidObject{v.oid, "content doesn't match oid"}
+	}
+	return n, io.EOF
+}
+
+// gitStorage is the Storage of a GitHttp, as it's
+// set when used, the local disk if it has none
+type gitStorage struct {
+	git *githttp.GitHttp
+}
+
+func (s gitStorage) storage() githttp.Storage {
+	if s.git.Storage != nil {
+		return s.git.Storage
+	}
+	return githttp.FileStorage{}
+}
+
+func (s gitStorage) Open(dir string, name string) (githttp.File, error) {
+	return s.storage().Open(dir, name)
+}
+
+func (s gitStorage) List(dir string, name string) ([]string, error) {
+	return s.storage().List(dir, name)
+}
+
+func (s gitStorage) Write(dir string, name string, r io.Reader) error {
+	return s.storage().Write(dir, name, r)
+}
+
+func (s gitStorage) Remove(dir string, name string) error {
+	return s.storage().Remove(dir, name)
+}
+
+func (s gitStorage) Lock(dir string, name string) (func(), error) {
+	return s.storage().Lock(dir, name)
+}
@@ -0,0 +1,188 @@
+package githttp
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter bounds the number of git upload-pack and receive-pack
+// processes running at once, globally and per repository.
+// Requests over the limits wait in a bounded queue:
+//
+//	git.Limiter = githttp.NewLimiter(githttp.LimiterConfig{
+//		MaxProcs:     32,
+//		MaxPerRepo:   8,
+//		MaxQueue:     100,
+//		QueueTimeout: 30 * time.Second,
+//	})
+//
+// Requests that find the queue full or wait longer than the
+// queue timeout are answered with a 503 and a Retry-After header.
+type Limiter struct {
+	config LimiterConfig
+
+	mu      sync.Mutex
+	running int
+	perRepo map[string]int
+	queue   *list.List
+	served  uint64
+	refused uint64
+}
+
+type LimiterConfig struct {
+	// Processes allowed to run at once, in total and
+	// for a single repo. No limit if zero.
+	MaxProcs   int
+	MaxPerRepo int
+
+	// Requests allowed to wait for a process to end,
+	// none if zero
+	MaxQueue int
+
+	// How long a request may wait, no limit if zero
+	// (it still stops waiting if the client goes away)
+	QueueTimeout time.Duration
+
+	// Delay suggested to refused clients (5s if zero)
+	RetryAfter time.Duration
+}
+
+// LimiterStats are counters on the requests handled by a Limiter
+type LimiterStats struct {
+	// Processes currently running
+	Running int
+
+	// Requests currently waiting
+	Queued int
+
+	// Requests let through and refused
+	Served  uint64
+	Refused uint64
+}
+
+// waiter is a request in the queue, ready
+// is closed once a slot was taken for it
+type waiter struct {
+	repo    string
+	ready   chan struct{}
+	granted bool
+}
+
+func NewLimiter(config LimiterConfig) *Limiter {
+	if config.RetryAfter <= 0 {
+		config.RetryAfter = 5 * time.Second
+	}
+	return &Limiter{
+		config:  config,
+		perRepo: map[string]int{},
+		queue:   list.New(),
+	}
+}
+
+// Acquire waits for a process slot for the repo at dir. It returns
+// a function that frees the slot, or an *ErrorBusy if the request
+// couldn't be queued or waited too long. If ctx is done first,
+// an *ErrorCanceled wrapping its error is returned.
+func (l *Limiter) Acquire(ctx context.Context, dir string) (func(), error) {
+	release := func() { l.release(dir) }
+
+	l.mu.Lock()
+	if l.fits(dir) {
+		l.take(dir)
+		l.mu.Unlock()
+		return release, nil
+	}
+	if l.queue.Len() >= l.config.MaxQueue {
+		l.refused++
+		l.mu.Unlock()
+		return nil, &ErrorBusy{dir, l.config.RetryAfter}
+	}
+	w := &waiter{repo: dir, ready: make(chan struct{})}
+	elem := l.queue.PushBack(w)
+	l.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if l.config.QueueTimeout > 0 {
+		timer := time.NewTimer(l.config.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var err error
+	select {
+	case <-w.ready:
+		return release, nil
+	case <-timeout:
+		err = &ErrorBusy{dir, l.config.RetryAfter}
+	case <-ctx.Done():
+		err = &ErrorCanceled{Err: ctx.Err()}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// The slot may have been handed over in the meantime
+	if w.granted {
+		return release, nil
+	}
+	l.queue.Remove(elem)
+	if _, ok := err.(*ErrorBusy); ok {
+		l.refused++
+	}
+	return nil, err
+}
+
+// Stats returns the limiter's current counters
+func (l *Limiter) Stats() LimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return LimiterStats{
+		Running: l.running,
+		Queued:  l.queue.Len(),
+		Served:  l.served,
+		Refused: l.refused,
+	}
+}
+
+func (l *Limiter) fits(dir string) bool {
+	if l.config.MaxProcs > 0 && l.running >= l.config.MaxProcs {
+		return false
+	}
+	if l.config.MaxPerRepo > 0 && l.perRepo[dir] >= l.config.MaxPerRepo {
+		return false
+	}
+	return true
+}
+
+func (l *Limiter) take(dir string) {
+	l.running++
+	l.perRepo[dir]++
+	l.served++
+}
+
+// release frees a slot and hands slots over to the waiters
+// that fit, in order, skipping those of busy repos
+func (l *Limiter) release(dir string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.running--
+	if l.perRepo[dir]--; l.perRepo[dir] <= 0 {
+		delete(l.perRepo, dir)
+	}
+
+	for elem := l.queue.Front(); elem != nil; {
+		next := elem.Next()
+		w := elem.Value.(*waiter)
+		if l.fits(w.repo) {
+			l.take(w.repo)
+			l.queue.Remove(elem)
+			w.granted = true
+			close(w.ready)
+		}
+		elem = next
+	}
+}
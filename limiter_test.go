@@ -0,0 +1,93 @@
+package githttp
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(LimiterConfig{MaxProcs: 2, MaxPerRepo: 1, MaxQueue: 1})
+	ctx := context.Background()
+
+	releaseA, err := l.Acquire(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseB, err := l.Acquire(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both slots are taken, one request may wait
+	acquired := make(chan func())
+	go func() {
+		release, err := l.Acquire(ctx, "b")
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- release
+	}()
+	for l.Stats().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := l.Acquire(ctx, "c"); err == nil {
+		t.Fatal("acquired with a full queue")
+	} else if _, ok := err.(*ErrorBusy); !ok {
+		t.Fatalf("got %v, want an *ErrorBusy", err)
+	}
+
+	// Freeing a slot of another repo doesn't help the waiting request
+	releaseA()
+	select {
+	case <-acquired:
+		t.Fatal("acquired over the per-repo limit")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	releaseB()
+	release := <-acquired
+	release()
+
+	stats := l.Stats()
+	if stats != (LimiterStats{Running: 0, Queued: 0, Served: 3, Refused: 1}) {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestLimiterTimeout(t *testing.T) {
+	l := NewLimiter(LimiterConfig{MaxProcs: 1, MaxQueue: 1, QueueTimeout: 10 * time.Millisecond, RetryAfter: 1500 * time.Millisecond})
+
+	release, _ := l.Acquire(context.Background(), "a")
+	defer release()
+
+	_, err := l.Acquire(context.Background(), "a")
+	if _, ok := err.(*ErrorBusy); !ok {
+		t.Fatalf("got %v, want an *ErrorBusy", err)
+	}
+
+	w := httptest.NewRecorder()
+	renderError(w, err)
+	if w.Code != 503 || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("got status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// Clients going away aren't told the server is busy
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = l.Acquire(ctx, "a")
+	if _, ok := err.(*ErrorCanceled); !ok || !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want an *ErrorCanceled", err)
+	}
+	w = httptest.NewRecorder()
+	renderError(w, err)
+	if w.Code != 504 || w.Header().Get("Retry-After") != "" {
+		t.Errorf("got status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if stats := l.Stats(); stats.Queued != 0 || stats.Refused != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,157 @@
+package githttp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"time"
+)
+
+// logger returns the Logger to use, discarding all logs if none is set
+func (g *GitHttp) logger() *slog.Logger {
+	if g.Logger != nil {
+		return g.Logger
+	}
+	return discardLogger
+}
+
+var discardLogger = slog.New(discardHandler{})
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// requestStats collects what's reported in a request's access log
+type requestStats struct {
+	start   time.Time
+	service string
+	bytesIn int64
+	err     error
+
+	// Whether the repo of the URL was resolved. Metrics are only
+	// labeled with such repos, others being made up by clients.
+	resolved bool
+
+	// Whether the response was replayed from the PackCache
+	cacheHit bool
+
+	// Exit code of the git process serving the request, if any
+	ranGit   bool
+	exitCode int
+}
+
+// serviceDone notes the exit code of the git process
+// that served the request, if the backend ran one
+func (s *requestStats) serviceDone(b Backend, err error) {
+	if _, ok := b.(execBackend); !ok || s == nil {
+		return
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		s.ranGit, s.exitCode = true, exitErr.ExitCode()
+	} else if err == nil {
+		s.ranGit, s.exitCode = true, 0
+	}
+}
+
+// statsWriter counts the status and size of a response
+type statsWriter struct {
+	http.ResponseWriter
+	status   int
+	bytesOut int64
+}
+
+func (w *statsWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statsWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytesOut += int64(n)
+	return n, err
+}
+
+func (w *statsWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	*r.n += int64(n)
+	return n, err
+}
+
+// logRequest writes the access log of a request
+func (g *GitHttp) logRequest(w *statsWriter, r *http.Request, repo string, stats *requestStats) {
+	level := slog.LevelInfo
+	if w.status >= 500 {
+		level = slog.LevelError
+	}
+
+	attrs := []slog.Attr{
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("repo", repo),
+		slog.String("service", stats.service),
+		slog.Int("status", w.status),
+		slog.Int64("bytes_in", stats.bytesIn),
+		slog.Int64("bytes_out", w.bytesOut),
+		slog.Duration("duration", time.Since(stats.start)),
+		slog.String("user", g.RequestAuthInfo(r).Username),
+		slog.String("remote_addr", r.RemoteAddr),
+	}
+	if stats.ranGit {
+		attrs = append(attrs, slog.Int("exit_code", stats.exitCode))
+	}
+	if stats.cacheHit {
+		attrs = append(attrs, slog.Bool("cache_hit", true))
+	}
+	if stats.err != nil {
+		attrs = append(attrs, slog.String("error", stats.err.Error()))
+	}
+
+	g.logger().LogAttrs(r.Context(), level, "git request", attrs...)
+}
+
+// logCommand traces a git process that has completed
+func (g *GitHttp) logCommand(ctx context.Context, dir string, args []string, start time.Time, exitCode int, err error) {
+	logger := g.logger()
+	if !logger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.String("dir", dir),
+		slog.Any("args", args),
+		slog.Duration("duration", time.Since(start)),
+		slog.Int("exit_code", exitCode),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	logger.LogAttrs(ctx, slog.LevelDebug, "git command", attrs...)
+}
@@ -0,0 +1,52 @@
+package githttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/AaronO/go-git-http/auth"
+)
+
+func TestAccessLog(t *testing.T) {
+	root := t.TempDir()
+	makeBareRepo(t, filepath.Join(root, "repo.git"), true)
+
+	var buf bytes.Buffer
+	g := New(root)
+	g.Logger = slog.New(slog.NewJSONHandler(&buf, nil))
+
+	tests := []struct {
+		path   string
+		status int
+		out    int64
+	}{
+		{"/repo.git/HEAD", 200, 23},
+		{"/missing.git/HEAD", 404, 9},
+	}
+
+	for _, tt := range tests {
+		buf.Reset()
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r.SetBasicAuth("mallory", "forged")
+		r = r.WithContext(auth.NewContext(r.Context(), auth.AuthInfo{Username: "alice"}))
+		g.ServeHTTP(httptest.NewRecorder(), r)
+
+		var entry struct {
+			Msg      string `json:"msg"`
+			Path     string `json:"path"`
+			Status   int    `json:"status"`
+			BytesOut int64  `json:"bytes_out"`
+			User     string `json:"user"`
+		}
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Fatalf("%s: %v in %q", tt.path, err, buf.String())
+		}
+		if entry.Msg != "git request" || entry.Path != tt.path || entry.Status != tt.status || entry.BytesOut != tt.out || entry.User != "alice" {
+			t.Errorf("%s: unexpected log entry %s", tt.path, buf.String())
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package githttp
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics counts the requests served and the git processes spawned by
+// a GitHttp. It serves them over HTTP in the Prometheus text format:
+//
+//	metrics := githttp.NewMetrics()
+//	git.Metrics = metrics
+//	http.Handle("/metrics", metrics)
+//
+// Requests are labeled with their repo, so expect a series
+// per repository and status for each service.
+type Metrics struct {
+	mu       sync.Mutex
+	families []*metricFamily
+	byName   map[string]*metricFamily
+
+	// Limiter whose queue is reported, if any
+	limiter *Limiter
+}
+
+// Upper bounds of the duration histograms' buckets, in seconds
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// Names of the metrics collected
+const (
+	metricRequests        = "githttp_requests_total"
+	metricRequestDuration = "githttp_request_duration_seconds"
+	metricBytesIn         = "githttp_request_bytes_total"
+	metricBytesOut        = "githttp_response_bytes_total"
+	metricAuthFailures    = "githttp_auth_failures_total"
+	metricGitDuration     = "githttp_git_process_duration_seconds"
+	metricGitProcesses    = "githttp_git_processes"
+)
+
+func NewMetrics() *Metrics {
+	m := &Metrics{byName: map[string]*metricFamily{}}
+
+	m.add(metricRequests, "counter", "Requests served, by service, status and repo (empty for unknown repos).")
+	m.add(metricRequestDuration, "histogram", "Time taken to serve requests, by service.")
+	m.add(metricBytesIn, "counter", "Bytes of request bodies read, by service.")
+	m.add(metricBytesOut, "counter", "Bytes of response bodies written, by service.")
+	m.add(metricAuthFailures, "counter", "Requests refused with a 401 or 403, by service.")
+	m.add(metricGitDuration, "histogram", "Run time of git processes, by git command.")
+	m.add(metricGitProcesses, "gauge", "Git processes currently running.")
+
+	return m
+}
+
+func (m *Metrics) add(name string, kind string, help string) {
+	f := &metricFamily{
+		name:   name,
+		kind:   kind,
+		help:   help,
+		values: map[string]float64{},
+		hists:  map[string]*histogram{},
+	}
+	m.families = append(m.families, f)
+	m.byName[name] = f
+}
+
+// metricFamily holds the series of a metric, keyed by their formatted labels
+type metricFamily struct {
+	name   string
+	kind   string
+	help   string
+	values map[string]float64
+	hists  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range durationBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (m *Metrics) addValue(name string, labels string, v float64) {
+	m.mu.Lock()
+	m.byName[name].values[labels] += v
+	m.mu.Unlock()
+}
+
+func (m *Metrics) observe(name string, labels string, v float64) {
+	m.mu.Lock()
+	f := m.byName[name]
+	h := f.hists[labels]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		f.hists[labels] = h
+	}
+	h.observe(v)
+	m.mu.Unlock()
+}
+
+// observeRequest records a request once it has been served.
+// Like the other recording methods, it does nothing on a nil Metrics.
+func (m *Metrics) observeRequest(service string, repo string, status int, bytesIn int64, bytesOut int64, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	if service == "" {
+		service = "dumb"
+	}
+
+	m.addValue(metricRequests, formatLabels("service", service, "status", strconv.Itoa(status), "repo", repo), 1)
+	m.observe(metricRequestDuration, formatLabels("service", service), duration.Seconds())
+	m.addValue(metricBytesIn, formatLabels("service", service), float64(bytesIn))
+	m.addValue(metricBytesOut, formatLabels("service", service), float64(bytesOut))
+
+	if status == http.StatusUnauthorized || status == http.StatusForbidden {
+		m.addValue(metricAuthFailures, formatLabels("service", service), 1)
+	}
+}
+
+// processStarted and processDone track the git processes running
+func (m *Metrics) processStarted() {
+	if m == nil {
+		return
+	}
+	m.addValue(metricGitProcesses, "", 1)
+}
+
+func (m *Metrics) processDone(args []string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	command := ""
+	if len(args) > 0 {
+		command = args[0]
+	}
+	m.addValue(metricGitProcesses, "", -1)
+	m.observe(metricGitDuration, formatLabels("command", command), duration.Seconds())
+}
+
+// watchLimiter reports the state of a Limiter along with the metrics
+func (m *Metrics) watchLimiter(l *Limiter) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.limiter = l
+	m.mu.Unlock()
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+
+	m.mu.Lock()
+	if m.limiter != nil {
+		stats := m.limiter.Stats()
+		writeSimpleMetric(&b, "githttp_limiter_running", "gauge", "Git processes running under the limiter.", float64(stats.Running))
+		writeSimpleMetric(&b, "githttp_limiter_queued", "gauge", "Requests waiting for a git process slot.", float64(stats.Queued))
+		writeSimpleMetric(&b, "githttp_limiter_refused_total", "counter", "Requests refused because the server was busy.", float64(stats.Refused))
+	}
+	for _, f := range m.families {
+		fmt.Fprintf(&b, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", f.name, f.kind)
+
+		if f.kind == "gauge" && len(f.values) == 0 {
+			fmt.Fprintf(&b, "%s 0\n", f.name)
+		}
+		for _, labels := range sortedKeys(f.values) {
+			fmt.Fprintf(&b, "%s%s %s\n", f.name, labels, formatValue(f.values[labels]))
+		}
+		for _, labels := range sortedKeys(f.hists) {
+			h := f.hists[labels]
+			for i, bound := range durationBuckets {
+				le := formatLabels("le", formatValue(bound))
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, joinLabels(labels, le), h.counts[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, joinLabels(labels, formatLabels("le", "+Inf")), h.count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", f.name, labels, formatValue(h.sum))
+			fmt.Fprintf(&b, "%s_count%s %d\n", f.name, labels, h.count)
+		}
+	}
+	m.mu.Unlock()
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func writeSimpleMetric(b *strings.Builder, name string, kind string, help string, v float64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, kind, name, formatValue(v))
+}
+
+// formatLabels formats label name and value pairs as {name="value",...}
+func formatLabels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// joinLabels merges two formatted label sets
+func joinLabels(a, b string) string {
+	if a == "" || a == "{}" {
+		return b
+	}
+	return a[:len(a)-1] + "," + b[1:]
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,63 @@
+package githttp
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	root := t.TempDir()
+	makeBareRepo(t, filepath.Join(root, "repo.git"), true)
+
+	g := New(root)
+	g.UploadPack = false
+	g.Metrics = NewMetrics()
+
+	for _, path := range []string{"/repo.git/HEAD", "/repo.git/HEAD", "/missing.git/HEAD", "/random/path"} {
+		g.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	r := httptest.NewRequest("POST", "/repo.git/git-upload-pack", nil)
+	r.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	g.ServeHTTP(httptest.NewRecorder(), r)
+
+	g.Metrics.processStarted()
+	g.Metrics.processStarted()
+	g.Metrics.processDone([]string{"upload-pack", "--stateless-rpc", "."}, 2*time.Second)
+
+	w := httptest.NewRecorder()
+	g.Metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	out := w.Body.String()
+
+	for _, line := range []string{
+		"# TYPE githttp_requests_total counter",
+		`githttp_requests_total{service="dumb",status="200",repo="/repo.git"} 2`,
+		`githttp_requests_total{service="dumb",status="404",repo=""} 2`,
+		`githttp_requests_total{service="upload-pack",status="403",repo="/repo.git"} 1`,
+		`githttp_response_bytes_total{service="dumb"} 64`,
+		`githttp_auth_failures_total{service="upload-pack"} 1`,
+		`githttp_request_duration_seconds_count{service="dumb"} 4`,
+		"githttp_git_processes 1",
+		`githttp_git_process_duration_seconds_bucket{command="upload-pack",le="1"} 0`,
+		`githttp_git_process_duration_seconds_bucket{command="upload-pack",le="2.5"} 1`,
+		`githttp_git_process_duration_seconds_bucket{command="upload-pack",le="+Inf"} 1`,
+		`githttp_git_process_duration_seconds_sum{command="upload-pack"} 2`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, out)
+		}
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	got := formatLabels("repo", "a\"b\\c\nd", "service", "fetch")
+	want := `{repo="a\"b\\c\nd",service="fetch"}`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got := joinLabels(`{a="1"}`, `{le="2"}`); got != `{a="1",le="2"}` {
+		t.Errorf("got %s", got)
+	}
+}
@@ -0,0 +1,55 @@
+package githttp
+
+import (
+	"strings"
+)
+
+// ObjectFormat is the hash algorithm naming the objects of a repository
+type ObjectFormat string
+
+// Supported object formats
+const (
+	SHA1   ObjectFormat = "sha1"
+	SHA256 ObjectFormat = "sha256"
+)
+
+// HexSize returns the length of hex encoded object ids
+func (f ObjectFormat) HexSize() int {
+	if f == SHA256 {
+		return 64
+	}
+	return 40
+}
+
+// repoObjectFormat returns the object format of the repository in dir,
+// as set by "git init --object-format"
+func repoObjectFormat(s Storage, dir string) ObjectFormat {
+	if format, ok := readConfig(s, dir, "extensions", "objectformat"); ok {
+		return ObjectFormat(strings.ToLower(format))
+	}
+	return SHA1
+}
+
+// isObjectId reports whether s is a hex encoded SHA-1 or SHA-256 object id
+func isObjectId(s string) bool {
+	if len(s) != SHA1.HexSize() && len(s) != SHA256.HexSize() {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// fileObjectId returns the object or pack id named by the path of
+// a loose object, pack or pack index (e.g. "objects/pack/pack-<id>.idx")
+func fileObjectId(file string) string {
+	file = strings.TrimPrefix(file, "/")
+	if strings.HasPrefix(file, "objects/pack/pack-") {
+		id := strings.TrimPrefix(file, "objects/pack/pack-")
+		return id[:strings.IndexByte(id, '.')]
+	}
+	return strings.Replace(strings.TrimPrefix(file, "objects/"), "/", "", 1)
+}
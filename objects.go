@@ -0,0 +1,129 @@
+package githttp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// commitObject holds what's needed to walk
+// the history from a commit
+type commitObject struct {
+	tree    string
+	parents []string
+
+	// Committer date, in seconds since the epoch
+	date int64
+}
+
+func parseCommit(data []byte) (commitObject, error) {
+	var c commitObject
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+
+		// Headers end with a blank line
+		if len(line) == 0 {
+			break
+		}
+		key, value, _ := strings.Cut(string(line), " ")
+		switch key {
+		case "tree":
+			c.tree = value
+		case "parent":
+			c.parents = append(c.parents, value)
+		case "committer":
+			// "<name> <<email>> <date> <timezone>"
+			if fields := strings.Fields(value); len(fields) >= 2 {
+				c.date, _ = strconv.ParseInt(fields[len(fields)-2], 10, 64)
+			}
+		}
+	}
+
+	if !isObjectId(c.tree) {
+		return c, fmt.Errorf("commit without tree")
+	}
+	return c, nil
+}
+
+type treeEntry struct {
+	mode string
+	name string
+	id   string
+}
+
+// Mode of tree entries for submodules, whose
+// commits live in another repo
+const gitlinkMode = "160000"
+
+func (e treeEntry) isTree() bool {
+	return e.mode == "40000"
+}
+
+// parseTree parses the "<mode> <name>\x00<raw id>" entries of a tree
+func parseTree(data []byte, hashSize int) ([]treeEntry, error) {
+	var entries []treeEntry
+	for len(data) > 0 {
+		sp := bytes.IndexByte(data, ' ')
+		nul := bytes.IndexByte(data, 0)
+		if sp < 0 || nul < sp || len(data) < nul+1+hashSize {
+			return nil, fmt.Errorf("bad tree entry")
+		}
+
+		entries = append(entries, treeEntry{
+			mode: string(data[:sp]),
+			name: string(data[sp+1 : nul]),
+			id:   hex.EncodeToString(data[nul+1 : nul+1+hashSize]),
+		})
+		data = data[nul+1+hashSize:]
+	}
+	return entries, nil
+}
+
+// parseTag returns the object an annotated tag points to
+func parseTag(data []byte) (string, objectType, error) {
+	var id, typ string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			break
+		}
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "object":
+			id = value
+		case "type":
+			typ = value
+		}
+	}
+
+	t, err := parseObjectType(typ)
+	if err != nil || !isObjectId(id) {
+		return "", 0, fmt.Errorf("bad tag")
+	}
+	return id, t, nil
+}
+
+// peel follows annotated tags down to the object they point to
+func (db *objectDB) peel(id string) (string, objectType, error) {
+	for depth := 0; ; depth++ {
+		typ, data, err := db.read(id)
+		if err != nil {
+			return "", 0, err
+		}
+		if typ != objTag {
+			return id, typ, nil
+		}
+		if depth >= 20 {
+			return "", 0, fmt.Errorf("tag %s nested too deep", id)
+		}
+		if id, _, err = parseTag(data); err != nil {
+			return "", 0, err
+		}
+	}
+}
@@ -0,0 +1,665 @@
+package githttp
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// objectType is the type of a git object, numbered as in packs
+type objectType int
+
+const (
+	objCommit   objectType = 1
+	objTree     objectType = 2
+	objBlob     objectType = 3
+	objTag      objectType = 4
+	objOfsDelta objectType = 6
+	objRefDelta objectType = 7
+)
+
+func (t objectType) String() string {
+	switch t {
+	case objCommit:
+		return "commit"
+	case objTree:
+		return "tree"
+	case objBlob:
+		return "blob"
+	case objTag:
+		return "tag"
+	}
+	return "unknown"
+}
+
+func parseObjectType(s string) (objectType, error) {
+	for _, t := range []objectType{objCommit, objTree, objBlob, objTag} {
+		if t.String() == s {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown object type '%s'", s)
+}
+
+// errObjectNotFound is returned when reading a missing object
+var errObjectNotFound = errors.New("object not found")
+
+// errObjectTooLarge is returned when a pushed object is larger
+// than allowed
+var errObjectTooLarge = errors.New("object too large")
+
+// errPackTooLarge is returned when a pushed pack is larger than allowed
+var errPackTooLarge = errors.New("pack too large")
+
+// Longest delta chain followed, as git pack-objects --depth allows
+// at most, chains pointing back at themselves never ending
+const maxDeltaDepth = 4095
+
+// Resolved delta bases kept in memory, so that long
+// delta chains aren't resolved over and over again
+const maxDeltaBaseCache = 64 << 20
+
+// objectDB reads the objects of a repository, loose or packed,
+// along with those of its alternates
+type objectDB struct {
+	storage Storage
+	format  ObjectFormat
+
+	// Object directories, the repo's first
+	dirs  []objectDir
+	packs []*packFile
+
+	cache     map[packOffset]cachedObject
+	cacheSize int
+
+	// Size the objects of packs received may not exceed, if not zero
+	maxObjectSize int64
+
+	// Size packs received may not exceed, if not zero
+	maxPackSize int64
+}
+
+// objectDir is an object directory, named by the dir
+// of its repo and its path in there, e.g. "objects"
+type objectDir struct {
+	repo string
+	name string
+}
+
+type packOffset struct {
+	pack   *packFile
+	offset int64
+}
+
+type cachedObject struct {
+	typ  objectType
+	data []byte
+}
+
+// openObjectDB opens the object database of the repo in dir
+func openObjectDB(s Storage, dir string) (*objectDB, error) {
+	db := &objectDB{
+		storage: s,
+		format:  repoObjectFormat(s, dir),
+		cache:   map[packOffset]cachedObject{},
+	}
+	if err := db.addDir(objectDir{dir, "objects"}, 0); err != nil {
+		db.close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// addDir adds an object directory, its packs and its alternates
+func (db *objectDB) addDir(dir objectDir, depth int) error {
+	for _, d := range db.dirs {
+		if d == dir {
+			return nil
+		}
+	}
+	db.dirs = append(db.dirs, dir)
+
+	names, err := db.storage.List(dir.repo, dir.name+"/pack")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(path.Base(name), "pack-") || !strings.HasSuffix(name, ".idx") {
+			continue
+		}
+		pack, err := openPackFile(db.storage, dir.repo, strings.TrimSuffix(name, ".idx"), db.format)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Pack being written or removed
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		db.packs = append(db.packs, pack)
+	}
+
+	// Alternates may have alternates, up to git's depth
+	alternates, err := readFile(db.storage, dir.repo, dir.name+"/info/alternates")
+	if err != nil || depth >= 5 {
+		return nil
+	}
+	for _, line := range strings.Split(string(alternates), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(dir.repo, dir.name, line)
+		}
+		line = filepath.Clean(line)
+		alternate := objectDir{filepath.Dir(line), filepath.Base(line)}
+		if err := db.addDir(alternate, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *objectDB) close() {
+	for _, pack := range db.packs {
+		pack.close()
+	}
+}
+
+// newHash returns the hash naming the objects of the repo
+func (db *objectDB) newHash() hash.Hash {
+	if db.format == SHA256 {
+		return sha256.New()
+	}
+	return sha1.New()
+}
+
+// has reports whether the object named id is in the repo
+func (db *objectDB) has(id string) bool {
+	raw, err := hex.DecodeString(id)
+	if err != nil || len(raw)*2 != db.format.HexSize() {
+		return false
+	}
+	for _, pack := range db.packs {
+		if _, ok := pack.find(raw); ok {
+			return true
+		}
+	}
+	for _, dir := range db.dirs {
+		if fileExists(db.storage, dir.repo, looseObjectPath(dir.name, id)) {
+			return true
+		}
+	}
+	return false
+}
+
+// read returns the type and content of the object named id
+func (db *objectDB) read(id string) (objectType, []byte, error) {
+	raw, err := hex.DecodeString(id)
+	if err != nil || len(raw)*2 != db.format.HexSize() {
+		return 0, nil, fmt.Errorf("invalid object id '%s'", id)
+	}
+
+	if pack, offset := db.findPacked(raw); pack != nil {
+		return db.readPacked(pack, offset)
+	}
+	for _, dir := range db.dirs {
+		typ, data, err := readLooseObject(db.storage, dir.repo, looseObjectPath(dir.name, id))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, nil, fmt.Errorf("object %s: %v", id, err)
+		}
+		return typ, data, nil
+	}
+	return 0, nil, fmt.Errorf("%w: %s", errObjectNotFound, id)
+}
+
+// readType reads an object, making sure it's of the given type
+func (db *objectDB) readType(id string, want objectType) ([]byte, error) {
+	typ, data, err := db.read(id)
+	if err != nil {
+		return nil, err
+	}
+	if typ != want {
+		return nil, fmt.Errorf("object %s is a %s, not a %s", id, typ, want)
+	}
+	return data, nil
+}
+
+// readPacked reads the object at offset in a pack, resolving deltas.
+// Delta chains are followed down to their base, then applied back up,
+// so that long chains don't take a stack frame per delta.
+func (db *objectDB) readPacked(pack *packFile, offset int64) (objectType, []byte, error) {
+	var chain []packOffset
+	var deltas [][]byte
+	var typ objectType
+	var data []byte
+
+	for {
+		key := packOffset{pack, offset}
+		if obj, ok := db.cache[key]; ok {
+			typ, data = obj.typ, obj.data
+			break
+		}
+		if len(chain) > maxDeltaDepth {
+			return 0, nil, fmt.Errorf("delta chain in %s at %d is too long", chain[0].pack.path, chain[0].offset)
+		}
+
+		entry, err := pack.entry(offset)
+		if err != nil {
+			return 0, nil, err
+		}
+		if entry.typ != objOfsDelta && entry.typ != objRefDelta {
+			typ, data = entry.typ, entry.data
+			break
+		}
+		chain = append(chain, key)
+		deltas = append(deltas, entry.data)
+
+		if entry.typ == objOfsDelta {
+			offset = entry.baseOffset
+			continue
+		}
+		if pack, offset = db.findPacked(entry.baseId); pack != nil {
+			continue
+		}
+		// Bases outside of packs are loose
+		if typ, data, err = db.read(hex.EncodeToString(entry.baseId)); err != nil {
+			return 0, nil, fmt.Errorf("delta base in %s at %d: %w", key.pack.path, key.offset, err)
+		}
+		break
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		var err error
+		key := chain[i]
+		if data, err = applyDelta(data, deltas[i], key.pack.maxObjectSize); err != nil {
+			return 0, nil, fmt.Errorf("delta in %s at %d: %v", key.pack.path, key.offset, err)
+		}
+
+		// Only deltified objects are worth keeping,
+		// others are read with a single inflate
+		if db.cacheSize+len(data) > maxDeltaBaseCache {
+			db.cache = map[packOffset]cachedObject{}
+			db.cacheSize = 0
+		}
+		db.cache[key] = cachedObject{typ, data}
+		db.cacheSize += len(data)
+	}
+
+	return typ, data, nil
+}
+
+// findPacked returns the pack holding the object with the
+// raw id, and its offset in there, a nil pack if none does
+func (db *objectDB) findPacked(raw []byte) (*packFile, int64) {
+	for _, pack := range db.packs {
+		if offset, ok := pack.find(raw); ok {
+			return pack, offset
+		}
+	}
+	return nil, 0
+}
+
+// looseObjectPath returns the name of a loose object
+// in the object directory named dir
+func looseObjectPath(dir string, id string) string {
+	return path.Join(dir, id[:2], id[2:])
+}
+
+// readLooseObject inflates the loose object in file,
+// made of a "<type> <size>\x00" header and the content
+func readLooseObject(s Storage, dir string, file string) (objectType, []byte, error) {
+	f, err := s.Open(dir, file)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+
+	zr, err := zlib.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer zr.Close()
+
+	br := bufio.NewReader(zr)
+	header, err := br.ReadString(0)
+	if err != nil {
+		return 0, nil, fmt.Errorf("bad loose object header")
+	}
+	name, sizeStr, ok := strings.Cut(strings.TrimSuffix(header, "\x00"), " ")
+	if !ok {
+		return 0, nil, fmt.Errorf("bad loose object header")
+	}
+	typ, err := parseObjectType(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil || size < 0 {
+		return 0, nil, fmt.Errorf("bad loose object size")
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(br, data); err != nil {
+		return 0, nil, err
+	}
+	return typ, data, nil
+}
+
+// hashObject returns the id of an object
+func (db *objectDB) hashObject(typ objectType, data []byte) string {
+	h := db.newHash()
+	fmt.Fprintf(h, "%s %d\x00", typ, len(data))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// packFile is a pack and its version 2 index
+type packFile struct {
+	path string
+	file File
+
+	hashSize int
+	fanout   [256]uint32
+	ids      []byte
+	offsets  []byte
+	large    []byte
+
+	// Offsets of the objects of a pack being indexed, by raw id
+	indexing map[string]int64
+
+	// Size objects of a pushed pack may not exceed, if not zero
+	maxObjectSize int64
+}
+
+// openPackFile opens the pack of the repo in dir
+// whose name is given without extension
+func openPackFile(s Storage, dir string, name string, format ObjectFormat) (*packFile, error) {
+	idx, err := readFile(s, dir, name+".idx")
+	if err != nil {
+		return nil, err
+	}
+
+	p := &packFile{path: name + ".pack", hashSize: format.HexSize() / 2}
+	if err := p.parseIndex(idx); err != nil {
+		return nil, fmt.Errorf("%s.idx: %v", name, err)
+	}
+
+	p.file, err = s.Open(dir, p.path)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+var packIndexMagic = []byte{0xff, 't', 'O', 'c'}
+
+func (p *packFile) parseIndex(idx []byte) error {
+	header := 8 + 256*4
+	if len(idx) < header || !bytes.Equal(idx[:4], packIndexMagic) || binary.BigEndian.Uint32(idx[4:8]) != 2 {
+		return fmt.Errorf("unsupported pack index")
+	}
+	for i := range p.fanout {
+		p.fanout[i] = binary.BigEndian.Uint32(idx[8+i*4:])
+	}
+
+	n := int(p.fanout[255])
+	idsEnd := header + n*p.hashSize
+	offsetsStart := idsEnd + n*4 // past the CRCs
+	offsetsEnd := offsetsStart + n*4
+	if len(idx) < offsetsEnd+2*p.hashSize {
+		return fmt.Errorf("truncated pack index")
+	}
+
+	p.ids = idx[header:idsEnd]
+	p.offsets = idx[offsetsStart:offsetsEnd]
+	p.large = idx[offsetsEnd : len(idx)-2*p.hashSize]
+	return nil
+}
+
+// find returns the offset of an object in the pack
+func (p *packFile) find(id []byte) (int64, bool) {
+	if p.indexing != nil {
+		offset, ok := p.indexing[string(id)]
+		return offset, ok
+	}
+
+	lo, hi := 0, int(p.fanout[id[0]])
+	if id[0] > 0 {
+		lo = int(p.fanout[id[0]-1])
+	}
+
+	for lo < hi {
+		mid := (lo + hi) / 2
+		switch bytes.Compare(p.ids[mid*p.hashSize:(mid+1)*p.hashSize], id) {
+		case 0:
+			return p.offset(mid), true
+		case -1:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+	return 0, false
+}
+
+func (p *packFile) offset(i int) int64 {
+	offset := binary.BigEndian.Uint32(p.offsets[i*4:])
+	if offset&0x80000000 == 0 {
+		return int64(offset)
+	}
+	i = int(offset & 0x7fffffff)
+	if (i+1)*8 > len(p.large) {
+		return -1
+	}
+	return int64(binary.BigEndian.Uint64(p.large[i*8:]))
+}
+
+func (p *packFile) close() {
+	if p.file != nil {
+		p.file.Close()
+	}
+}
+
+// packEntry is an object as stored in a pack,
+// deltas not being resolved
+type packEntry struct {
+	typ  objectType
+	data []byte
+
+	// Base of objOfsDelta and objRefDelta entries
+	baseOffset int64
+	baseId     []byte
+}
+
+// entry reads the entry at offset
+func (p *packFile) entry(offset int64) (*packEntry, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("bad offset in %s", p.path)
+	}
+	br := bufio.NewReader(io.NewSectionReader(p.file, offset, 1<<62))
+
+	typ, size, err := readEntryHeader(br)
+	if err != nil {
+		return nil, fmt.Errorf("%s at %d: %v", p.path, offset, err)
+	}
+
+	entry := &packEntry{typ: typ}
+	switch typ {
+	case objOfsDelta:
+		rel, err := readOffsetDelta(br)
+		if err != nil {
+			return nil, err
+		}
+		entry.baseOffset = offset - rel
+	case objRefDelta:
+		entry.baseId = make([]byte, p.hashSize)
+		if _, err := io.ReadFull(br, entry.baseId); err != nil {
+			return nil, err
+		}
+	case objCommit, objTree, objBlob, objTag:
+	default:
+		return nil, fmt.Errorf("%s at %d: bad object type %d", p.path, offset, typ)
+	}
+
+	if p.maxObjectSize > 0 && size > p.maxObjectSize {
+		return nil, fmt.Errorf("%s at %d: %w", p.path, offset, errObjectTooLarge)
+	}
+	entry.data, err = inflate(br, size)
+	if err != nil {
+		return nil, fmt.Errorf("%s at %d: %v", p.path, offset, err)
+	}
+	return entry, nil
+}
+
+// readEntryHeader reads the type and inflated size of a pack entry
+func readEntryHeader(r io.ByteReader) (objectType, int64, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	typ := objectType(c >> 4 & 7)
+	size := int64(c & 15)
+	for shift := 4; c&0x80 != 0; shift += 7 {
+		if c, err = r.ReadByte(); err != nil {
+			return 0, 0, err
+		}
+		if shift > 56 {
+			return 0, 0, fmt.Errorf("bad entry size")
+		}
+		size |= int64(c&0x7f) << shift
+	}
+	return typ, size, nil
+}
+
+// readOffsetDelta reads the distance back to the base of an objOfsDelta
+func readOffsetDelta(r io.ByteReader) (int64, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	offset := int64(c & 0x7f)
+	for c&0x80 != 0 {
+		if c, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+		if offset > 1<<55 {
+			return 0, fmt.Errorf("bad delta offset")
+		}
+		offset = (offset+1)<<7 | int64(c&0x7f)
+	}
+	return offset, nil
+}
+
+// inflate reads size bytes of zlib compressed data from r, up to
+// the end of the compressed stream if r is an io.ByteReader
+func inflate(r io.Reader, size int64) ([]byte, error) {
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	// The size comes from the pack, it's not trusted with allocations
+	var buf bytes.Buffer
+	buf.Grow(int(min(size, maxInflatePrealloc)))
+	if _, err := io.Copy(&buf, io.LimitReader(zr, size+1)); err != nil {
+		return nil, err
+	}
+	switch {
+	case int64(buf.Len()) > size:
+		return nil, fmt.Errorf("object larger than its size")
+	case int64(buf.Len()) < size:
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), nil
+}
+
+// Memory allocated upfront for inflated objects,
+// which grow beyond as they're actually read
+const maxInflatePrealloc = 1 << 20
+
+// applyDelta rebuilds an object from its base and a delta,
+// refusing results larger than max unless it's zero
+func applyDelta(base []byte, delta []byte, max int64) ([]byte, error) {
+	errBadDelta := fmt.Errorf("bad delta")
+
+	r := bytes.NewReader(delta)
+	baseSize, err := binary.ReadUvarint(r)
+	if err != nil || baseSize != uint64(len(base)) {
+		return nil, errBadDelta
+	}
+	size, err := binary.ReadUvarint(r)
+	if err != nil || size > 1<<40 {
+		return nil, errBadDelta
+	}
+	if max > 0 && size > uint64(max) {
+		return nil, errObjectTooLarge
+	}
+
+	// Deltas mostly copy their base, the claimed size isn't trusted
+	out := make([]byte, 0, min(size, uint64(len(base)+len(delta))))
+	for r.Len() > 0 {
+		if uint64(len(out)) > size {
+			return nil, errBadDelta
+		}
+		op, _ := r.ReadByte()
+
+		if op&0x80 == 0 {
+			// Insert the next op bytes
+			if op == 0 || int(op) > r.Len() {
+				return nil, errBadDelta
+			}
+			start := len(delta) - r.Len()
+			out = append(out, delta[start:start+int(op)]...)
+			r.Seek(int64(op), io.SeekCurrent)
+			continue
+		}
+
+		// Copy from the base, offset and size bytes
+		// being present as flagged by op's bits
+		var offset, n uint64
+		for i := 0; i < 7; i++ {
+			if op&(1<<i) == 0 {
+				continue
+			}
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, errBadDelta
+			}
+			if i < 4 {
+				offset |= uint64(b) << (8 * i)
+			} else {
+				n |= uint64(b) << (8 * (i - 4))
+			}
+		}
+		if n == 0 {
+			n = 0x10000
+		}
+		if offset+n > uint64(len(base)) {
+			return nil, errBadDelta
+		}
+		out = append(out, base[offset:offset+n]...)
+	}
+
+	if uint64(len(out)) != size {
+		return nil, errBadDelta
+	}
+	return out, nil
+}
@@ -0,0 +1,316 @@
+package githttp
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// PackCache keeps upload-pack responses on disk, so that identical
+// fetches (e.g. CI clones of the same commit) are answered without
+// running git again:
+//
+//	cache, err := githttp.NewPackCache("/var/cache/git-packs", 10<<30)
+//	git.PackCache = cache
+//
+// Only requests that end the negotiation (and so are answered with
+// a pack) are cached, keyed on the repo and the wants, haves and
+// capabilities of the request. Least recently used responses are
+// evicted past the size limit, and a repo's responses are dropped
+// whenever it's pushed to.
+type PackCache struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+
+	// Bumped when a repo is invalidated, so responses
+	// being written at the time aren't kept
+	generations map[string]uint64
+
+	hits   uint64
+	misses uint64
+}
+
+// PackCacheStats are counters on the responses of a PackCache
+type PackCacheStats struct {
+	// Responses kept and their total size in bytes
+	Entries int
+	Size    int64
+
+	// Cacheable requests answered from the cache or not
+	Hits   uint64
+	Misses uint64
+}
+
+type packCacheEntry struct {
+	key  string
+	repo string
+	size int64
+}
+
+// Requests larger than this aren't cached, they
+// would have to be held in memory to be keyed
+const maxCacheableRequest = 1 << 20
+
+// NewPackCache returns a PackCache keeping up to maxSize bytes of
+// responses in dir. The cache owns dir, any file left in it is removed.
+func NewPackCache(dir string, maxSize int64) (*PackCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		os.Remove(name)
+	}
+
+	return &PackCache{
+		dir:         dir,
+		maxSize:     maxSize,
+		lru:         list.New(),
+		entries:     map[string]*list.Element{},
+		generations: map[string]uint64{},
+	}, nil
+}
+
+// Invalidate drops the cached responses of the repo at dir
+func (c *PackCache) Invalidate(dir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generations[dir]++
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*packCacheEntry).repo == dir {
+			c.remove(elem)
+		}
+		elem = next
+	}
+}
+
+// Stats returns the cache's current counters
+func (c *PackCache) Stats() PackCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return PackCacheStats{
+		Entries: c.lru.Len(),
+		Size:    c.size,
+		Hits:    c.hits,
+		Misses:  c.misses,
+	}
+}
+
+// requestKey reads an upload-pack request from body to key it. It returns
+// a reader with the whole request, and an empty key if it can't be cached.
+func (c *PackCache) requestKey(dir string, version int, body io.Reader) (io.Reader, string, error) {
+	buf, err := io.ReadAll(io.LimitReader(body, maxCacheableRequest+1))
+	if err != nil {
+		return nil, "", err
+	}
+	input := io.MultiReader(bytes.NewReader(buf), body)
+	if len(buf) > maxCacheableRequest {
+		return input, "", nil
+	}
+
+	lines, ok := cacheableLines(buf)
+	if !ok {
+		return input, "", nil
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00", dir, version)
+	for _, line := range lines {
+		fmt.Fprintf(h, "%s\n", line)
+	}
+	return input, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cacheableLines returns the sorted lines and capabilities of
+// a request, leaving out those naming the client. Requests that
+// don't end the negotiation with "done" aren't cacheable.
+func cacheableLines(req []byte) ([]string, bool) {
+	var lines []string
+	done := false
+
+	for len(req) > 0 {
+		if len(req) < pktLenSize {
+			return nil, false
+		}
+		pktLen, err := parseHex(req[:pktLenSize])
+		if err != nil {
+			return nil, false
+		}
+		if pktLen < pktLenSize {
+			// flush, delim or response-end
+			req = req[pktLenSize:]
+			continue
+		}
+		if int(pktLen) > len(req) {
+			return nil, false
+		}
+		line := strings.TrimSuffix(string(req[pktLenSize:pktLen]), "\n")
+		req = req[pktLen:]
+
+		// Protocol v0 capabilities follow the first want
+		if fields := strings.Fields(line); len(fields) > 2 && fields[0] == "want" {
+			line = "want " + fields[1]
+			for _, c := range fields[2:] {
+				lines = appendCapability(lines, c)
+			}
+		}
+
+		if line == "done" {
+			done = true
+		}
+		lines = appendCapability(lines, line)
+	}
+
+	sort.Strings(lines)
+	return lines, done
+}
+
+// appendCapability appends line unless it's a client specific capability
+func appendCapability(lines []string, line string) []string {
+	if strings.HasPrefix(line, "agent=") || strings.HasPrefix(line, "session-id=") {
+		return lines
+	}
+	return append(lines, line)
+}
+
+// open returns the cached response for key, if any
+func (c *PackCache) open(key string) (*os.File, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	f, err := os.Open(filepath.Join(c.dir, key))
+	if err != nil {
+		c.remove(elem)
+		c.misses++
+		return nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+	c.hits++
+	return f, true
+}
+
+// create starts caching the response for key
+func (c *PackCache) create(repo string, key string) *packCacheWriter {
+	f, err := os.CreateTemp(c.dir, "tmp-*")
+	if err != nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	generation := c.generations[repo]
+	c.mu.Unlock()
+
+	return &packCacheWriter{
+		cache:      c,
+		file:       f,
+		repo:       repo,
+		key:        key,
+		generation: generation,
+	}
+}
+
+// add keeps a response written to file under key, evicting
+// the least recently used responses to make room for it
+func (c *PackCache) add(w *packCacheWriter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.generations[w.repo] != w.generation {
+		os.Remove(w.file.Name())
+		return
+	}
+	if elem, ok := c.entries[w.key]; ok {
+		c.remove(elem)
+	}
+	if err := os.Rename(w.file.Name(), filepath.Join(c.dir, w.key)); err != nil {
+		os.Remove(w.file.Name())
+		return
+	}
+
+	c.entries[w.key] = c.lru.PushFront(&packCacheEntry{w.key, w.repo, w.size})
+	c.size += w.size
+
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *PackCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*packCacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+	os.Remove(filepath.Join(c.dir, entry.key))
+}
+
+// packCacheWriter writes a response to the cache as it's sent.
+// It never fails, so as not to disturb the response, but a
+// response that couldn't be written entirely isn't kept.
+type packCacheWriter struct {
+	cache      *PackCache
+	file       *os.File
+	repo       string
+	key        string
+	generation uint64
+	size       int64
+	err        error
+}
+
+func (w *packCacheWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return len(p), nil
+	}
+	if w.size+int64(len(p)) > w.cache.maxSize {
+		w.err = fmt.Errorf("response larger than the cache")
+		return len(p), nil
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	w.err = err
+	return len(p), nil
+}
+
+// commit keeps the response if it was written entirely
+func (w *packCacheWriter) commit() {
+	if err := w.file.Close(); err != nil && w.err == nil {
+		w.err = err
+	}
+	if w.err != nil {
+		os.Remove(w.file.Name())
+		return
+	}
+	w.cache.add(w)
+}
+
+// abort drops a response that wasn't sent entirely
+func (w *packCacheWriter) abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
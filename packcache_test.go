@@ -0,0 +1,124 @@
+package githttp
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func fetchRequest(lines ...string) []byte {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if line == "" {
+			buf.Write(packetFlush())
+			continue
+		}
+		buf.Write(packetWrite(line + "\n"))
+	}
+	return buf.Bytes()
+}
+
+func TestPackCacheKey(t *testing.T) {
+	c, err := NewPackCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := func(dir string, req []byte) string {
+		input, key, err := c.requestKey(dir, 0, bytes.NewReader(req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := io.ReadAll(input); !bytes.Equal(got, req) {
+			t.Fatalf("request altered: %q", got)
+		}
+		return key
+	}
+
+	base := key("a", fetchRequest("want "+someId+" ofs-delta agent=git/2.39.5", "want "+zeroId, "", "done"))
+	if base == "" {
+		t.Fatal("request should be cacheable")
+	}
+
+	tests := []struct {
+		dir  string
+		req  []byte
+		same bool
+	}{
+		{"a", fetchRequest("want "+zeroId+" ofs-delta agent=git/2.45.0", "want "+someId, "", "done"), true},
+		{"b", fetchRequest("want "+someId+" ofs-delta agent=git/2.39.5", "want "+zeroId, "", "done"), false},
+		{"a", fetchRequest("want "+someId+" ofs-delta side-band-64k", "want "+zeroId, "", "done"), false},
+		{"a", fetchRequest("want "+someId+" ofs-delta", "want "+zeroId, "", "have "+someId, "done"), false},
+	}
+	for i, tt := range tests {
+		if got := key(tt.dir, tt.req); (got == base) != tt.same {
+			t.Errorf("%d: got same key %v, want %v", i, got == base, tt.same)
+		}
+	}
+
+	// Negotiation isn't over without "done"
+	if k := key("a", fetchRequest("want "+someId, "", "have "+zeroId, "")); k != "" {
+		t.Errorf("request without done should not be cacheable")
+	}
+}
+
+func TestPackCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "leftover"), []byte("x"), 0644)
+
+	c, err := NewPackCache(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "leftover")); !os.IsNotExist(err) {
+		t.Errorf("leftover files should be removed")
+	}
+
+	put := func(repo, key, data string) {
+		w := c.create(repo, key)
+		w.Write([]byte(data))
+		w.commit()
+	}
+	get := func(key string) string {
+		f, ok := c.open(key)
+		if !ok {
+			return ""
+		}
+		defer f.Close()
+		data, _ := io.ReadAll(f)
+		return string(data)
+	}
+
+	put("a", "k1", "1234")
+	put("a", "k2", "5678")
+	if get("k1") != "1234" {
+		t.Fatalf("k1 should be cached")
+	}
+
+	// k2 is the least recently used
+	put("b", "k3", "abcd")
+	if get("k2") != "" || get("k1") != "1234" || get("k3") != "abcd" {
+		t.Errorf("k2 should have been evicted")
+	}
+
+	// Too large for the cache
+	put("b", "k4", "0123456789a")
+	if get("k4") != "" {
+		t.Errorf("k4 should not be cached")
+	}
+
+	// Responses being written while invalidated aren't kept
+	w := c.create("a", "k5")
+	c.Invalidate("a")
+	w.Write([]byte("x"))
+	w.commit()
+
+	if get("k1") != "" || get("k5") != "" || get("k3") != "abcd" {
+		t.Errorf("repo a should have been invalidated")
+	}
+	if st := c.Stats(); st.Entries != 1 || st.Size != 4 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
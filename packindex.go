@@ -0,0 +1,417 @@
+package githttp
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+// indexedObject is an object of a pack being indexed
+type indexedObject struct {
+	// Raw id, nil for deltas not resolved yet
+	id     []byte
+	offset int64
+	crc    uint32
+
+	typ    objectType
+	baseId []byte
+}
+
+// packReader reads a pack sequentially, keeping track of the offset,
+// the checksum of the pack and the CRC-32 of the current entry
+type packReader struct {
+	r   *bufio.Reader
+	n   int64
+	sum hash.Hash
+	crc hash.Hash32
+}
+
+func (p *packReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	p.sum.Write(b[:n])
+	p.crc.Write(b[:n])
+	return n, err
+}
+
+func (p *packReader) ReadByte() (byte, error) {
+	c, err := p.r.ReadByte()
+	if err == nil {
+		p.n++
+		p.sum.Write([]byte{c})
+		p.crc.Write([]byte{c})
+	}
+	return c, err
+}
+
+// receivePack stores a pack sent by a client in the repo, along with its
+// index, under objects/pack. Thin packs, with deltas against objects of
+// the repo, are completed with those objects.
+func (db *objectDB) receivePack(ctx context.Context, r io.Reader) error {
+	// The pack is spooled to disk, to be checked
+	// and indexed before it's stored
+	tmp, err := os.CreateTemp("", "githttp-pack-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	if _, err := copyPack(tmp, r, db.maxPackSize); err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	pack, objects, trailer, err := db.indexPack(ctx, tmp)
+	if err != nil || len(objects) == 0 {
+		return err
+	}
+
+	objects, trailer, err = db.completeThinPack(tmp, pack, objects, trailer)
+	if err != nil {
+		return err
+	}
+
+	// Packs are named after their checksum, the same
+	// pack being received twice is only kept once
+	dir := db.dirs[0]
+	base := dir.name + "/pack/pack-" + hex.EncodeToString(trailer)
+	if fileExists(db.storage, dir.repo, base+".idx") {
+		return nil
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := db.storage.Write(dir.repo, base+".pack", tmp); err != nil {
+		return err
+	}
+
+	// The index comes last, as it's what makes the pack visible
+	idx := db.packIndex(objects, trailer)
+	if err := db.storage.Write(dir.repo, base+".idx", bytes.NewReader(idx)); err != nil {
+		db.storage.Remove(dir.repo, base+".pack")
+		return err
+	}
+
+	received, err := openPackFile(db.storage, dir.repo, base, db.format)
+	if err != nil {
+		return err
+	}
+	db.packs = append(db.packs, received)
+	return nil
+}
+
+// copyPack copies a pack to f, failing once more
+// than max bytes were copied if max isn't zero
+func copyPack(f *os.File, r io.Reader, max int64) (int64, error) {
+	if max <= 0 {
+		return io.Copy(f, r)
+	}
+	n, err := io.Copy(f, io.LimitReader(r, max+1))
+	if err == nil && n > max {
+		err = errPackTooLarge
+	}
+	return n, err
+}
+
+// indexPack reads the pack in f, checking its objects and resolving its
+// deltas through the objects of the repo. It returns the pack, finding
+// its objects while it's being indexed, along with them and its trailer.
+func (db *objectDB) indexPack(ctx context.Context, f *os.File) (*packFile, []indexedObject, []byte, error) {
+	pack := &packFile{
+		path:     f.Name(),
+		file:     f,
+		hashSize: db.format.HexSize() / 2,
+		indexing: map[string]int64{},
+
+		maxObjectSize: db.maxObjectSize,
+	}
+	objects, trailer, err := db.parsePack(ctx, pack)
+	if err != nil || len(objects) == 0 {
+		return pack, objects, trailer, err
+	}
+
+	// Deltas are resolved through the objects of the repo,
+	// the pack being indexed coming first
+	packs := db.packs
+	db.packs = append([]*packFile{pack}, packs...)
+	err = db.resolveDeltas(ctx, pack, objects)
+	db.packs = packs
+	return pack, objects, trailer, err
+}
+
+// parsePack reads the entries of a pack, noting the ids of those
+// that aren't deltas. It returns them along with the pack's trailer.
+func (db *objectDB) parsePack(ctx context.Context, pack *packFile) ([]indexedObject, []byte, error) {
+	pr := &packReader{
+		r:   bufio.NewReader(pack.file),
+		sum: db.newHash(),
+		crc: crc32.NewIEEE(),
+	}
+
+	var header [12]byte
+	if _, err := io.ReadFull(pr, header[:]); err != nil {
+		return nil, nil, fmt.Errorf("bad pack header")
+	}
+	version := binary.BigEndian.Uint32(header[4:])
+	if string(header[:4]) != "PACK" || version != 2 && version != 3 {
+		return nil, nil, fmt.Errorf("bad pack header")
+	}
+	count := binary.BigEndian.Uint32(header[8:])
+
+	var objects []indexedObject
+	for i := uint32(0); i < count; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		obj := indexedObject{offset: pr.n}
+		pr.crc.Reset()
+
+		typ, size, err := readEntryHeader(pr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("pack truncated at %d", obj.offset)
+		}
+		obj.typ = typ
+
+		switch typ {
+		case objOfsDelta:
+			rel, err := readOffsetDelta(pr)
+			if err != nil || rel <= 0 || rel > obj.offset {
+				return nil, nil, fmt.Errorf("bad delta base offset at %d", obj.offset)
+			}
+		case objRefDelta:
+			obj.baseId = make([]byte, pack.hashSize)
+			if _, err := io.ReadFull(pr, obj.baseId); err != nil {
+				return nil, nil, fmt.Errorf("pack truncated at %d", obj.offset)
+			}
+		case objCommit, objTree, objBlob, objTag:
+		default:
+			return nil, nil, fmt.Errorf("bad object type %d at %d", typ, obj.offset)
+		}
+
+		if db.maxObjectSize > 0 && size > db.maxObjectSize {
+			return nil, nil, fmt.Errorf("bad object at %d: %w", obj.offset, errObjectTooLarge)
+		}
+		data, err := inflate(pr, size)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad object at %d: %v", obj.offset, err)
+		}
+		obj.crc = pr.crc.Sum32()
+
+		if typ != objOfsDelta && typ != objRefDelta {
+			if obj.id, err = db.checkObject(typ, data); err != nil {
+				return nil, nil, err
+			}
+			pack.indexing[string(obj.id)] = obj.offset
+		}
+		objects = append(objects, obj)
+	}
+
+	sum := pr.sum.Sum(nil)
+	trailer := make([]byte, len(sum))
+	if _, err := io.ReadFull(pr.r, trailer); err != nil || !bytes.Equal(trailer, sum) {
+		return nil, nil, fmt.Errorf("pack checksum mismatch")
+	}
+	if _, err := pr.r.ReadByte(); err != io.EOF {
+		return nil, nil, fmt.Errorf("garbage at the end of the pack")
+	}
+	return objects, trailer, nil
+}
+
+// resolveDeltas computes the ids of the deltas of a pack, whose bases
+// may be deltas themselves, coming later in the pack
+func (db *objectDB) resolveDeltas(ctx context.Context, pack *packFile, objects []indexedObject) error {
+	for {
+		progress, pending := false, 0
+		for i := range objects {
+			obj := &objects[i]
+			if obj.id != nil {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if obj.typ == objRefDelta && !db.has(hex.EncodeToString(obj.baseId)) {
+				pending++
+				continue
+			}
+
+			typ, data, err := db.readPacked(pack, obj.offset)
+			if errors.Is(err, errObjectNotFound) {
+				pending++
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if obj.id, err = db.checkObject(typ, data); err != nil {
+				return err
+			}
+			pack.indexing[string(obj.id)] = obj.offset
+			progress = true
+		}
+
+		if pending == 0 {
+			return nil
+		}
+		if !progress {
+			return fmt.Errorf("pack has %d unresolved deltas", pending)
+		}
+	}
+}
+
+// checkObject makes sure an object received is well formed,
+// returning its raw id
+func (db *objectDB) checkObject(typ objectType, data []byte) ([]byte, error) {
+	id := db.hashObject(typ, data)
+
+	var err error
+	switch typ {
+	case objCommit:
+		_, err = parseCommit(data)
+	case objTree:
+		_, err = parseTree(data, db.format.HexSize()/2)
+	case objTag:
+		_, _, err = parseTag(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %s: %v", typ, id, err)
+	}
+
+	raw, _ := hex.DecodeString(id)
+	return raw, nil
+}
+
+// completeThinPack appends the objects of the repo that deltas of the
+// pack spooled to tmp are based on, returning the new list of objects
+// and trailer
+func (db *objectDB) completeThinPack(tmp *os.File, pack *packFile, objects []indexedObject, trailer []byte) ([]indexedObject, []byte, error) {
+	var bases []string
+	seen := map[string]bool{}
+	for _, obj := range objects {
+		if obj.typ != objRefDelta || seen[string(obj.baseId)] {
+			continue
+		}
+		seen[string(obj.baseId)] = true
+		if _, ok := pack.indexing[string(obj.baseId)]; !ok {
+			bases = append(bases, hex.EncodeToString(obj.baseId))
+		}
+	}
+	if len(bases) == 0 {
+		return objects, trailer, nil
+	}
+	sort.Strings(bases)
+
+	// Replace the trailer with the bases
+	end, err := tmp.Seek(-int64(len(trailer)), io.SeekEnd)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := tmp.Truncate(end); err != nil {
+		return nil, nil, err
+	}
+
+	for _, id := range bases {
+		typ, data, err := db.read(id)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var entry bytes.Buffer
+		entry.Write(packEntryHeader(typ, int64(len(data))))
+		zw := zlib.NewWriter(&entry)
+		zw.Write(data)
+		zw.Close()
+
+		if _, err := tmp.Write(entry.Bytes()); err != nil {
+			return nil, nil, err
+		}
+		raw, _ := hex.DecodeString(id)
+		objects = append(objects, indexedObject{
+			id:     raw,
+			offset: end,
+			crc:    crc32.ChecksumIEEE(entry.Bytes()),
+			typ:    typ,
+		})
+		end += int64(entry.Len())
+	}
+
+	var count [4]byte
+	binary.BigEndian.PutUint32(count[:], uint32(len(objects)))
+	if _, err := tmp.WriteAt(count[:], 8); err != nil {
+		return nil, nil, err
+	}
+
+	h := db.newHash()
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.Copy(h, tmp); err != nil {
+		return nil, nil, err
+	}
+	trailer = h.Sum(nil)
+	if _, err := tmp.Write(trailer); err != nil {
+		return nil, nil, err
+	}
+	return objects, trailer, nil
+}
+
+// packIndex returns the version 2 index of a pack
+func (db *objectDB) packIndex(objects []indexedObject, packSum []byte) []byte {
+	sort.Slice(objects, func(i, j int) bool {
+		return bytes.Compare(objects[i].id, objects[j].id) < 0
+	})
+
+	var buf bytes.Buffer
+	buf.Write(packIndexMagic)
+	binary.Write(&buf, binary.BigEndian, uint32(2))
+
+	var fanout [256]uint32
+	for _, obj := range objects {
+		for b := int(obj.id[0]); b < 256; b++ {
+			fanout[b]++
+		}
+	}
+	binary.Write(&buf, binary.BigEndian, fanout)
+
+	for _, obj := range objects {
+		buf.Write(obj.id)
+	}
+	for _, obj := range objects {
+		binary.Write(&buf, binary.BigEndian, obj.crc)
+	}
+
+	// Offsets past 2GB go to a table of 8 byte offsets
+	var large []uint64
+	for _, obj := range objects {
+		offset := uint32(obj.offset)
+		if obj.offset >= 0x80000000 {
+			offset = 0x80000000 | uint32(len(large))
+			large = append(large, uint64(obj.offset))
+		}
+		binary.Write(&buf, binary.BigEndian, offset)
+	}
+	binary.Write(&buf, binary.BigEndian, large)
+
+	buf.Write(packSum)
+	h := db.newHash()
+	h.Write(buf.Bytes())
+	buf.Write(h.Sum(nil))
+	return buf.Bytes()
+}
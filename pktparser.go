@@ -18,6 +18,12 @@ type pktLineParser struct {
 	// Error contains the first error encountered while parsing, or nil otherwise.
 	Error error
 
+	// v2 enables protocol v2 framing, where a delim-pkt "0001" separates
+	// the sections of a request. Delimiters aren't added to Lines,
+	// sections holds the index in Lines at which each one occurred.
+	v2       bool
+	sections []int
+
 	// Internal state machine.
 	state state
 	next  int // next is the number of bytes that need to be written to buf before its contents should be processed by the state machine.
@@ -62,6 +68,9 @@ func (p *pktLineParser) Feed(data []byte) {
 const (
 	// pkt-len = 4*(HEXDIG)
 	pktLenSize = 4
+
+	// delim-pkt = "0001"
+	delimPkt = "0001"
 )
 
 type state uint8
@@ -84,6 +93,13 @@ func (p *pktLineParser) step() error {
 		return nil
 	case readingLen:
 		// len(p.buf) is 4.
+		if p.v2 && string(p.buf) == delimPkt {
+			p.sections = append(p.sections, len(p.Lines))
+			p.next = pktLenSize
+			p.buf = p.buf[:0]
+			return nil
+		}
+
 		pktLen, err := parsePktLen(p.buf)
 		if err != nil {
 			return err
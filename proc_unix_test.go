@@ -0,0 +1,52 @@
+//go:build !windows
+
+package githttp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUploadPackTimeout(t *testing.T) {
+	root := t.TempDir()
+	makeBareRepo(t, filepath.Join(root, "repo.git"), true)
+
+	// A git whose child hangs, holding on to its output
+	bin := filepath.Join(t.TempDir(), "git")
+	os.WriteFile(bin, []byte("#!/bin/sh\nsleep 30\necho done\n"), 0755)
+
+	var events []Event
+	g := New(root)
+	g.GitBinPath = bin
+	g.UploadPackTimeout = 100 * time.Millisecond
+	g.EventHandler = func(ev Event) {
+		events = append(events, ev)
+	}
+
+	req := httptest.NewRequest("POST", "/repo.git/git-upload-pack", bytes.NewReader(fetchRequest("want "+someId, "", "done")))
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	w := httptest.NewRecorder()
+	start := time.Now()
+	g.ServeHTTP(w, req)
+
+	if w.Code != 504 {
+		t.Errorf("got %d %q, want 504", w.Code, w.Body)
+	}
+
+	// The whole process group was killed, not just git
+	if elapsed := time.Since(start); elapsed > killWaitDelay/2 {
+		t.Errorf("took %v", elapsed)
+	}
+
+	var canceled *ErrorCanceled
+	if len(events) != 1 || events[0].Type != FETCH || !errors.As(events[0].Error, &canceled) ||
+		canceled.Rpc != "upload-pack" || !errors.Is(canceled, context.DeadlineExceeded) {
+		t.Errorf("got events %+v", events)
+	}
+}
@@ -0,0 +1,9 @@
+package githttp
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup is a no-op on windows,
+// where only the git process itself is killed
+func setProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,270 @@
+package githttp
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// quarantine gives hooks access to the objects of a push before git
+// receive-pack gets them. On first use, the pack sent by the client is
+// spooled to disk and indexed into a temporary object directory, that
+// git commands see along with the repo's objects. For repos served by
+// a GoBackend, the pack can be indexed in process instead.
+type quarantine struct {
+	g     *GitHttp
+	dir   string
+	input io.Reader
+
+	spoolOnce sync.Once
+	spoolErr  error
+
+	once sync.Once
+	err  error
+
+	dbOnce sync.Once
+	db     *objectDB
+	dbErr  error
+
+	// Temporary directory, holding the spooled
+	// pack and the object directory
+	tmp  string
+	pack *os.File
+	size int64
+}
+
+// spool copies the pack to the temporary directory, once
+func (q *quarantine) spool() error {
+	q.spoolOnce.Do(func() {
+		q.spoolErr = q.spoolPack()
+	})
+	return q.spoolErr
+}
+
+func (q *quarantine) spoolPack() error {
+	tmp, err := os.MkdirTemp("", "githttp-quarantine-")
+	if err != nil {
+		return err
+	}
+	q.tmp = tmp
+
+	if err := os.MkdirAll(filepath.Join(tmp, "objects", "pack"), 0755); err != nil {
+		return err
+	}
+
+	q.pack, err = os.Create(filepath.Join(tmp, "incoming.pack"))
+	if err != nil {
+		return err
+	}
+	if q.size, err = copyPack(q.pack, q.input, q.g.maxPackSize()); err != nil {
+		return err
+	}
+	_, err = q.pack.Seek(0, io.SeekStart)
+	return err
+}
+
+// load spools and indexes the pack, once
+func (q *quarantine) load(ctx context.Context) error {
+	q.once.Do(func() {
+		q.err = q.index(ctx)
+	})
+	return q.err
+}
+
+func (q *quarantine) index(ctx context.Context) error {
+	if err := q.spool(); err != nil {
+		return err
+	}
+
+	// Pushes only deleting refs come without a pack
+	if q.size == 0 {
+		return nil
+	}
+
+	cmd := q.g.newCommand(ctx, q.dir, "index-pack", "--stdin", "--fix-thin")
+	cmd.Env = q.env()
+	cmd.Stdin = q.pack
+	_, err := cmd.Output()
+
+	if _, seekErr := q.pack.Seek(0, io.SeekStart); err == nil {
+		err = seekErr
+	}
+	return err
+}
+
+// objects returns the objects of the repo along with the pushed ones,
+// indexing the pack in process, once
+func (q *quarantine) objects(ctx context.Context, b *GoBackend) (*objectDB, error) {
+	q.dbOnce.Do(func() {
+		q.db, q.dbErr = q.openObjects(ctx, b)
+	})
+	return q.db, q.dbErr
+}
+
+func (q *quarantine) openObjects(ctx context.Context, b *GoBackend) (*objectDB, error) {
+	if err := q.spool(); err != nil {
+		return nil, err
+	}
+	db, err := openObjectDB(b.storage(), q.dir)
+	if err != nil || q.size == 0 {
+		return db, err
+	}
+	db.maxObjectSize = b.maxObjectSize()
+
+	pack, _, _, err := db.indexPack(ctx, q.pack)
+	if _, seekErr := q.pack.Seek(0, io.SeekStart); err == nil {
+		err = seekErr
+	}
+	if err != nil {
+		db.close()
+		return nil, err
+	}
+	db.packs = append([]*packFile{pack}, db.packs...)
+	return db, nil
+}
+
+// isFastForward reports whether the ref update u only adds
+// commits to its ref, the old commit being an ancestor of the new
+func (q *quarantine) isFastForward(ctx context.Context, u RefUpdate) (bool, error) {
+	if b, ok := q.g.backend().(*GoBackend); ok {
+		db, err := q.objects(ctx, b)
+		if err != nil {
+			return false, err
+		}
+		old, oldType, err := db.peel(u.Old)
+		if err != nil {
+			return false, err
+		}
+		new, newType, err := db.peel(u.New)
+		if err != nil {
+			return false, err
+		}
+		if oldType != objCommit || newType != objCommit {
+			return false, nil
+		}
+		return db.isAncestor(ctx, old, new)
+	}
+
+	if err := q.load(ctx); err != nil {
+		return false, err
+	}
+	_, err := q.g.gitCommandEnv(ctx, q.dir, q.env(), "merge-base", "--is-ancestor", u.Old, u.New)
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// env returns the environment for git commands to see the pushed objects
+func (q *quarantine) env() []string {
+	return append(os.Environ(),
+		"GIT_OBJECT_DIRECTORY="+filepath.Join(q.tmp, "objects"),
+		"GIT_ALTERNATE_OBJECT_DIRECTORIES="+filepath.Join(q.dir, "objects"),
+	)
+}
+
+// reader returns the pack to hand over to git receive-pack
+func (q *quarantine) reader() io.Reader {
+	if q.pack != nil {
+		return q.pack
+	}
+	return q.input
+}
+
+// close removes the temporary files
+func (q *quarantine) close() {
+	if q.db != nil {
+		q.db.close()
+	}
+	if q.pack != nil {
+		q.pack.Close()
+	}
+	if q.tmp != "" {
+		os.RemoveAll(q.tmp)
+	}
+}
+
+// ChangedPaths returns the paths of the files added, modified or
+// removed by the commits a ref update brings in. For new refs, these
+// are the commits not yet in the repo. Merge commits are skipped.
+func (h *HookInfo) ChangedPaths(ctx context.Context, u RefUpdate) ([]string, error) {
+	if u.Kind == REF_DELETE || h.quarantine == nil {
+		return nil, nil
+	}
+
+	q := h.quarantine
+	if b, ok := q.g.backend().(*GoBackend); ok {
+		return q.changedPaths(ctx, b, u)
+	}
+	if err := q.load(ctx); err != nil {
+		return nil, err
+	}
+
+	args := []string{"log", "--format=", "--name-only", "--no-renames", "-z", u.New, "--not"}
+	if u.Kind == REF_UPDATE {
+		args = append(args, u.Old)
+	} else {
+		args = append(args, "--glob=refs/*")
+	}
+
+	out, err := q.g.gitCommandEnv(ctx, q.dir, q.env(), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var paths []string
+	for _, path := range strings.Split(string(out), "\x00") {
+		path = strings.TrimLeft(path, "\n")
+		if path != "" && !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// changedPaths lists the paths ChangedPaths returns in process
+func (q *quarantine) changedPaths(ctx context.Context, b *GoBackend, u RefUpdate) ([]string, error) {
+	db, err := q.objects(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+
+	haves := []string{u.Old}
+	if u.Kind != REF_UPDATE {
+		refs, err := listRefs(b.storage(), q.dir)
+		if err != nil {
+			return nil, err
+		}
+		haves = nil
+		for _, r := range refs {
+			haves = append(haves, r.id)
+		}
+	}
+
+	commits, err := db.pushedCommits(ctx, u.New, haves)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var paths []string
+	for _, c := range commits {
+		changes, err := db.commitChanges(ctx, c, false)
+		if err != nil {
+			return nil, err
+		}
+		for _, change := range changes {
+			if !seen[change.Path] {
+				seen[change.Path] = true
+				paths = append(paths, change.Path)
+			}
+		}
+	}
+	return paths, nil
+}
@@ -0,0 +1,275 @@
+package githttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// Capabilities advertised for receive-pack,
+// along with object-format and agent
+var goReceivePackCapabilities = []string{
+	"report-status",
+	"delete-refs",
+	"side-band-64k",
+	"quiet",
+	"atomic",
+	"ofs-delta",
+}
+
+// readCommands reads the ref update commands of a receive-pack
+// request, up to the flush-pkt preceding the pack
+func readCommands(r *bufio.Reader) ([]RefUpdate, []string, error) {
+	var updates []RefUpdate
+	var caps []string
+	for {
+		pkt, err := readPacket(r)
+		if err == io.EOF && len(updates) == 0 {
+			return nil, nil, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if pkt == nil {
+			return updates, caps, nil
+		}
+
+		line := strings.TrimSuffix(string(pkt), "\n")
+		if i := strings.IndexByte(line, 0); i >= 0 {
+			caps = strings.Fields(line[i+1:])
+			line = line[:i]
+		}
+		if strings.HasPrefix(line, "shallow ") {
+			continue
+		}
+
+		u, ok := parseCommand(line)
+		if !ok {
+			return nil, nil, fmt.Errorf("bad command '%s'", line)
+		}
+		updates = append(updates, u)
+	}
+}
+
+func (b *GoBackend) ReceivePack(ctx context.Context, dir string, proto string, in io.Reader, out io.Writer) error {
+	br := bufio.NewReader(in)
+	updates, caps, err := readCommands(br)
+	if err != nil || len(updates) == 0 {
+		return err
+	}
+
+	db, err := openObjectDB(b.storage(), dir)
+	if err != nil {
+		return err
+	}
+	defer db.close()
+	db.maxObjectSize = b.maxObjectSize()
+	db.maxPackSize = b.maxPackSize()
+
+	// Clients only send a pack if a ref is to point to new objects
+	var unpackErr error
+	for _, u := range updates {
+		if u.Kind != REF_DELETE {
+			unpackErr = db.receivePack(ctx, br)
+			break
+		}
+	}
+
+	reasons := make([]string, len(updates))
+	if unpackErr != nil {
+		for i := range reasons {
+			reasons[i] = "unpacker error"
+		}
+	} else {
+		reasons = updateRefs(ctx, dir, db, updates, slices.Contains(caps, "atomic"))
+	}
+
+	if slices.Contains(caps, "report-status") {
+		var status bytes.Buffer
+		if unpackErr != nil {
+			status.Write(packetWrite("unpack " + unpackErr.Error() + "\n"))
+		} else {
+			status.Write(packetWrite("unpack ok\n"))
+		}
+		for i, u := range updates {
+			if reasons[i] == "" {
+				status.Write(packetWrite("ok " + u.Ref + "\n"))
+			} else {
+				status.Write(packetWrite("ng " + u.Ref + " " + reasons[i] + "\n"))
+			}
+		}
+		status.Write(packetFlush())
+
+		if err := writeStatus(out, caps, status.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return unpackErr
+}
+
+// updateRefs applies ref updates, their objects being in the repo.
+// It returns the reason each update failed for, empty for those
+// that succeeded. With atomic, either all updates succeed or none.
+func updateRefs(ctx context.Context, dir string, db *objectDB, updates []RefUpdate, atomic bool) []string {
+	reasons := make([]string, len(updates))
+
+	refs, err := listRefs(db.storage, dir)
+	if err != nil {
+		for i := range reasons {
+			reasons[i] = "failed to read refs"
+		}
+		return reasons
+	}
+	head, _, _ := readHead(db.storage, dir, refs)
+	var tips []string
+	for _, r := range refs {
+		tips = append(tips, r.id)
+	}
+
+	for i, u := range updates {
+		reasons[i] = checkUpdate(ctx, db, u, head, tips)
+	}
+
+	// Lock the refs, making sure they're still where the client saw them
+	locks := make([]*refLock, len(updates))
+	for i, u := range updates {
+		if reasons[i] != "" {
+			continue
+		}
+		lock, err := lockRef(db.storage, dir, u.Ref)
+		if err != nil {
+			reasons[i] = "failed to lock"
+			continue
+		}
+		locks[i] = lock
+
+		current, exists, err := lock.current()
+		switch {
+		case err != nil:
+			reasons[i] = "failed to update ref"
+		case u.Kind == REF_CREATE && exists:
+			reasons[i] = "failed to update ref"
+		case u.Kind != REF_CREATE && (!exists || current != u.Old):
+			reasons[i] = "failed to update ref"
+		}
+	}
+
+	failed := false
+	for _, reason := range reasons {
+		failed = failed || reason != ""
+	}
+	for i, lock := range locks {
+		if lock == nil {
+			continue
+		}
+		if reasons[i] == "" && atomic && failed {
+			reasons[i] = "atomic push failure"
+		}
+		if reasons[i] != "" {
+			lock.release()
+			continue
+		}
+		if err := lock.commit(updates[i].New); err != nil {
+			reasons[i] = "failed to update ref"
+		}
+	}
+
+	return reasons
+}
+
+// checkUpdate vets a ref update before its ref is locked,
+// returning the reason to refuse it for
+func checkUpdate(ctx context.Context, db *objectDB, u RefUpdate, head string, tips []string) string {
+	if !validRefName(u.Ref) {
+		return "funny refname"
+	}
+	if u.Kind == REF_DELETE {
+		if u.Ref == head {
+			return "deletion of the current branch prohibited"
+		}
+		return ""
+	}
+
+	typ, _, err := db.read(u.New)
+	if err != nil {
+		return "missing necessary objects"
+	}
+	if u.IsBranch() && typ != objCommit {
+		return "non-commit object on a branch"
+	}
+
+	// Everything the ref would lead to must be in the repo
+	objects, err := db.missingObjects(ctx, []string{u.New}, tips)
+	if err != nil {
+		return "missing necessary objects"
+	}
+	for _, id := range objects {
+		if !db.has(id) {
+			return "missing necessary objects"
+		}
+	}
+	return ""
+}
+
+// isAncestor reports whether the commit old is an ancestor of new
+func (db *objectDB) isAncestor(ctx context.Context, old string, new string) (bool, error) {
+	seen := map[string]bool{}
+	queue := []string{new}
+	for len(queue) > 0 {
+		id := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if id == old {
+			return true, nil
+		}
+		if seen[id] {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		seen[id] = true
+
+		data, err := db.readType(id, objCommit)
+		if err != nil {
+			return false, err
+		}
+		c, err := parseCommit(data)
+		if err != nil {
+			return false, err
+		}
+		queue = append(queue, c.parents...)
+	}
+	return false, nil
+}
+
+// isForced tells forced updates apart, as GitHttp.isForced
+// does with git, for repos served by a GoBackend
+func (b *GoBackend) isForced(ctx context.Context, dir string, u RefUpdate) (bool, error) {
+	db, err := openObjectDB(b.storage(), dir)
+	if err != nil {
+		return false, err
+	}
+	defer db.close()
+
+	ancestor, err := db.isAncestor(ctx, u.Old, u.New)
+	if err != nil || ancestor {
+		return false, err
+	}
+
+	// The update may have been refused
+	refs, err := listRefs(b.storage(), dir)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range refs {
+		if r.name == u.Ref {
+			return r.id == u.New, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,331 @@
+package githttp
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// pushRequest builds a receive-pack request of commands and a pack
+// of the given objects, read from the repo in src
+func pushRequest(t *testing.T, src string, commands []string, objects []string) []byte {
+	var buf bytes.Buffer
+	for _, c := range commands {
+		buf.Write(packetWrite(c + "\n"))
+	}
+	buf.Write(packetFlush())
+	if objects == nil {
+		return buf.Bytes()
+	}
+
+	db, err := openObjectDB(FileStorage{}, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	if err := db.writePack(context.Background(), &buf, objects); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readRef(t *testing.T, dir string, name string) string {
+	refs, err := listRefs(FileStorage{}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range refs {
+		if r.name == name {
+			return r.id
+		}
+	}
+	return ""
+}
+
+func TestGoBackendReceivePack(t *testing.T) {
+	r := makeTestRepo(t)
+
+	// The new commit is made in another repo, to be pushed
+	src := t.TempDir()
+	makeBareRepo(t, src, true)
+	blobC := writeObject(t, src, objBlob, []byte("c\n"))
+	tree3 := writeObject(t, src, objTree, treeData(treeEntry{"100644", "a.txt", r.blobA}, treeEntry{"100644", "c.txt", blobC}))
+	commit3 := writeObject(t, src, objCommit, commitData(tree3, r.commit2))
+
+	req := pushRequest(t, src, []string{
+		r.commit2 + " " + commit3 + " refs/heads/master\x00report-status atomic",
+		zeroId + " " + commit3 + " refs/heads/feature",
+		r.tag + " " + zeroId + " refs/tags/v1",
+	}, []string{blobC, tree3, commit3})
+
+	var out bytes.Buffer
+	if err := (&GoBackend{}).ReceivePack(context.Background(), r.dir, "", bytes.NewReader(req), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := readPackets(t, out.Bytes())
+	want := []string{"unpack ok\n", "ok refs/heads/master\n", "ok refs/heads/feature\n", "ok refs/tags/v1\n", ""}
+	if strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Fatalf("got %q, want %q", lines, want)
+	}
+
+	if id := readRef(t, r.dir, "refs/heads/master"); id != commit3 {
+		t.Errorf("master is at %s, want %s", id, commit3)
+	}
+	if id := readRef(t, r.dir, "refs/heads/feature"); id != commit3 {
+		t.Errorf("feature is at %s, want %s", id, commit3)
+	}
+	if id := readRef(t, r.dir, "refs/tags/v1"); id != "" {
+		t.Errorf("v1 wasn't deleted, at %s", id)
+	}
+
+	// The pack is kept with its index
+	idx, _ := filepath.Glob(filepath.Join(r.dir, "objects", "pack", "pack-*.idx"))
+	if len(idx) != 1 {
+		t.Fatalf("got indexes %v", idx)
+	}
+	db, err := openObjectDB(FileStorage{}, r.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	for _, id := range []string{blobC, tree3, commit3} {
+		if _, _, err := db.read(id); err != nil {
+			t.Errorf("%s: %v", id, err)
+		}
+	}
+}
+
+func TestGoBackendReceivePackRejected(t *testing.T) {
+	r := makeTestRepo(t)
+
+	tests := []struct {
+		name     string
+		commands []string
+		objects  []string
+		lines    []string
+	}{
+		{
+			"stale old value",
+			[]string{
+				r.commit1 + " " + r.commit1 + " refs/heads/master\x00report-status",
+				zeroId + " " + r.commit1 + " refs/heads/old",
+			},
+			[]string{},
+			[]string{"unpack ok\n", "ng refs/heads/master failed to update ref\n", "ok refs/heads/old\n", ""},
+		},
+		{
+			"atomic",
+			[]string{
+				r.commit1 + " " + r.commit1 + " refs/heads/master\x00report-status atomic",
+				zeroId + " " + r.commit1 + " refs/heads/other",
+			},
+			[]string{},
+			[]string{"unpack ok\n", "ng refs/heads/master failed to update ref\n", "ng refs/heads/other atomic push failure\n", ""},
+		},
+		{
+			"missing objects",
+			[]string{zeroId + " " + strings.Repeat("1", 40) + " refs/heads/missing\x00report-status"},
+			[]string{},
+			[]string{"unpack ok\n", "ng refs/heads/missing missing necessary objects\n", ""},
+		},
+		{
+			"non-commit on a branch",
+			[]string{zeroId + " " + r.tree1 + " refs/heads/tree\x00report-status"},
+			[]string{},
+			[]string{"unpack ok\n", "ng refs/heads/tree non-commit object on a branch\n", ""},
+		},
+		{
+			"funny refname",
+			[]string{zeroId + " " + r.commit1 + " refs/heads/a..b\x00report-status"},
+			[]string{},
+			[]string{"unpack ok\n", "ng refs/heads/a..b funny refname\n", ""},
+		},
+		{
+			"current branch",
+			[]string{r.commit2 + " " + zeroId + " refs/heads/master\x00report-status"},
+			nil,
+			[]string{"unpack ok\n", "ng refs/heads/master deletion of the current branch prohibited\n", ""},
+		},
+	}
+
+	for _, tt := range tests {
+		req := pushRequest(t, r.dir, tt.commands, tt.objects)
+
+		var out bytes.Buffer
+		if err := (&GoBackend{}).ReceivePack(context.Background(), r.dir, "", bytes.NewReader(req), &out); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		lines := readPackets(t, out.Bytes())
+		if strings.Join(lines, "|") != strings.Join(tt.lines, "|") {
+			t.Errorf("%s: got %q, want %q", tt.name, lines, tt.lines)
+		}
+	}
+
+	if id := readRef(t, r.dir, "refs/heads/master"); id != r.commit2 {
+		t.Errorf("master moved to %s", id)
+	}
+	if id := readRef(t, r.dir, "refs/heads/other"); id != "" {
+		t.Errorf("other was created despite the atomic push failing")
+	}
+}
+
+func TestReceiveThinPack(t *testing.T) {
+	r := makeTestRepo(t)
+
+	// A blob as a delta against blobA, which only the repo has
+	base := []byte("a\n")
+	delta := []byte{
+		byte(len(base)), 5, // base and result sizes
+		0x90, 2, // copy 2 bytes from offset 0
+		3, 'x', 'y', '\n', // insert "xy\n"
+	}
+	rawBase, _ := hex.DecodeString(r.blobA)
+
+	var pack bytes.Buffer
+	pack.WriteString("PACK\x00\x00\x00\x02\x00\x00\x00\x01")
+	pack.Write(packEntryHeader(objRefDelta, int64(len(delta))))
+	pack.Write(rawBase)
+	zw := zlib.NewWriter(&pack)
+	zw.Write(delta)
+	zw.Close()
+	sum := sha1.Sum(pack.Bytes())
+	pack.Write(sum[:])
+	pushed := bytes.Clone(pack.Bytes())
+
+	db, err := openObjectDB(FileStorage{}, r.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	if err := db.receivePack(context.Background(), &pack); err != nil {
+		t.Fatal(err)
+	}
+
+	// The pack is completed with its base, blobA being
+	// found in it even without the loose object
+	blob := db.hashObject(objBlob, []byte("a\nxy\n"))
+	os.Remove(looseObjectPath(filepath.Join(r.dir, "objects"), r.blobA))
+
+	db, err = openObjectDB(FileStorage{}, r.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	for _, id := range []string{blob, r.blobA} {
+		if _, _, err := db.read(id); err != nil {
+			t.Errorf("%s: %v", id, err)
+		}
+	}
+
+	// So are objects claiming huge sizes, or larger than allowed
+	for _, tt := range []struct {
+		size int64
+		max  int64
+	}{{1 << 55, 0}, {5, 4}} {
+		var huge bytes.Buffer
+		huge.WriteString("PACK\x00\x00\x00\x02\x00\x00\x00\x01")
+		huge.Write(packEntryHeader(objBlob, tt.size))
+		zw := zlib.NewWriter(&huge)
+		zw.Write([]byte("huge\n"))
+		zw.Close()
+		sum := sha1.Sum(huge.Bytes())
+		huge.Write(sum[:])
+
+		db.maxObjectSize = tt.max
+		if err := db.receivePack(context.Background(), &huge); err == nil {
+			t.Errorf("%d bytes blob with max %d: expected an error", tt.size, tt.max)
+		}
+	}
+	db.maxObjectSize = 0
+
+	// Packs larger than allowed aren't spooled whole
+	db.maxPackSize = 16
+	if err := db.receivePack(context.Background(), bytes.NewReader(pushed)); err != errPackTooLarge {
+		t.Errorf("got %v, want %v", err, errPackTooLarge)
+	}
+	db.maxPackSize = 0
+
+	// Corrupt packs are refused
+	bad := []byte("PACK\x00\x00\x00\x02\x00\x00\x00\x00" + strings.Repeat("\x00", 20))
+	if err := db.receivePack(context.Background(), bytes.NewReader(bad)); err == nil {
+		t.Fatal("expected a checksum error")
+	}
+}
+
+func TestPushForceEvents(t *testing.T) {
+	backends := map[string]Backend{"git": nil, "go": &GoBackend{}}
+
+	for name, backend := range backends {
+		r := makeTestRepo(t)
+
+		// A commit on top of the first, next to the second
+		src := t.TempDir()
+		makeBareRepo(t, src, true)
+		blobC := writeObject(t, src, objBlob, []byte("c\n"))
+		tree3 := writeObject(t, src, objTree, treeData(treeEntry{"100644", "c.txt", blobC}))
+		commit3 := writeObject(t, src, objCommit, commitData(tree3, r.commit1))
+
+		var events []Event
+		g := New(filepath.Dir(r.dir))
+		g.Backend = backend
+		g.EventHandler = func(ev Event) {
+			events = append(events, ev)
+		}
+		push := func(commands []string, objects []string) string {
+			events = nil
+			req := httptest.NewRequest("POST", "/"+filepath.Base(r.dir)+"/git-receive-pack", bytes.NewReader(pushRequest(t, src, commands, objects)))
+			req.Header.Set("Content-Type", "application/x-git-receive-pack-request")
+			w := httptest.NewRecorder()
+			g.ServeHTTP(w, req)
+			return w.Body.String()
+		}
+		types := func() []EventType {
+			var types []EventType
+			for _, ev := range events {
+				types = append(types, ev.Type)
+			}
+			return types
+		}
+
+		// Rewinding master rewrites its history
+		out := push([]string{r.commit2 + " " + r.commit1 + " refs/heads/master\x00report-status"}, []string{})
+		if !strings.Contains(out, "ok refs/heads/master") {
+			t.Fatalf("%s: rewind got %q", name, out)
+		}
+		if len(events) != 1 || events[0].Type != PUSH_FORCE || !events[0].Update.Forced {
+			t.Errorf("%s: rewind fired %v", name, types())
+		}
+
+		// Updates that weren't fast-forwards but were refused, the
+		// old commit being stale, didn't rewrite anything
+		out = push([]string{r.commit2 + " " + commit3 + " refs/heads/master\x00report-status"}, []string{blobC, tree3, commit3})
+		if !strings.Contains(out, "ng refs/heads/master") {
+			t.Fatalf("%s: stale update got %q", name, out)
+		}
+		for _, ev := range events {
+			if ev.Type == PUSH_FORCE || ev.Update != nil && ev.Update.Forced {
+				t.Errorf("%s: refused update fired %v", name, types())
+			}
+		}
+		if id := readRef(t, r.dir, "refs/heads/master"); id != r.commit1 {
+			t.Errorf("%s: master moved to %s", name, id)
+		}
+
+		// Fast-forwards are plain pushes
+		out = push([]string{r.commit1 + " " + commit3 + " refs/heads/master\x00report-status"}, []string{blobC, tree3, commit3})
+		if !strings.Contains(out, "ok refs/heads/master") {
+			t.Fatalf("%s: fast-forward got %q", name, out)
+		}
+		if len(events) != 1 || events[0].Type != PUSH || events[0].Update.Forced {
+			t.Errorf("%s: fast-forward fired %v", name, types())
+		}
+	}
+}
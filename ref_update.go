@@ -0,0 +1,116 @@
+package githttp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RefUpdate is a single ref update command sent by a client pushing
+// to the repository.
+type RefUpdate struct {
+	// Object ids the ref points to before and after the update,
+	// an all zero id stands for a ref that doesn't exist
+	Old string `json:"old"`
+	New string `json:"new"`
+
+	// Full name of the ref (e.g. "refs/heads/master")
+	Ref string `json:"ref"`
+
+	// One of create/update/delete
+	Kind RefUpdateKind `json:"kind"`
+
+	// Forced is set for updates of branches that weren't fast-forwards,
+	// once they have been applied
+	Forced bool `json:"forced,omitempty"`
+}
+
+type RefUpdateKind int
+
+// Possible kinds of ref updates
+const (
+	REF_CREATE RefUpdateKind = iota + 1
+	REF_UPDATE
+	REF_DELETE
+)
+
+func (k RefUpdateKind) String() string {
+	switch k {
+	case REF_CREATE:
+		return "create"
+	case REF_UPDATE:
+		return "update"
+	case REF_DELETE:
+		return "delete"
+	}
+	return "unknown"
+}
+
+func (k RefUpdateKind) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%s"`, k)), nil
+}
+
+func (k *RefUpdateKind) UnmarshalJSON(data []byte) error {
+	switch str := string(data); str {
+	case `"create"`:
+		*k = REF_CREATE
+	case `"update"`:
+		*k = REF_UPDATE
+	case `"delete"`:
+		*k = REF_DELETE
+	default:
+		return fmt.Errorf("%s is not a known ref update kind", str)
+	}
+	return nil
+}
+
+// Namespace returns the component of the ref name following "refs/",
+// e.g. "heads", "tags", "notes" or "pull", along with the rest of the name.
+// Refs outside of "refs/" or without a namespace (e.g. "refs/stash")
+// have an empty namespace.
+func (u RefUpdate) Namespace() (namespace string, name string) {
+	parts := strings.SplitN(u.Ref, "/", 3)
+	if len(parts) < 3 || parts[0] != "refs" {
+		return "", u.Ref
+	}
+	return parts[1], parts[2]
+}
+
+// IsBranch reports whether the ref is a branch under refs/heads/
+func (u RefUpdate) IsBranch() bool {
+	return strings.HasPrefix(u.Ref, "refs/heads/")
+}
+
+// IsTag reports whether the ref is a tag under refs/tags/
+func (u RefUpdate) IsTag() bool {
+	return strings.HasPrefix(u.Ref, "refs/tags/")
+}
+
+// parseCommand parses an "<old-id> <new-id> <ref>" receive-pack command.
+func parseCommand(line string) (RefUpdate, bool) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 || !isObjectId(fields[0]) || !isObjectId(fields[1]) || len(fields[0]) != len(fields[1]) {
+		return RefUpdate{}, false
+	}
+
+	u := RefUpdate{
+		Old:  strings.ToLower(fields[0]),
+		New:  strings.ToLower(fields[1]),
+		Ref:  fields[2],
+		Kind: REF_UPDATE,
+	}
+
+	switch {
+	case isZeroId(u.Old):
+		u.Kind = REF_CREATE
+	case isZeroId(u.New):
+		u.Kind = REF_DELETE
+	}
+
+	return u, true
+}
+
+// isZeroId reports whether id is the all zero object id,
+// which stands for a missing object
+func isZeroId(id string) bool {
+	return strings.Trim(id, "0") == ""
+}
@@ -0,0 +1,220 @@
+package githttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/AaronO/go-git-http/auth"
+)
+
+// refFilter tells which refs of a repo the user
+// making a request may see, as CanReadRef decides
+type refFilter struct {
+	g    *GitHttp
+	r    *http.Request
+	repo string
+	user auth.AuthInfo
+
+	decided map[string]bool
+}
+
+// refFilter returns the filter of the refs of the repo a request is
+// made for, nil if every ref is visible
+func (g *GitHttp) refFilter(hr HandlerReq) *refFilter {
+	if g.CanReadRef == nil {
+		return nil
+	}
+	return &refFilter{
+		g:       g,
+		r:       hr.r,
+		repo:    hr.Repo,
+		user:    g.RequestAuthInfo(hr.r),
+		decided: map[string]bool{},
+	}
+}
+
+// RequestAuthInfo returns who makes a request, as authenticated by the
+// auth package or else named by the TrustedUserHeader. Other requests
+// are anonymous, with an empty Username: basic auth credentials nobody
+// checked can't be trusted.
+func (g *GitHttp) RequestAuthInfo(r *http.Request) auth.AuthInfo {
+	if info, ok := auth.FromContext(r.Context()); ok {
+		return info
+	}
+	if g.TrustedUserHeader != "" {
+		return auth.AuthInfo{Username: r.Header.Get(g.TrustedUserHeader)}
+	}
+	return auth.AuthInfo{}
+}
+
+// visible reports whether the user may see ref
+func (f *refFilter) visible(ref string) (bool, error) {
+	if ok, decided := f.decided[ref]; decided {
+		return ok, nil
+	}
+	ok, err := f.g.CanReadRef(f.r, f.user, f.repo, ref)
+	if err != nil {
+		return false, err
+	}
+	f.decided[ref] = ok
+	return ok, nil
+}
+
+// filterAdvertisement removes the refs the user may not see from a
+// protocol v0 ref advertisement. HEAD goes along with the ref it
+// points to. The capabilities are moved to the first ref left, or
+// to a "capabilities^{}" line if none is.
+func (f *refFilter) filterAdvertisement(adv []byte) ([]byte, error) {
+	var lines []string
+	var caps []string
+	zero := strings.Repeat("0", SHA1.HexSize())
+	head := ""
+	shown := false
+
+	br := bufio.NewReader(bytes.NewReader(adv))
+	for first := true; ; first = false {
+		pkt, err := readPacket(br)
+		if err == io.EOF || err == nil && pkt == nil {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line := strings.TrimSuffix(string(pkt), "\n")
+		if i := strings.IndexByte(line, 0); first && i >= 0 {
+			caps = strings.Fields(line[i+1:])
+			line = line[:i]
+			for _, c := range caps {
+				if target, ok := strings.CutPrefix(c, "symref=HEAD:"); ok {
+					head = target
+				}
+			}
+		}
+		id, name, _ := strings.Cut(line, " ")
+		zero = strings.Repeat("0", len(id))
+
+		switch {
+		case name == "capabilities^{}":
+			continue
+		case strings.HasSuffix(name, "^{}"):
+			// Peeled tags follow their tag
+		case name == "HEAD" && head != "":
+			if shown, err = f.visible(head); err != nil {
+				return nil, err
+			}
+		default:
+			if shown, err = f.visible(name); err != nil {
+				return nil, err
+			}
+		}
+		if shown {
+			lines = append(lines, line)
+		}
+	}
+
+	// Don't tell where HEAD points to if it's hidden
+	if head != "" {
+		if ok, err := f.visible(head); err != nil {
+			return nil, err
+		} else if !ok {
+			for i, c := range caps {
+				if strings.HasPrefix(c, "symref=HEAD:") {
+					caps = append(caps[:i], caps[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+
+	if len(lines) == 0 {
+		lines = append(lines, zero+" capabilities^{}")
+	}
+
+	var buf bytes.Buffer
+	for i, line := range lines {
+		if i == 0 {
+			line += "\x00" + strings.Join(caps, " ")
+		}
+		buf.Write(packetWrite(line + "\n"))
+	}
+	buf.Write(packetFlush())
+	return buf.Bytes(), nil
+}
+
+// visibleTips returns the objects the visible refs of the repo
+// in dir point to, annotated tags being peeled as well
+func (f *refFilter) visibleTips(db *objectDB, dir string) ([]string, error) {
+	refs, err := listRefs(f.g.repoStorage(), dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var tips []string
+	for _, r := range refs {
+		ok, err := f.visible(r.name)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		tips = append(tips, r.id)
+		if peeled, _, err := db.peel(r.id); err == nil && peeled != r.id {
+			tips = append(tips, peeled)
+		}
+	}
+	return tips, nil
+}
+
+// hiddenWant returns the first object wanted by a fetch that the user
+// may not have, being neither the tip of a visible ref nor a commit
+// or tag reachable from one. Wants are those rpcReader picked up.
+func (f *refFilter) hiddenWant(ctx context.Context, dir string, rpcReader *RpcReader) (string, error) {
+	db, err := openObjectDB(f.g.repoStorage(), dir)
+	if err != nil {
+		return "", err
+	}
+	defer db.close()
+
+	tips, err := f.visibleTips(db, dir)
+	if err != nil {
+		return "", err
+	}
+	isTip := map[string]bool{}
+	for _, id := range tips {
+		isTip[id] = true
+	}
+
+	for _, e := range rpcReader.Events {
+		want := strings.ToLower(e.Commit)
+		if e.Type != FETCH || isTip[want] {
+			continue
+		}
+
+		// Wants already reachable from the tips leave nothing to send
+		missing, err := db.missingObjects(ctx, []string{want}, tips)
+		if err != nil || len(missing) > 0 {
+			return want, nil
+		}
+	}
+	return "", nil
+}
+
+// rejectHidden rejects the updates of a push to refs the user may not see
+func (f *refFilter) rejectHidden(updates []RefUpdate, rejected map[string]string) error {
+	for _, u := range updates {
+		ok, err := f.visible(u.Ref)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			rejected[u.Ref] = "deny updating a hidden ref"
+		}
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package githttp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AaronO/go-git-http/auth"
+)
+
+// hideSecurityRefs hides refs/heads/security/* from everyone but admin
+func hideSecurityRefs(r *http.Request, user auth.AuthInfo, repo string, ref string) (bool, error) {
+	return user.Username == "admin" || !strings.HasPrefix(ref, "refs/heads/security/"), nil
+}
+
+func TestFilterAdvertisement(t *testing.T) {
+	id := strings.Repeat("1", 40)
+	tag := strings.Repeat("2", 40)
+	adv := fetchRequest(
+		id+" HEAD\x00multi_ack symref=HEAD:refs/heads/security/fix agent=git/2",
+		id+" refs/heads/security/fix",
+		id+" refs/heads/master",
+		tag+" refs/tags/v1",
+		id+" refs/tags/v1^{}",
+		"",
+	)
+
+	tests := []struct {
+		user  string
+		lines []string
+	}{
+		{
+			"admin",
+			[]string{
+				id + " HEAD\x00multi_ack symref=HEAD:refs/heads/security/fix agent=git/2\n",
+				id + " refs/heads/security/fix\n",
+				id + " refs/heads/master\n",
+				tag + " refs/tags/v1\n",
+				id + " refs/tags/v1^{}\n",
+				"",
+			},
+		},
+		{
+			"",
+			[]string{
+				id + " refs/heads/master\x00multi_ack agent=git/2\n",
+				tag + " refs/tags/v1\n",
+				id + " refs/tags/v1^{}\n",
+				"",
+			},
+		},
+	}
+
+	g := &GitHttp{CanReadRef: hideSecurityRefs}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/repo.git/info/refs", nil)
+		r = r.WithContext(auth.NewContext(r.Context(), auth.AuthInfo{Username: tt.user}))
+		f := g.refFilter(HandlerReq{r: r, Repo: "/repo.git"})
+
+		got, err := f.filterAdvertisement(adv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := readPackets(t, got); strings.Join(lines, "|") != strings.Join(tt.lines, "|") {
+			t.Errorf("%q: got %q, want %q", tt.user, lines, tt.lines)
+		}
+	}
+
+	// Capabilities are still sent without any visible ref
+	g.CanReadRef = func(*http.Request, auth.AuthInfo, string, string) (bool, error) { return false, nil }
+	f := g.refFilter(HandlerReq{r: httptest.NewRequest("GET", "/", nil)})
+	got, err := f.filterAdvertisement(adv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{zeroId + " capabilities^{}\x00multi_ack agent=git/2\n", ""}
+	if lines := readPackets(t, got); strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("got %q, want %q", lines, want)
+	}
+}
+
+func TestHiddenRefs(t *testing.T) {
+	repo := makeTestRepo(t)
+	fix := writeObject(t, repo.dir, objCommit, commitData(repo.tree2, repo.commit2))
+	os.MkdirAll(filepath.Join(repo.dir, "refs", "heads", "security"), 0755)
+	os.WriteFile(filepath.Join(repo.dir, "refs", "heads", "security", "fix"), []byte(fix+"\n"), 0644)
+
+	root := filepath.Dir(repo.dir)
+	g := &GitHttp{
+		ProjectRoot: root,
+		Backend:     &GoBackend{},
+		UploadPack:  true,
+		ReceivePack: true,
+		CanReadRef:  hideSecurityRefs,
+	}
+	path := "/" + filepath.Base(repo.dir)
+
+	serve := func(user string, method string, url string, body []byte) string {
+		r := httptest.NewRequest(method, path+url, bytes.NewReader(body))
+		if method == "POST" {
+			rpc := strings.TrimPrefix(url, "/git-")
+			r.Header.Set("Content-Type", "application/x-git-"+rpc+"-request")
+		}
+		if user != "" {
+			r = r.WithContext(auth.NewContext(r.Context(), auth.AuthInfo{Username: user}))
+		}
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	for _, service := range []string{"upload-pack", "receive-pack"} {
+		adv := serve("", "GET", "/info/refs?service=git-"+service, nil)
+		if strings.Contains(adv, "security") || !strings.Contains(adv, " refs/heads/master") {
+			t.Errorf("%s: advertised %q", service, adv)
+		}
+	}
+	if adv := serve("admin", "GET", "/info/refs?service=git-upload-pack", nil); !strings.Contains(adv, fix+" refs/heads/security/fix") {
+		t.Errorf("admin was advertised %q", adv)
+	}
+
+	// Basic auth usernames nobody checked aren't trusted
+	r := httptest.NewRequest("GET", path+"/info/refs?service=git-upload-pack", nil)
+	r.SetBasicAuth("admin", "x")
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	if strings.Contains(w.Body.String(), "security") {
+		t.Errorf("unauthenticated admin was advertised %q", w.Body)
+	}
+
+	// The hidden branch can't be fetched nor pushed to
+	fetch := fetchRequest("want "+fix, "", "done")
+	if out := serve("", "POST", "/git-upload-pack", fetch); out != string(packetWrite("ERR upload-pack: not our ref "+fix+"\n")) {
+		t.Errorf("got %q", out)
+	}
+	if out := serve("admin", "POST", "/git-upload-pack", fetch); !strings.HasPrefix(out, string(packetWrite("NAK\n"))) {
+		t.Errorf("admin got %q", out)
+	}
+	if out := serve("", "POST", "/git-upload-pack", fetchRequest("want "+repo.commit2, "", "done")); !strings.HasPrefix(out, string(packetWrite("NAK\n"))) {
+		t.Errorf("got %q", out)
+	}
+
+	push := fetchRequest(fix+" "+repo.commit2+" refs/heads/security/fix\x00report-status", "")
+	if out := serve("", "POST", "/git-receive-pack", push); !strings.Contains(out, "ng refs/heads/security/fix deny updating a hidden ref\n") {
+		t.Errorf("got %q", out)
+	}
+
+	// Nor with requests ending their wants or commands with a delim-pkt,
+	// that the backends don't read the way the filter would
+	pack := pushRequest(t, repo.dir, nil, []string{})[len(packetFlush()):]
+	malformed := map[string][]byte{
+		"/git-upload-pack":  []byte(string(packetWrite("want "+fix+"\n")) + "0001" + string(packetWrite("done\n"))),
+		"/git-receive-pack": []byte(string(packetWrite(fix+" "+repo.commit2+" refs/heads/security/fix\x00report-status\n")) + "0001" + string(pack)),
+	}
+	for name, backend := range map[string]Backend{"go": &GoBackend{}, "git": nil} {
+		g.Backend = backend
+		g.GitBinPath = "/usr/bin/git"
+		for url, body := range malformed {
+			if out := serve("", "POST", url, body); out != "Bad Request" {
+				t.Errorf("%s %s: got %q", name, url, out)
+			}
+		}
+	}
+	if id := readRef(t, repo.dir, "refs/heads/security/fix"); id != fix {
+		t.Errorf("security/fix moved to %s", id)
+	}
+}
+
+func TestHiddenRefsBackendStorage(t *testing.T) {
+	src := makeTestRepo(t)
+
+	// The repo is only in the storage of the backend
+	s := NewMemoryStorage()
+	if err := initRepo(s, "/repo.git", "master"); err != nil {
+		t.Fatal(err)
+	}
+	objects := []string{src.blobA, src.blobB, src.tree1, src.tree2, src.commit1, src.commit2}
+	push := pushRequest(t, src.dir, []string{zeroId + " " + src.commit2 + " refs/heads/master\x00report-status"}, objects)
+	if err := (&GoBackend{Storage: s}).ReceivePack(context.Background(), "/repo.git", "", bytes.NewReader(push), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	g := &GitHttp{
+		Resolver: ResolverFunc(func(ctx context.Context, r *http.Request, urlRepo string) (string, error) {
+			return "/repo.git", nil
+		}),
+		Backend:    &GoBackend{Storage: s},
+		UploadPack: true,
+		CanReadRef: hideSecurityRefs,
+	}
+
+	// Visible refs are found in the storage of the backend
+	r := httptest.NewRequest("POST", "/repo.git/git-upload-pack", bytes.NewReader(fetchRequest("want "+src.commit2, "", "done")))
+	r.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	if !strings.HasPrefix(w.Body.String(), string(packetWrite("NAK\n"))) {
+		t.Errorf("got %d %q", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,169 @@
+package githttp
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/AaronO/go-git-http/auth"
+)
+
+// RefOp is an operation a push makes on a ref. RefRules allow sets
+// of them, e.g. REF_OP_CREATE|REF_OP_FAST_FORWARD.
+type RefOp int
+
+const (
+	REF_OP_CREATE RefOp = 1 << iota
+	REF_OP_FAST_FORWARD
+	// Updates that aren't fast-forwards, allowing fast-forwards too
+	REF_OP_FORCE
+	REF_OP_DELETE
+)
+
+func (op RefOp) String() string {
+	switch op {
+	case REF_OP_CREATE:
+		return "create"
+	case REF_OP_FAST_FORWARD:
+		return "fast-forward"
+	case REF_OP_FORCE:
+		return "force"
+	case REF_OP_DELETE:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// RefRule allows users and groups some operations on the refs it matches.
+type RefRule struct {
+	// Glob pattern of ref names, matched as with path.Match, except for
+	// a last "**" element matching any number of elements, e.g.
+	// "refs/heads/main" or "refs/heads/release/**"
+	Pattern string
+
+	// Glob pattern of the repo component of URLs the rule is
+	// restricted to, e.g. "org/*.git", any repo if empty
+	Repo string
+
+	// Users and groups the rule applies to, everyone if both are empty
+	Users  []string
+	Groups []string
+
+	// Operations allowed
+	Allow RefOp
+}
+
+// RefRules protect refs from pushes. Refs no rule matches may be updated
+// freely. Those some rules match may only be updated by the users
+// these rules apply to, and only with the operations they allow.
+type RefRules struct {
+	Rules []RefRule
+
+	// Groups, if set, returns the groups user belongs to, user being
+	// what auth.Authenticator let through, with an empty Username
+	// for anonymous requests
+	Groups func(r *http.Request, user auth.AuthInfo) ([]string, error)
+}
+
+// matchPattern reports whether name matches the glob pattern of a RefRule
+func matchPattern(pattern string, name string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "/**"); ok {
+		elems := strings.Split(name, "/")
+		n := strings.Count(prefix, "/") + 1
+		if len(elems) <= n {
+			return false
+		}
+		name = strings.Join(elems[:n], "/")
+		pattern = prefix
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// appliesTo reports whether the rule applies to a user in groups
+func (rule *RefRule) appliesTo(user string, groups []string) bool {
+	if len(rule.Users) == 0 && len(rule.Groups) == 0 {
+		return true
+	}
+	if user != "" && slices.Contains(rule.Users, user) {
+		return true
+	}
+	for _, group := range groups {
+		if slices.Contains(rule.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed returns the operations the user in groups may make on ref,
+// and whether any rule matches it
+func (rr *RefRules) allowed(repo string, ref string, user string, groups []string) (RefOp, bool) {
+	var ops RefOp
+	protected := false
+	for i := range rr.Rules {
+		rule := &rr.Rules[i]
+		if rule.Repo != "" && !matchPattern(rule.Repo, strings.Trim(repo, "/")) {
+			continue
+		}
+		if !matchPattern(rule.Pattern, ref) {
+			continue
+		}
+		protected = true
+		if rule.appliesTo(user, groups) {
+			ops |= rule.Allow
+		}
+	}
+	return ops, protected
+}
+
+// rejectDisallowed rejects the updates of a push the rules don't allow
+// user to make. Telling fast-forwards from forced updates requires the
+// pushed objects, read through q.
+func (rr *RefRules) rejectDisallowed(ctx context.Context, hr HandlerReq, user auth.AuthInfo, q *quarantine, updates []RefUpdate, rejected map[string]string) error {
+	var groups []string
+	if rr.Groups != nil {
+		var err error
+		if groups, err = rr.Groups(hr.r, user); err != nil {
+			return err
+		}
+	}
+
+	for _, u := range updates {
+		if rejected[u.Ref] != "" {
+			continue
+		}
+		ops, protected := rr.allowed(hr.Repo, u.Ref, user.Username, groups)
+		if !protected {
+			continue
+		}
+
+		var op RefOp
+		switch u.Kind {
+		case REF_CREATE:
+			op = REF_OP_CREATE
+		case REF_DELETE:
+			op = REF_OP_DELETE
+		default:
+			op = REF_OP_FORCE
+			if ops&REF_OP_FORCE != 0 {
+				break
+			}
+			ff, err := q.isFastForward(ctx, u)
+			if err != nil {
+				rejected[u.Ref] = "failed to check update"
+				continue
+			}
+			if ff {
+				op = REF_OP_FAST_FORWARD
+			}
+		}
+
+		if ops&op == 0 {
+			rejected[u.Ref] = "protected ref, " + op.String() + " not allowed"
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package githttp
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AaronO/go-git-http/auth"
+)
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"refs/heads/master", "refs/heads/master", true},
+		{"refs/heads/*", "refs/heads/master", true},
+		{"refs/heads/*", "refs/heads/release/1.0", false},
+		{"refs/heads/release/**", "refs/heads/release/1.0", true},
+		{"refs/heads/release/**", "refs/heads/release/1.0/fix", true},
+		{"refs/heads/release/**", "refs/heads/release", false},
+		{"refs/*/v*/**", "refs/tags/v1/rc", true},
+		{"refs/tags/**", "refs/heads/v1", false},
+	}
+
+	for _, tt := range tests {
+		if match := matchPattern(tt.pattern, tt.name); match != tt.match {
+			t.Errorf("%q, %q: got %v", tt.pattern, tt.name, match)
+		}
+	}
+}
+
+func TestRefRules(t *testing.T) {
+	r := makeTestRepo(t)
+
+	src := t.TempDir()
+	makeBareRepo(t, src, true)
+	blobC := writeObject(t, src, objBlob, []byte("c\n"))
+	tree3 := writeObject(t, src, objTree, treeData(treeEntry{"100644", "a.txt", r.blobA}, treeEntry{"100644", "c.txt", blobC}))
+	commit3 := writeObject(t, src, objCommit, commitData(tree3, r.commit2))
+	objects := []string{blobC, tree3, commit3}
+
+	g := &GitHttp{
+		ProjectRoot: filepath.Dir(r.dir),
+		Backend:     &GoBackend{},
+		ReceivePack: true,
+		RefRules: &RefRules{
+			Rules: []RefRule{
+				{Pattern: "refs/heads/master", Allow: REF_OP_FAST_FORWARD},
+				{Pattern: "refs/heads/master", Groups: []string{"admins"}, Allow: REF_OP_FORCE},
+				{Pattern: "refs/tags/**", Users: []string{"release"}, Allow: REF_OP_CREATE | REF_OP_DELETE},
+			},
+			Groups: func(r *http.Request, user auth.AuthInfo) ([]string, error) {
+				if user.Username == "admin" {
+					return []string{"admins"}, nil
+				}
+				return nil, nil
+			},
+		},
+	}
+
+	serve := func(commands []string, objects []string, prepare func(*http.Request) *http.Request) string {
+		req := httptest.NewRequest("POST", "/"+filepath.Base(r.dir)+"/git-receive-pack", bytes.NewReader(pushRequest(t, src, commands, objects)))
+		req.Header.Set("Content-Type", "application/x-git-receive-pack-request")
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, prepare(req))
+		return w.Body.String()
+	}
+	push := func(user string, commands []string, objects []string) string {
+		return serve(commands, objects, func(req *http.Request) *http.Request {
+			return req.WithContext(auth.NewContext(req.Context(), auth.AuthInfo{Username: user}))
+		})
+	}
+
+	// Only admins may force push master, and only the
+	// release user may delete tags, but other refs go through
+	out := push("dev", []string{
+		r.commit2 + " " + r.commit1 + " refs/heads/master\x00report-status",
+		r.tag + " " + zeroId + " refs/tags/v1",
+		zeroId + " " + r.commit1 + " refs/heads/feature",
+	}, []string{})
+	for _, line := range []string{
+		"ng refs/heads/master protected ref, force not allowed\n",
+		"ng refs/tags/v1 protected ref, delete not allowed\n",
+		"ok refs/heads/feature\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("got %q, want %q", out, line)
+		}
+	}
+	if id := readRef(t, r.dir, "refs/heads/master"); id != r.commit2 {
+		t.Errorf("master moved to %s", id)
+	}
+
+	// Unless the push is atomic
+	out = push("dev", []string{
+		r.commit2 + " " + r.commit1 + " refs/heads/master\x00report-status atomic",
+		zeroId + " " + r.commit1 + " refs/heads/other",
+	}, []string{})
+	if !strings.Contains(out, "ng refs/heads/other atomic push failure\n") {
+		t.Errorf("got %q", out)
+	}
+
+	// Fast-forwards are told apart with the pushed objects
+	out = push("dev", []string{r.commit2 + " " + commit3 + " refs/heads/master\x00report-status"}, objects)
+	if !strings.Contains(out, "ok refs/heads/master\n") {
+		t.Errorf("got %q", out)
+	}
+
+	// Usernames only count once authenticated, unless a proxy is trusted
+	force := []string{commit3 + " " + r.commit1 + " refs/heads/master\x00report-status"}
+	out = serve(force, []string{}, func(req *http.Request) *http.Request {
+		req.SetBasicAuth("admin", "x")
+		req.Header.Set("X-Remote-User", "admin")
+		return req
+	})
+	if !strings.Contains(out, "ng refs/heads/master protected ref, force not allowed\n") {
+		t.Errorf("unauthenticated admin got %q", out)
+	}
+	g.TrustedUserHeader = "X-Remote-User"
+	out = serve(force, []string{}, func(req *http.Request) *http.Request {
+		req.Header.Set("X-Remote-User", "admin")
+		return req
+	})
+	if !strings.Contains(out, "ok refs/heads/master\n") {
+		t.Errorf("admin got %q", out)
+	}
+	out = push("release", []string{r.tag + " " + zeroId + " refs/tags/v1\x00report-status"}, nil)
+	if !strings.Contains(out, "ok refs/tags/v1\n") {
+		t.Errorf("release got %q", out)
+	}
+
+	// Command lists the rules can't be checked against are refused,
+	// rather than relayed to the backend unchecked
+	pack := pushRequest(t, src, nil, []string{})[len(packetFlush()):]
+	body := string(packetWrite(zeroId+" "+r.commit1+" refs/tags/v2\x00report-status\n")) + "0001" + string(pack)
+	req := httptest.NewRequest("POST", "/"+filepath.Base(r.dir)+"/git-receive-pack", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-git-receive-pack-request")
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, req.WithContext(auth.NewContext(req.Context(), auth.AuthInfo{Username: "dev"})))
+	if w.Code != 400 {
+		t.Errorf("malformed push got %d %q", w.Code, w.Body)
+	}
+	if id := readRef(t, r.dir, "refs/tags/v2"); id != "" {
+		t.Errorf("v2 was created at %s", id)
+	}
+}
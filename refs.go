@@ -0,0 +1,240 @@
+package githttp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+)
+
+// ref is a ref of a repository and the object it points to
+type ref struct {
+	name string
+	id   string
+}
+
+// listRefs returns the refs of the repo in dir, sorted by name,
+// symbolic refs being resolved. Loose refs take precedence
+// over packed ones.
+func listRefs(s Storage, dir string) ([]ref, error) {
+	values, err := readPackedRefs(s, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := s.List(dir, "refs")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if strings.HasSuffix(name, ".lock") {
+			continue
+		}
+		data, err := readFile(s, dir, name)
+		if err != nil {
+			// Deleted under our feet
+			continue
+		}
+		values[name] = strings.TrimSpace(string(data))
+	}
+
+	var refs []ref
+	for name := range values {
+		if id, ok := resolveRef(values, name); ok {
+			refs = append(refs, ref{name, id})
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].name < refs[j].name
+	})
+	return refs, nil
+}
+
+// readPackedRefs returns the refs of the packed-refs file
+func readPackedRefs(s Storage, dir string) (map[string]string, error) {
+	values := map[string]string{}
+
+	f, err := s.Open(dir, "packed-refs")
+	if errors.Is(err, fs.ErrNotExist) {
+		return values, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// Skip the header and peeled tags
+		if strings.HasPrefix(line, "#") || strings.HasPrefix(line, "^") {
+			continue
+		}
+		id, name, ok := strings.Cut(line, " ")
+		if ok && isObjectId(id) {
+			values[name] = id
+		}
+	}
+	return values, scanner.Err()
+}
+
+// resolveRef follows symbolic refs ("ref: <name>") to an object id
+func resolveRef(values map[string]string, name string) (string, bool) {
+	for depth := 0; depth < 5; depth++ {
+		value, ok := values[name]
+		if !ok {
+			return "", false
+		}
+		if target, ok := strings.CutPrefix(value, "ref: "); ok {
+			name = target
+			continue
+		}
+		return value, isObjectId(value)
+	}
+	return "", false
+}
+
+// readHead returns the ref HEAD points to, if it's symbolic,
+// and the id of its commit
+func readHead(s Storage, dir string, refs []ref) (string, string, bool) {
+	data, err := readFile(s, dir, "HEAD")
+	if err != nil {
+		return "", "", false
+	}
+
+	value := strings.TrimSpace(string(data))
+	target, ok := strings.CutPrefix(value, "ref: ")
+	if !ok {
+		return "", value, isObjectId(value)
+	}
+	for _, r := range refs {
+		if r.name == target {
+			return target, r.id, true
+		}
+	}
+	// Unborn branch
+	return target, "", false
+}
+
+// validRefName reports whether name is a ref that may be pushed to,
+// following the rules of "git check-ref-format"
+func validRefName(name string) bool {
+	if !strings.HasPrefix(name, "refs/") || strings.HasSuffix(name, "/") ||
+		strings.HasSuffix(name, ".") || strings.Contains(name, "..") ||
+		strings.Contains(name, "@{") || strings.Contains(name, "//") {
+		return false
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f || strings.ContainsRune(" ~^:?*[\\", c) {
+			return false
+		}
+	}
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") || strings.HasSuffix(part, ".lock") {
+			return false
+		}
+	}
+	return true
+}
+
+// refLock is the lock of a ref being updated,
+// held until the ref is updated or released
+type refLock struct {
+	storage Storage
+	dir     string
+	name    string
+	unlock  func()
+}
+
+// lockRef locks a ref, failing if it's already locked
+func lockRef(s Storage, dir string, name string) (*refLock, error) {
+	unlock, err := s.Lock(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	return &refLock{s, dir, name, unlock}, nil
+}
+
+// current returns the id the locked ref points to, if it exists
+func (l *refLock) current() (string, bool, error) {
+	data, err := readFile(l.storage, l.dir, l.name)
+	if err == nil {
+		id := strings.TrimSpace(string(data))
+		if !isObjectId(id) {
+			return "", false, fmt.Errorf("%s isn't a plain ref", l.name)
+		}
+		return id, true, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", false, err
+	}
+
+	packed, err := readPackedRefs(l.storage, l.dir)
+	if err != nil {
+		return "", false, err
+	}
+	id, ok := packed[l.name]
+	return id, ok, nil
+}
+
+// commit points the ref to id, or deletes it if id is the zero id
+func (l *refLock) commit(id string) error {
+	defer l.release()
+
+	if isZeroId(id) {
+		if err := removePackedRef(l.storage, l.dir, l.name); err != nil {
+			return err
+		}
+		return l.storage.Remove(l.dir, l.name)
+	}
+	return l.storage.Write(l.dir, l.name, strings.NewReader(id+"\n"))
+}
+
+// release gives up the lock, leaving the ref as it is
+func (l *refLock) release() {
+	l.unlock()
+}
+
+// removePackedRef removes a ref from the packed-refs file, if it's there
+func removePackedRef(s Storage, dir string, name string) error {
+	data, err := readFile(s, dir, "packed-refs")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(string(data), " "+name+"\n") {
+		return nil
+	}
+
+	unlock, err := s.Lock(dir, "packed-refs")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Read again, now that nobody else may write it
+	data, err = readFile(s, dir, "packed-refs")
+	if err != nil {
+		return err
+	}
+
+	var kept []string
+	skipPeeled := false
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if skipPeeled && strings.HasPrefix(line, "^") {
+			continue
+		}
+		_, ref, _ := strings.Cut(strings.TrimSuffix(line, "\n"), " ")
+		skipPeeled = ref == name && !strings.HasPrefix(line, "#")
+		if !skipPeeled {
+			kept = append(kept, line)
+		}
+	}
+
+	return s.Write(dir, "packed-refs", strings.NewReader(strings.Join(kept, "")))
+}
@@ -0,0 +1,164 @@
+package githttp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Side-band channels of receive-pack and upload-pack responses
+const (
+	sidebandData     = 1
+	sidebandProgress = 2
+	sidebandError    = 3
+)
+
+// sidebandLimit returns the maximal amount of data per side-band packet
+// negotiated through the client's capabilities, or 0 if side-band is off
+func sidebandLimit(caps []string) int {
+	limit := 0
+	for _, c := range caps {
+		switch c {
+		case "side-band-64k":
+			return 65520 - pktLenSize - 1
+		case "side-band":
+			limit = 1000 - pktLenSize - 1
+		}
+	}
+	return limit
+}
+
+func wantsReportStatus(caps []string) bool {
+	for _, c := range caps {
+		if c == "report-status" || c == "report-status-v2" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeSideband writes data to w as side-band packets on the given channel
+func writeSideband(w io.Writer, channel byte, data []byte, limit int) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > limit {
+			n = limit
+		}
+		if _, err := w.Write(packetWrite(string(channel) + string(data[:n]))); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// writeReportStatus writes a receive-pack report-status response,
+// as git would, for a push none of which was handed over to git
+func writeReportStatus(w io.Writer, caps []string, lines []string) error {
+	if !wantsReportStatus(caps) {
+		return nil
+	}
+
+	var status bytes.Buffer
+	status.Write(packetWrite("unpack ok\n"))
+	for _, line := range lines {
+		status.Write(packetWrite(line))
+	}
+	status.Write(packetFlush())
+
+	return writeStatus(w, caps, status.Bytes())
+}
+
+func writeStatus(w io.Writer, caps []string, status []byte) error {
+	limit := sidebandLimit(caps)
+	if limit == 0 {
+		_, err := w.Write(status)
+		return err
+	}
+
+	if err := writeSideband(w, sidebandData, status, limit); err != nil {
+		return err
+	}
+	_, err := w.Write(packetFlush())
+	return err
+}
+
+// relayReportStatus copies the output of git receive-pack from r to w,
+// adding extra lines to its report-status. Progress and error messages
+// are relayed immediately, the status itself once it's complete.
+func relayReportStatus(w io.Writer, r io.Reader, caps []string, extra []string) error {
+	if !wantsReportStatus(caps) {
+		_, err := io.Copy(w, r)
+		return err
+	}
+
+	br := bufio.NewReader(r)
+	status := br
+
+	// With side-band, the report-status is carried
+	// as pkt-lines inside the data channel
+	if sidebandLimit(caps) > 0 {
+		var data bytes.Buffer
+		for {
+			pkt, err := readPacket(br)
+			if err != nil {
+				return err
+			}
+			if pkt == nil {
+				break
+			}
+			if len(pkt) == 0 {
+				continue
+			}
+			if pkt[0] == sidebandData {
+				data.Write(pkt[1:])
+				continue
+			}
+			if _, err := w.Write(packetWrite(string(pkt))); err != nil {
+				return err
+			}
+		}
+		status = bufio.NewReader(&data)
+	}
+
+	var out bytes.Buffer
+	for {
+		pkt, err := readPacket(status)
+		if err != nil {
+			return err
+		}
+		if pkt == nil {
+			break
+		}
+		out.Write(packetWrite(string(pkt)))
+	}
+	for _, line := range extra {
+		out.Write(packetWrite(line))
+	}
+	out.Write(packetFlush())
+
+	return writeStatus(w, caps, out.Bytes())
+}
+
+// readPacket reads a single pkt-line, it returns nil for a flush-pkt
+func readPacket(r *bufio.Reader) ([]byte, error) {
+	var lenBuf [pktLenSize]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+
+	pktLen, err := parsePktLen(lenBuf[:])
+	if err != nil {
+		return nil, err
+	}
+	if pktLen == 0 {
+		return nil, nil
+	}
+
+	pkt := make([]byte, pktLen-pktLenSize)
+	if _, err := io.ReadFull(r, pkt); err != nil {
+		return nil, fmt.Errorf("short pkt-line: %v", err)
+	}
+	return pkt, nil
+}
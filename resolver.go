@@ -0,0 +1,206 @@
+package githttp
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// RepoResolver maps the repo component of a request's URL
+// (e.g. "org/project.git") to the directory of the repository.
+// Resolve should return an *ErrorRepoNotFound for unknown
+// repositories and an *ErrorNoAccess for forbidden ones.
+type RepoResolver interface {
+	Resolve(ctx context.Context, r *http.Request, urlRepo string) (dir string, err error)
+}
+
+// ResolverFunc allows using an ordinary function as a RepoResolver
+type ResolverFunc func(ctx context.Context, r *http.Request, urlRepo string) (string, error)
+
+func (f ResolverFunc) Resolve(ctx context.Context, r *http.Request, urlRepo string) (string, error) {
+	return f(ctx, r, urlRepo)
+}
+
+// RootResolver serves repositories from the directory under Root
+// at the same path as in the URL. It's used when GitHttp has no Resolver.
+type RootResolver struct {
+	// Root directory to serve repos from,
+	// the working directory if empty
+	Root string
+
+	// Strict rejects repo paths with ".." segments and repos
+	// that end up outside of Root once symlinks are resolved
+	Strict bool
+
+	// Storage, if set, holds the repos instead of the local disk,
+	// their dirs being the paths under Root (e.g. "/org/project.git")
+	Storage Storage
+}
+
+func (res RootResolver) Resolve(ctx context.Context, r *http.Request, urlRepo string) (string, error) {
+	if res.Storage != nil && !onDisk(res.Storage) {
+		return res.resolveStored(urlRepo)
+	}
+
+	root := res.Root
+
+	if root == "" {
+		cwd, err := os.Getwd()
+
+		if err != nil {
+			return "", err
+		}
+
+		root = cwd
+	}
+
+	if res.Strict {
+		return strictJoin(root, urlRepo)
+	}
+
+	f := path.Join(root, urlRepo)
+	if _, err := os.Stat(f); os.IsNotExist(err) {
+		dir := ""
+		if root := path.Clean(root); f != root && isWithin(f, root) {
+			dir = f
+		}
+		return "", &ErrorRepoNotFound{urlRepo, dir}
+	}
+
+	return f, nil
+}
+
+// resolveStored resolves urlRepo to a repo of Storage, the paths
+// of the repos it holds having no symlinks to follow
+func (res RootResolver) resolveStored(urlRepo string) (string, error) {
+	if !validRepoPath(urlRepo) || path.Clean("/"+urlRepo) == "/" {
+		return "", &ErrorRepoNotFound{urlRepo, ""}
+	}
+
+	dir := path.Join(res.Root, urlRepo)
+	if !fileExists(res.Storage, dir, "HEAD") {
+		return "", &ErrorRepoNotFound{urlRepo, dir}
+	}
+	return dir, nil
+}
+
+// validRepoPath reports whether urlRepo has no ".."
+// segments nor characters to escape its root with
+func validRepoPath(urlRepo string) bool {
+	for _, segment := range strings.Split(urlRepo, "/") {
+		if segment == ".." || strings.ContainsAny(segment, "\\\x00") {
+			return false
+		}
+	}
+	return true
+}
+
+// strictJoin resolves urlRepo under root, making sure the
+// canonical path of the result stays within root
+func strictJoin(root, urlRepo string) (string, error) {
+	if !validRepoPath(urlRepo) {
+		return "", &ErrorRepoNotFound{urlRepo, ""}
+	}
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+
+	f := filepath.Join(root, filepath.FromSlash(urlRepo))
+	real, err := filepath.EvalSymlinks(f)
+	if os.IsNotExist(err) {
+		// Tell where the repo would be created, as long
+		// as its existing parents don't lead out of root
+		dir := ""
+		if parent, err := canonicalParent(f); err == nil && isWithin(parent, root) {
+			dir = f
+		}
+		return "", &ErrorRepoNotFound{urlRepo, dir}
+	}
+	if err != nil || !isWithin(real, root) || real == root {
+		return "", &ErrorRepoNotFound{urlRepo, ""}
+	}
+
+	return real, nil
+}
+
+// canonicalParent returns the canonical path
+// of the closest existing parent of f
+func canonicalParent(f string) (string, error) {
+	for {
+		parent := filepath.Dir(f)
+		if parent == f {
+			return "", os.ErrNotExist
+		}
+		real, err := filepath.EvalSymlinks(parent)
+		if !os.IsNotExist(err) {
+			return real, err
+		}
+		f = parent
+	}
+}
+
+// isWithin reports whether f is root or inside of it
+func isWithin(f, root string) bool {
+	return f == root || strings.HasPrefix(f, root+string(filepath.Separator))
+}
+
+// isBareRepo reports whether dir looks like a bare git repository
+func isBareRepo(s Storage, dir string) bool {
+	f, err := s.Open(dir, "HEAD")
+	if err != nil {
+		return false
+	}
+	fi, err := f.Stat()
+	f.Close()
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+
+	// Other storages have no directories
+	if onDisk(s) {
+		for _, sub := range []string{"objects", "refs"} {
+			if fi, err := os.Stat(filepath.Join(dir, sub)); err != nil || !fi.IsDir() {
+				return false
+			}
+		}
+	}
+
+	bare, _ := readConfig(s, dir, "core", "bare")
+	return strings.EqualFold(bare, "true")
+}
+
+// readConfig looks up a value in the config file of a repo, without
+// spawning git. Includes and multi-valued keys aren't supported.
+func readConfig(s Storage, dir string, section string, key string) (string, bool) {
+	f, err := s.Open(dir, "config")
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+
+	current := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			current = strings.ToLower(strings.Trim(line, "[] \t"))
+			continue
+		}
+
+		k, v, ok := strings.Cut(line, "=")
+		if ok && current == section && strings.EqualFold(strings.TrimSpace(k), key) {
+			return strings.TrimSpace(v), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,145 @@
+package githttp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// makeBareRepo lays out the minimal structure of a bare repository
+func makeBareRepo(t *testing.T, dir string, bare bool) {
+	for _, sub := range []string{"objects", "refs/heads"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := "[core]\n\tbare = false\n"
+	if bare {
+		config = "[core]\n\trepositoryformatversion = 0\n\tbare = true\n"
+	}
+	os.WriteFile(filepath.Join(dir, "HEAD"), []byte("ref: refs/heads/master\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "config"), []byte(config), 0644)
+}
+
+func TestStrictResolve(t *testing.T) {
+	tmp := t.TempDir()
+	root := filepath.Join(tmp, "root")
+
+	makeBareRepo(t, filepath.Join(root, "org", "repo.git"), true)
+	makeBareRepo(t, filepath.Join(root, "work", ".git"), false)
+	makeBareRepo(t, filepath.Join(tmp, "outside.git"), true)
+	os.MkdirAll(filepath.Join(root, "notrepo"), 0755)
+	os.Symlink(filepath.Join(tmp, "outside.git"), filepath.Join(root, "escape.git"))
+	os.Symlink(filepath.Join(root, "org", "repo.git"), filepath.Join(root, "alias.git"))
+
+	g := New(root)
+	g.Strict = true
+
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/org/repo.git/HEAD", 200},
+		{"/alias.git/HEAD", 200},
+		{"/org/../org/repo.git/HEAD", 404},
+		{"/../outside.git/HEAD", 404},
+		{"/org/../../outside.git/HEAD", 404},
+		{"/escape.git/HEAD", 404},
+		{"/work/.git/HEAD", 404},
+		{"/work/HEAD", 404},
+		{"/notrepo/HEAD", 404},
+		{"/missing.git/HEAD", 404},
+		{"/HEAD", 404},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s: got status %d, want %d", tt.path, w.Code, tt.code)
+		}
+	}
+}
+
+func TestIsBareRepo(t *testing.T) {
+	tmp := t.TempDir()
+
+	makeBareRepo(t, filepath.Join(tmp, "bare.git"), true)
+	makeBareRepo(t, filepath.Join(tmp, "work", ".git"), false)
+
+	if !isBareRepo(FileStorage{}, filepath.Join(tmp, "bare.git")) {
+		t.Errorf("bare.git should be a bare repo")
+	}
+	if isBareRepo(FileStorage{}, filepath.Join(tmp, "work", ".git")) {
+		t.Errorf("work/.git should not be a bare repo")
+	}
+	if isBareRepo(FileStorage{}, filepath.Join(tmp, "work")) {
+		t.Errorf("work should not be a bare repo")
+	}
+}
+
+func TestCustomResolver(t *testing.T) {
+	root := t.TempDir()
+
+	// Repos are spread over shards by the first letter of their
+	// name, those under private/ being off limits
+	shard := func(repo string) string {
+		name := strings.TrimSuffix(strings.Trim(repo, "/"), ".git")
+		return filepath.Join(root, "shard-"+name[:1], name+".git")
+	}
+	makeBareRepo(t, shard("/alpha.git"), true)
+	makeBareRepo(t, shard("/org/beta.git"), true)
+	makeBareRepo(t, shard("/private/gamma.git"), true)
+
+	var resolved []string
+	g := New(root)
+	g.Resolver = ResolverFunc(func(ctx context.Context, r *http.Request, repo string) (string, error) {
+		resolved = append(resolved, repo)
+		if strings.HasPrefix(repo, "/private/") {
+			return "", &ErrorNoAccess{shard(repo)}
+		}
+		dir := shard(repo)
+		if !isBareRepo(FileStorage{}, dir) {
+			return "", &ErrorRepoNotFound{repo, ""}
+		}
+		return dir, nil
+	})
+
+	tests := []struct {
+		path string
+		code int
+		head string
+	}{
+		{"/alpha.git/HEAD", 200, "ref: refs/heads/master\n"},
+		{"/alpha/HEAD", 200, "ref: refs/heads/master\n"},
+		{"/org/beta.git/HEAD", 200, "ref: refs/heads/master\n"},
+		{"/org/beta.git/info/refs?service=git-upload-pack", 200, ""},
+		{"/missing.git/HEAD", 404, ""},
+		{"/missing.git/info/refs?service=git-upload-pack", 404, ""},
+		{"/private/gamma.git/HEAD", 403, ""},
+		{"/private/gamma.git/git-upload-pack", 403, ""},
+	}
+
+	for _, tt := range tests {
+		resolved = nil
+		method := "GET"
+		if strings.HasSuffix(tt.path, "/git-upload-pack") {
+			method = "POST"
+		}
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest(method, tt.path, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s: got status %d, want %d", tt.path, w.Code, tt.code)
+		}
+		if tt.head != "" && w.Body.String() != tt.head {
+			t.Errorf("%s: got %q", tt.path, w.Body)
+		}
+		if len(resolved) != 1 {
+			t.Errorf("%s: resolved %q", tt.path, resolved)
+		}
+	}
+}
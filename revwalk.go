@@ -0,0 +1,200 @@
+package githttp
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+)
+
+// walkCommit is a commit met walking history
+type walkCommit struct {
+	id      string
+	tree    string
+	parents []string
+	date    int64
+
+	// Reachable from a commit the client has
+	uninteresting bool
+
+	queued bool
+	walked bool
+}
+
+// commitQueue orders the commits to walk newest first, like rev-list
+type commitQueue []*walkCommit
+
+func (q commitQueue) Len() int           { return len(q) }
+func (q commitQueue) Less(i, j int) bool { return q[i].date > q[j].date }
+func (q commitQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *commitQueue) Push(x any)        { *q = append(*q, x.(*walkCommit)) }
+func (q *commitQueue) Pop() any {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
+
+// Commits walked once only uninteresting ones are left,
+// in case of clock skew, as rev-list does
+const walkSlop = 5
+
+// revWalk walks the history between the commits a client
+// wants and those it has, from the newest commits down
+type revWalk struct {
+	db      *objectDB
+	commits map[string]*walkCommit
+	queue   commitQueue
+
+	// Interesting commits in the queue
+	interesting int
+}
+
+// commit reads a commit, once
+func (w *revWalk) commit(id string) (*walkCommit, error) {
+	if c, ok := w.commits[id]; ok {
+		return c, nil
+	}
+	data, err := w.db.readType(id, objCommit)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := parseCommit(data)
+	if err != nil {
+		return nil, fmt.Errorf("commit %s: %v", id, err)
+	}
+	c := &walkCommit{id: id, tree: parsed.tree, parents: parsed.parents, date: parsed.date}
+	w.commits[id] = c
+	return c, nil
+}
+
+// push queues a commit, unless it already was
+func (w *revWalk) push(c *walkCommit, uninteresting bool) {
+	if uninteresting {
+		w.markUninteresting(c)
+	}
+	if c.queued || c.walked {
+		return
+	}
+	c.queued = true
+	if !c.uninteresting {
+		w.interesting++
+	}
+	heap.Push(&w.queue, c)
+}
+
+// markUninteresting marks a commit as reachable from the client's,
+// along with the ancestors of it already met
+func (w *revWalk) markUninteresting(c *walkCommit) {
+	stack := []*walkCommit{c}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if c.uninteresting {
+			continue
+		}
+		c.uninteresting = true
+		if c.queued {
+			w.interesting--
+		}
+		if !c.walked {
+			continue
+		}
+		for _, id := range c.parents {
+			if parent, ok := w.commits[id]; ok {
+				stack = append(stack, parent)
+			}
+		}
+	}
+}
+
+// newCommits returns the commits reachable from wants but not from
+// haves, newest first, along with the commits the client has that are
+// parents of them. The walk stops once only commits the client has are
+// left to walk, rather than going through all of their history.
+func (db *objectDB) newCommits(ctx context.Context, wants []string, haves []string) ([]*walkCommit, []string, error) {
+	w := &revWalk{db: db, commits: map[string]*walkCommit{}}
+
+	for _, have := range haves {
+		id, typ, err := db.peel(have)
+		if err != nil || typ != objCommit {
+			continue
+		}
+		c, err := w.commit(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		w.push(c, true)
+	}
+	for _, id := range wants {
+		c, err := w.commit(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		w.push(c, false)
+	}
+
+	var walked []*walkCommit
+	for slop := walkSlop; w.queue.Len() > 0 && slop > 0; {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		c := heap.Pop(&w.queue).(*walkCommit)
+		c.queued = false
+		c.walked = true
+		if !c.uninteresting {
+			w.interesting--
+			walked = append(walked, c)
+		}
+
+		for _, id := range c.parents {
+			parent, err := w.commit(id)
+			if errors.Is(err, errObjectNotFound) && c.uninteresting {
+				// Shallow history
+				continue
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			w.push(parent, c.uninteresting)
+		}
+
+		if w.interesting == 0 {
+			slop--
+		} else {
+			slop = walkSlop
+		}
+	}
+
+	// Commits found out to be reachable from
+	// the client's late, through clock skew, are left out
+	var commits []*walkCommit
+	var boundary []string
+	onBoundary := map[string]bool{}
+	for _, c := range walked {
+		if c.uninteresting {
+			continue
+		}
+		commits = append(commits, c)
+		for _, id := range c.parents {
+			if parent := w.commits[id]; parent.uninteresting && !onBoundary[id] {
+				onBoundary[id] = true
+				boundary = append(boundary, id)
+			}
+		}
+	}
+	return commits, boundary, nil
+}
+
+// pushedCommits returns the commits a ref update to new brings in,
+// those not reachable from haves, newest first. Refs updated to
+// objects other than commits or tags of commits bring none.
+func (db *objectDB) pushedCommits(ctx context.Context, new string, haves []string) ([]*walkCommit, error) {
+	id, typ, err := db.peel(new)
+	if err != nil || typ != objCommit {
+		return nil, err
+	}
+	commits, _, err := db.newCommits(ctx, []string{id}, haves)
+	return commits, err
+}
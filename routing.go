@@ -5,6 +5,7 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"time"
 )
 
 type Service struct {
@@ -17,8 +18,11 @@ type HandlerReq struct {
 	w    http.ResponseWriter
 	r    *http.Request
 	Rpc  string
+	Repo string
 	Dir  string
 	File string
+
+	stats *requestStats
 }
 
 // Routing regexes
@@ -31,9 +35,10 @@ var (
 	_getHttpAlternates = regexp.MustCompile("(.*?)/objects/info/http-alternates$")
 	_getInfoPacks      = regexp.MustCompile("(.*?)/objects/info/packs$")
 	_getInfoFile       = regexp.MustCompile("(.*?)/objects/info/[^/]*$")
-	_getLooseObject    = regexp.MustCompile("(.*?)/objects/[0-9a-f]{2}/[0-9a-f]{38}$")
-	_getPackFile       = regexp.MustCompile("(.*?)/objects/pack/pack-[0-9a-f]{40}\\.pack$")
-	_getIdxFile        = regexp.MustCompile("(.*?)/objects/pack/pack-[0-9a-f]{40}\\.idx$")
+	_getLooseObject    = regexp.MustCompile("(.*?)/objects/[0-9a-f]{2}/(?:[0-9a-f]{38}|[0-9a-f]{62})$")
+	_getPackFile       = regexp.MustCompile("(.*?)/objects/pack/pack-(?:[0-9a-f]{40}|[0-9a-f]{64})\\.pack$")
+	_getIdxFile        = regexp.MustCompile("(.*?)/objects/pack/pack-(?:[0-9a-f]{40}|[0-9a-f]{64})\\.idx$")
+	_lfs               = regexp.MustCompile("(.*?)/info/lfs/.*$")
 )
 
 func (g *GitHttp) services() map[*regexp.Regexp]Service {
@@ -71,6 +76,34 @@ func (g *GitHttp) requestHandler(w http.ResponseWriter, r *http.Request) {
 	// Get service for URL
 	repo, service := g.getService(r.URL.Path)
 
+	// Count what goes in and out for the access log
+	stats := &requestStats{start: time.Now()}
+	sw := &statsWriter{ResponseWriter: w}
+	w = sw
+	if r.Body != nil {
+		r.Body = countingReader{r.Body, &stats.bytesIn}
+	}
+	defer func() {
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		g.logRequest(sw, r, repo, stats)
+		metricsRepo := ""
+		if stats.resolved {
+			metricsRepo = repo
+		}
+		g.Metrics.observeRequest(stats.service, metricsRepo, sw.status, stats.bytesIn, sw.bytesOut, time.Since(stats.start))
+	}()
+
+	// Git LFS requests are left to the LFS handler,
+	// which resolves the repo unless it errs
+	if m := _lfs.FindStringSubmatch(r.URL.Path); m != nil && g.LFS != nil {
+		repo, stats.service = m[1], "lfs"
+		g.LFS.ServeHTTP(w, r)
+		stats.resolved = sw.status < 400
+		return
+	}
+
 	// No url match
 	if service == nil {
 		renderNotFound(w)
@@ -85,33 +118,66 @@ func (g *GitHttp) requestHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Rpc type
 	rpc := service.Rpc
+	stats.service = rpc
+	if rpc == "" && r.Method == "GET" {
+		stats.service = getServiceType(r)
+	}
 
 	// Get specific file
 	file := strings.Replace(r.URL.Path, repo+"/", "", 1)
 
 	// Resolve directory
-	dir, err := g.getGitDir(repo)
+	dir, err := g.getGitDir(r, repo)
+
+	// Create missing repos on push
+	if nf, ok := err.(*ErrorRepoNotFound); ok && g.AutoCreate && g.ReceivePack && nf.Dir != "" {
+		if rpc == "receive-pack" || r.Method == "GET" && getServiceType(r) == "receive-pack" {
+			dir, err = nf.Dir, g.createRepo(r, repo, nf.Dir)
+		}
+	}
 
-	// Repo not found on disk
+	// Repo not found or not accessible
 	if err != nil {
-		renderNotFound(w)
+		stats.err = err
+		renderError(w, err)
 		return
 	}
 
+	stats.resolved = true
+
 	// Build request info for handler
-	hr := HandlerReq{w, r, rpc, dir, file}
+	hr := HandlerReq{w, r, rpc, repo, dir, file, stats}
 
 	// Call handler
 	if err := service.Handler(hr); err != nil {
-		if os.IsNotExist(err) {
-			renderNotFound(w)
-			return
-		}
-		switch err.(type) {
-		case *ErrorNoAccess:
-			renderNoAccess(w)
-			return
-		}
-		http.Error(w, err.Error(), 500)
+		stats.err = err
+		renderError(w, err)
+	}
+}
+
+// renderError writes the response for an error
+// returned while handling a request
+func renderError(w http.ResponseWriter, err error) {
+	if os.IsNotExist(err) {
+		renderNotFound(w)
+		return
+	}
+	switch err.(type) {
+	case *ErrorRepoNotFound:
+		renderNotFound(w)
+		return
+	case *ErrorNoAccess:
+		renderNoAccess(w)
+		return
+	case *ErrorCanceled:
+		renderTimeout(w)
+		return
+	case *ErrorInvalidRequest:
+		renderBadRequest(w)
+		return
+	case *ErrorBusy:
+		renderBusy(w, err.(*ErrorBusy).RetryAfter)
+		return
 	}
+	http.Error(w, err.Error(), 500)
 }
@@ -0,0 +1,137 @@
+package githttp
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetService(t *testing.T) {
+	const (
+		sha1Id   = "3da295397738f395c2ca5fd5570f01a9fcea3be3"
+		sha256Id = "0f1e2d3c4b5a69788796a5b4c3d2e1f00112233445566778899aabbccddeeff0"
+	)
+
+	tests := []struct {
+		path string
+
+		wantRepo string
+		wantId   string
+	}{
+		{"/repo.git/objects/" + sha1Id[:2] + "/" + sha1Id[2:], "/repo.git", sha1Id},
+		{"/repo.git/objects/" + sha256Id[:2] + "/" + sha256Id[2:], "/repo.git", sha256Id},
+		{"/org/repo/objects/pack/pack-" + sha1Id + ".pack", "/org/repo", sha1Id},
+		{"/org/repo/objects/pack/pack-" + sha256Id + ".idx", "/org/repo", sha256Id},
+
+		// Neither SHA-1 nor SHA-256
+		{"/repo.git/objects/pack/pack-" + sha1Id + "00.pack", "", ""},
+		{"/repo.git/objects/" + sha256Id[:2] + "/" + sha256Id[3:], "", ""},
+	}
+
+	g := New("")
+	for _, tt := range tests {
+		repo, service := g.getService(tt.path)
+		if service == nil {
+			if tt.wantRepo != "" {
+				t.Errorf("%s: no service found", tt.path)
+			}
+			continue
+		}
+		if tt.wantRepo == "" {
+			t.Errorf("%s: should not be routed", tt.path)
+			continue
+		}
+
+		file := tt.path[len(repo)+1:]
+		if repo != tt.wantRepo || fileObjectId(file) != tt.wantId {
+			t.Errorf("%s:\n got: %q, %q\nwant: %q, %q", tt.path, repo, fileObjectId(file), tt.wantRepo, tt.wantId)
+		}
+	}
+}
+
+func TestAutoCreate(t *testing.T) {
+	root := t.TempDir()
+	template := t.TempDir()
+	os.WriteFile(filepath.Join(template, "description"), []byte("created from template\n"), 0644)
+
+	var events []Event
+	g := New(root)
+	g.AutoCreate = true
+	g.TemplateDir = template
+	g.DefaultBranch = "main"
+	g.AllowCreate = func(r *http.Request, repo string) (bool, error) {
+		return repo != "/denied.git", nil
+	}
+	g.EventHandler = func(ev Event) {
+		events = append(events, ev)
+	}
+	serve := func(method string, path string, body []byte) int {
+		events = nil
+		r := httptest.NewRequest(method, path, bytes.NewReader(body))
+		if method == "POST" {
+			r.Header.Set("Content-Type", "application/x-git-receive-pack-request")
+		}
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// The first push creates the repo with git init --bare
+	if code := serve("GET", "/org/new.git/info/refs?service=git-receive-pack", nil); code != 200 {
+		t.Fatalf("got %d", code)
+	}
+	dir := filepath.Join(root, "org", "new.git")
+	if !isBareRepo(FileStorage{}, dir) {
+		t.Fatalf("%s isn't a bare repo", dir)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "HEAD")); string(data) != "ref: refs/heads/main\n" {
+		t.Errorf("got HEAD %q", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "description")); string(data) != "created from template\n" {
+		t.Errorf("got description %q", data)
+	}
+	if len(events) == 0 || events[0].Type != CREATE || events[0].Repo != "/org/new.git" || events[0].Dir != dir || events[0].Error != nil {
+		t.Errorf("got events %+v", events)
+	}
+
+	// Pushes create repos even without asking for refs first
+	src := makeTestRepo(t)
+	objects := []string{src.blobA, src.tree1, src.commit1}
+	push := pushRequest(t, src.dir, []string{zeroId + " " + src.commit1 + " refs/heads/main\x00report-status"}, objects)
+	if code := serve("POST", "/pushed.git/git-receive-pack", push); code != 200 {
+		t.Fatalf("push got %d", code)
+	}
+	if id := readRef(t, filepath.Join(root, "pushed.git"), "refs/heads/main"); id != src.commit1 {
+		t.Errorf("main is at %q, want %s", id, src.commit1)
+	}
+	if len(events) == 0 || events[0].Type != CREATE {
+		t.Errorf("push got events %+v", events)
+	}
+
+	// Unless AllowCreate denies it, or it's a fetch
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/denied.git/info/refs?service=git-receive-pack", 403},
+		{"/fetched.git/info/refs?service=git-upload-pack", 404},
+	}
+	for _, tt := range tests {
+		if code := serve("GET", tt.path, nil); code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.path, code, tt.code)
+		}
+		for _, ev := range events {
+			if ev.Type == CREATE {
+				t.Errorf("%s: got a create event", tt.path)
+			}
+		}
+	}
+	for _, name := range []string{"denied.git", "fetched.git"} {
+		if _, err := os.Stat(filepath.Join(root, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was created", name)
+		}
+	}
+}
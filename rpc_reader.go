@@ -2,7 +2,6 @@ package githttp
 
 import (
 	"io"
-	"regexp"
 	"strings"
 )
 
@@ -14,10 +13,21 @@ type RpcReader struct {
 	// Rpc type (receive-pack or upload-pack).
 	Rpc string
 
+	// ProtocolVersion is the git wire protocol version of the request,
+	// as requested through the Git-Protocol header. Protocol v2 is only
+	// spoken by upload-pack; 0 and 1 are parsed alike.
+	ProtocolVersion int
+
 	// List of events RpcReader has picked up through scanning.
 	// These events do not have the Dir field set.
 	Events []Event
 
+	// Ref updates requested by a receive-pack client.
+	Updates []RefUpdate
+
+	// Capabilities requested by the client.
+	Capabilities []string
+
 	pktLineParser pktLineParser
 }
 
@@ -39,6 +49,7 @@ func (r *RpcReader) scan(data []byte) {
 		return
 	}
 
+	r.pktLineParser.v2 = r.Rpc == "upload-pack" && r.ProtocolVersion == 2
 	r.pktLineParser.Feed(data)
 
 	// If parsing has just finished, process its output once.
@@ -51,70 +62,159 @@ func (r *RpcReader) scan(data []byte) {
 		// and can now extract relevant events.
 		switch r.Rpc {
 		case "receive-pack":
-			for _, line := range r.pktLineParser.Lines {
-				events := scanPush(line)
-				r.Events = append(r.Events, events...)
-			}
+			r.scanPush(r.pktLineParser.Lines)
 		case "upload-pack":
-			total := strings.Join(r.pktLineParser.Lines, "")
-			events := scanFetch(total)
-			r.Events = append(r.Events, events...)
+			r.scanFetch(r.pktLineParser.Lines)
 		}
 	}
 }
 
-// TODO: Avoid using regexp to parse a well documented binary protocol with an open source
-//       implementation. There should not be a need for regexp.
-
-// receivePackRegex is used once per pkt-line.
-var receivePackRegex = regexp.MustCompile("([0-9a-fA-F]{40}) ([0-9a-fA-F]{40}) refs\\/(heads|tags)\\/(.+?)(\x00|$)")
+// readHeader reads the pkt-lines at the start of the request up to
+// the terminating flush-pkt, without reading any further. It returns
+// the data read, which must still be relayed to git, or an
+// *ErrorInvalidRequest if it doesn't end with a flush-pkt, git
+// possibly reading it differently (e.g. up to a delim-pkt).
+func (r *RpcReader) readHeader() ([]byte, error) {
+	var header []byte
+	buf := make([]byte, 65524)
+
+	r.scan(nil)
+	for r.pktLineParser.state != done {
+		n, err := io.ReadFull(r.Reader, buf[:r.pktLineParser.next])
+		header = append(header, buf[:n]...)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return header, &ErrorInvalidRequest{r.Rpc, "truncated pkt-lines"}
+		}
+		if err != nil {
+			return header, err
+		}
+		r.scan(buf[:n])
+	}
 
-func scanPush(line string) []Event {
-	matches := receivePackRegex.FindAllStringSubmatch(line, -1)
+	if err := r.pktLineParser.Error; err != nil {
+		return header, &ErrorInvalidRequest{r.Rpc, err.Error()}
+	}
+	return header, nil
+}
 
-	if matches == nil {
-		return nil
+func (r *RpcReader) hasCapability(name string) bool {
+	for _, c := range r.Capabilities {
+		if c == name {
+			return true
+		}
 	}
+	return false
+}
 
-	var events []Event
-	for _, m := range matches {
-		e := Event{
-			Last:   m[1],
-			Commit: m[2],
+// isSigned reports whether a receive-pack request is a signed push
+func (r *RpcReader) isSigned() bool {
+	for _, line := range r.pktLineParser.Lines {
+		if strings.HasPrefix(line, "push-cert") {
+			return true
 		}
+	}
+	return false
+}
 
-		// Handle pushes to branches and tags differently
-		if m[3] == "heads" {
-			e.Type = PUSH
-			e.Branch = m[4]
-		} else {
-			e.Type = TAG
-			e.Tag = m[4]
+// scanPush parses the command list of a receive-pack request, e.g.:
+//
+//	<old-id> <new-id> <ref>\x00<capabilities>
+//	<old-id> <new-id> <ref>
+//
+// The command list may be preceded by shallow lines, or wrapped in
+// a push certificate for signed pushes. Neither produces events.
+func (r *RpcReader) scanPush(lines []string) {
+	for _, line := range lines {
+		cmd := line
+		if i := strings.IndexByte(line, 0); i >= 0 {
+			cmd = line[:i]
+			r.Capabilities = strings.Fields(line[i+1:])
 		}
 
-		events = append(events, e)
+		if u, ok := parseCommand(cmd); ok {
+			r.Updates = append(r.Updates, u)
+		}
 	}
 
-	return events
+	for i := range r.Updates {
+		r.Events = append(r.Events, pushEvent(&r.Updates[i], r.Capabilities))
+	}
 }
 
-// uploadPackRegex is used once on the entire header data.
-var uploadPackRegex = regexp.MustCompile(`^want ([0-9a-fA-F]{40})`)
+// pushEvent returns the event of a ref update. Updates to refs/tags/
+// are TAG events, all other refs (branches, notes, ...) PUSH events.
+func pushEvent(u *RefUpdate, caps []string) Event {
+	e := Event{
+		Type:         PUSH,
+		Last:         u.Old,
+		Commit:       u.New,
+		Update:       u,
+		Capabilities: caps,
+	}
 
-func scanFetch(total string) []Event {
-	matches := uploadPackRegex.FindAllStringSubmatch(total, -1)
+	if u.IsTag() {
+		e.Type = TAG
+		e.Tag = strings.TrimPrefix(u.Ref, "refs/tags/")
+	} else if u.IsBranch() {
+		e.Branch = strings.TrimPrefix(u.Ref, "refs/heads/")
+	}
+
+	return e
+}
+
+// scanFetch parses the wants of an upload-pack request, producing
+// an event for every distinct object wanted. For protocol v0 the
+// capabilities follow the object id of the first want line:
+//
+//	want <id> <capabilities>
+//	want <id>
+//
+// whereas protocol v2 requests list them after the command, e.g.:
+//
+//	command=fetch
+//	<capabilities>
+//	0001
+//	want <id>
+func (r *RpcReader) scanFetch(lines []string) {
+	if r.pktLineParser.v2 {
+		// Only a fetch command transfers objects,
+		// ls-refs and the like don't produce events.
+		if len(lines) == 0 || strings.TrimSuffix(lines[0], "\n") != "command=fetch" {
+			return
+		}
 
-	if matches == nil {
-		return nil
+		end := len(lines)
+		if len(r.pktLineParser.sections) > 0 {
+			end = r.pktLineParser.sections[0]
+		}
+		for _, line := range lines[1:end] {
+			r.Capabilities = append(r.Capabilities, strings.TrimSuffix(line, "\n"))
+		}
+		lines = lines[end:]
 	}
 
-	var events []Event
-	for _, m := range matches {
-		events = append(events, Event{
-			Type:   FETCH,
-			Commit: m[1],
+	seen := map[string]bool{}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "want ") {
+			continue
+		}
+
+		fields := strings.Fields(strings.TrimPrefix(line, "want "))
+		if len(fields) == 0 || !isObjectId(fields[0]) {
+			continue
+		}
+		if r.Capabilities == nil && !r.pktLineParser.v2 {
+			r.Capabilities = fields[1:]
+		}
+		if seen[fields[0]] {
+			continue
+		}
+		seen[fields[0]] = true
+
+		r.Events = append(r.Events, Event{
+			Type:         FETCH,
+			Commit:       fields[0],
+			Capabilities: r.Capabilities,
 		})
 	}
-
-	return events
 }
@@ -14,8 +14,9 @@ import (
 
 func TestRpcReader(t *testing.T) {
 	tests := []struct {
-		rpc  string
-		file string
+		rpc     string
+		file    string
+		version int
 
 		want []githttp.Event
 	}{
@@ -25,14 +26,16 @@ func TestRpcReader(t *testing.T) {
 
 			want: []githttp.Event{
 				(githttp.Event)(githttp.Event{
-					Type:    (githttp.EventType)(githttp.PUSH),
-					Commit:  (string)("92eef6dcb9cc198bc3ac6010c108fa482773f116"),
-					Dir:     (string)(""),
-					Tag:     (string)(""),
-					Last:    (string)("0000000000000000000000000000000000000000"),
-					Branch:  (string)("master"),
-					Error:   (error)(nil),
-					Request: (*http.Request)(nil),
+					Type:         (githttp.EventType)(githttp.PUSH),
+					Commit:       (string)("92eef6dcb9cc198bc3ac6010c108fa482773f116"),
+					Dir:          (string)(""),
+					Tag:          (string)(""),
+					Last:         (string)("0000000000000000000000000000000000000000"),
+					Branch:       (string)("master"),
+					Update:       &githttp.RefUpdate{Old: "0000000000000000000000000000000000000000", New: "92eef6dcb9cc198bc3ac6010c108fa482773f116", Ref: "refs/heads/master", Kind: githttp.REF_CREATE},
+					Capabilities: []string{"report-status", "side-band-64k", "agent=git/2.5.4.(Apple.Git-61)"},
+					Error:        (error)(nil),
+					Request:      (*http.Request)(nil),
 				}),
 			},
 		},
@@ -44,14 +47,16 @@ func TestRpcReader(t *testing.T) {
 
 			want: []githttp.Event{
 				(githttp.Event)(githttp.Event{
-					Type:    (githttp.EventType)(githttp.TAG),
-					Commit:  (string)("3da295397738f395c2ca5fd5570f01a9fcea3be3"),
-					Dir:     (string)(""),
-					Tag:     (string)("sometextualtag"),
-					Last:    (string)("0000000000000000000000000000000000000000"),
-					Branch:  (string)(""),
-					Error:   (error)(nil),
-					Request: (*http.Request)(nil),
+					Type:         (githttp.EventType)(githttp.TAG),
+					Commit:       (string)("3da295397738f395c2ca5fd5570f01a9fcea3be3"),
+					Dir:          (string)(""),
+					Tag:          (string)("sometextualtag"),
+					Last:         (string)("0000000000000000000000000000000000000000"),
+					Branch:       (string)(""),
+					Update:       &githttp.RefUpdate{Old: "0000000000000000000000000000000000000000", New: "3da295397738f395c2ca5fd5570f01a9fcea3be3", Ref: "refs/tags/sometextualtag", Kind: githttp.REF_CREATE},
+					Capabilities: []string{"report-status", "side-band-64k", "agent=git/2.5.4.(Apple.Git-61)"},
+					Error:        (error)(nil),
+					Request:      (*http.Request)(nil),
 				}),
 			},
 		},
@@ -63,14 +68,16 @@ func TestRpcReader(t *testing.T) {
 
 			want: []githttp.Event{
 				(githttp.Event)(githttp.Event{
-					Type:    (githttp.EventType)(githttp.TAG),
-					Commit:  (string)("3da295397738f395c2ca5fd5570f01a9fcea3be3"),
-					Dir:     (string)(""),
-					Tag:     (string)("1.000.1"),
-					Last:    (string)("0000000000000000000000000000000000000000"),
-					Branch:  (string)(""),
-					Error:   (error)(nil),
-					Request: (*http.Request)(nil),
+					Type:         (githttp.EventType)(githttp.TAG),
+					Commit:       (string)("3da295397738f395c2ca5fd5570f01a9fcea3be3"),
+					Dir:          (string)(""),
+					Tag:          (string)("1.000.1"),
+					Last:         (string)("0000000000000000000000000000000000000000"),
+					Branch:       (string)(""),
+					Update:       &githttp.RefUpdate{Old: "0000000000000000000000000000000000000000", New: "3da295397738f395c2ca5fd5570f01a9fcea3be3", Ref: "refs/tags/1.000.1", Kind: githttp.REF_CREATE},
+					Capabilities: []string{"report-status", "side-band-64k", "agent=git/2.5.4.(Apple.Git-61)"},
+					Error:        (error)(nil),
+					Request:      (*http.Request)(nil),
 				}),
 			},
 		},
@@ -82,34 +89,97 @@ func TestRpcReader(t *testing.T) {
 
 			want: []githttp.Event{
 				(githttp.Event)(githttp.Event{
-					Type:    (githttp.EventType)(githttp.TAG),
-					Commit:  (string)("3da295397738f395c2ca5fd5570f01a9fcea3be3"),
-					Dir:     (string)(""),
-					Tag:     (string)("1.000.2"),
-					Last:    (string)("0000000000000000000000000000000000000000"),
-					Branch:  (string)(""),
-					Error:   (error)(nil),
-					Request: (*http.Request)(nil),
-				}),
-				(githttp.Event)(githttp.Event{
-					Type:    (githttp.EventType)(githttp.TAG),
-					Commit:  (string)("3da295397738f395c2ca5fd5570f01a9fcea3be3"),
-					Dir:     (string)(""),
-					Tag:     (string)("1.000.3"),
-					Last:    (string)("0000000000000000000000000000000000000000"),
-					Branch:  (string)(""),
-					Error:   (error)(nil),
-					Request: (*http.Request)(nil),
-				}),
-				(githttp.Event)(githttp.Event{
-					Type:    (githttp.EventType)(githttp.TAG),
-					Commit:  (string)("3da295397738f395c2ca5fd5570f01a9fcea3be3"),
-					Dir:     (string)(""),
-					Tag:     (string)("1.000.4"),
-					Last:    (string)("0000000000000000000000000000000000000000"),
-					Branch:  (string)(""),
-					Error:   (error)(nil),
-					Request: (*http.Request)(nil),
+					Type:         (githttp.EventType)(githttp.TAG),
+					Commit:       (string)("3da295397738f395c2ca5fd5570f01a9fcea3be3"),
+					Dir:          (string)(""),
+					Tag:          (string)("1.000.2"),
+					Last:         (string)("0000000000000000000000000000000000000000"),
+					Branch:       (string)(""),
+					Update:       &githttp.RefUpdate{Old: "0000000000000000000000000000000000000000", New: "3da295397738f395c2ca5fd5570f01a9fcea3be3", Ref: "refs/tags/1.000.2", Kind: githttp.REF_CREATE},
+					Capabilities: []string{"report-status", "side-band-64k", "agent=git/2.5.4.(Apple.Git-61)"},
+					Error:        (error)(nil),
+					Request:      (*http.Request)(nil),
+				}),
+				(githttp.Event)(githttp.Event{
+					Type:         (githttp.EventType)(githttp.TAG),
+					Commit:       (string)("3da295397738f395c2ca5fd5570f01a9fcea3be3"),
+					Dir:          (string)(""),
+					Tag:          (string)("1.000.3"),
+					Last:         (string)("0000000000000000000000000000000000000000"),
+					Branch:       (string)(""),
+					Update:       &githttp.RefUpdate{Old: "0000000000000000000000000000000000000000", New: "3da295397738f395c2ca5fd5570f01a9fcea3be3", Ref: "refs/tags/1.000.3", Kind: githttp.REF_CREATE},
+					Capabilities: []string{"report-status", "side-band-64k", "agent=git/2.5.4.(Apple.Git-61)"},
+					Error:        (error)(nil),
+					Request:      (*http.Request)(nil),
+				}),
+				(githttp.Event)(githttp.Event{
+					Type:         (githttp.EventType)(githttp.TAG),
+					Commit:       (string)("3da295397738f395c2ca5fd5570f01a9fcea3be3"),
+					Dir:          (string)(""),
+					Tag:          (string)("1.000.4"),
+					Last:         (string)("0000000000000000000000000000000000000000"),
+					Branch:       (string)(""),
+					Update:       &githttp.RefUpdate{Old: "0000000000000000000000000000000000000000", New: "3da295397738f395c2ca5fd5570f01a9fcea3be3", Ref: "refs/tags/1.000.4", Kind: githttp.REF_CREATE},
+					Capabilities: []string{"report-status", "side-band-64k", "agent=git/2.5.4.(Apple.Git-61)"},
+					Error:        (error)(nil),
+					Request:      (*http.Request)(nil),
+				}),
+			},
+		},
+
+		// Updates, deletions and refs other than branches and tags.
+		{
+			rpc:  "receive-pack",
+			file: "receive-pack.4",
+
+			want: []githttp.Event{
+				(githttp.Event)(githttp.Event{
+					Type:         (githttp.EventType)(githttp.PUSH),
+					Commit:       (string)("3da295397738f395c2ca5fd5570f01a9fcea3be3"),
+					Dir:          (string)(""),
+					Tag:          (string)(""),
+					Last:         (string)("92eef6dcb9cc198bc3ac6010c108fa482773f116"),
+					Branch:       (string)("master"),
+					Update:       &githttp.RefUpdate{Old: "92eef6dcb9cc198bc3ac6010c108fa482773f116", New: "3da295397738f395c2ca5fd5570f01a9fcea3be3", Ref: "refs/heads/master", Kind: githttp.REF_UPDATE},
+					Capabilities: []string{"report-status-v2", "side-band-64k", "atomic", "object-format=sha1", "agent=git/2.39.5"},
+					Error:        (error)(nil),
+					Request:      (*http.Request)(nil),
+				}),
+				(githttp.Event)(githttp.Event{
+					Type:         (githttp.EventType)(githttp.PUSH),
+					Commit:       (string)("0000000000000000000000000000000000000000"),
+					Dir:          (string)(""),
+					Tag:          (string)(""),
+					Last:         (string)("3da295397738f395c2ca5fd5570f01a9fcea3be3"),
+					Branch:       (string)("old-feature"),
+					Update:       &githttp.RefUpdate{Old: "3da295397738f395c2ca5fd5570f01a9fcea3be3", New: "0000000000000000000000000000000000000000", Ref: "refs/heads/old-feature", Kind: githttp.REF_DELETE},
+					Capabilities: []string{"report-status-v2", "side-band-64k", "atomic", "object-format=sha1", "agent=git/2.39.5"},
+					Error:        (error)(nil),
+					Request:      (*http.Request)(nil),
+				}),
+				(githttp.Event)(githttp.Event{
+					Type:         (githttp.EventType)(githttp.PUSH),
+					Commit:       (string)("a647ec2ea40ee9ca35d32232dc28de22b1537e00"),
+					Dir:          (string)(""),
+					Tag:          (string)(""),
+					Last:         (string)("0000000000000000000000000000000000000000"),
+					Branch:       (string)(""),
+					Update:       &githttp.RefUpdate{Old: "0000000000000000000000000000000000000000", New: "a647ec2ea40ee9ca35d32232dc28de22b1537e00", Ref: "refs/notes/commits", Kind: githttp.REF_CREATE},
+					Capabilities: []string{"report-status-v2", "side-band-64k", "atomic", "object-format=sha1", "agent=git/2.39.5"},
+					Error:        (error)(nil),
+					Request:      (*http.Request)(nil),
+				}),
+				(githttp.Event)(githttp.Event{
+					Type:         (githttp.EventType)(githttp.PUSH),
+					Commit:       (string)("92eef6dcb9cc198bc3ac6010c108fa482773f116"),
+					Dir:          (string)(""),
+					Tag:          (string)(""),
+					Last:         (string)("0000000000000000000000000000000000000000"),
+					Branch:       (string)(""),
+					Update:       &githttp.RefUpdate{Old: "0000000000000000000000000000000000000000", New: "92eef6dcb9cc198bc3ac6010c108fa482773f116", Ref: "refs/pull/12/head", Kind: githttp.REF_CREATE},
+					Capabilities: []string{"report-status-v2", "side-band-64k", "atomic", "object-format=sha1", "agent=git/2.39.5"},
+					Error:        (error)(nil),
+					Request:      (*http.Request)(nil),
 				}),
 			},
 		},
@@ -120,14 +190,15 @@ func TestRpcReader(t *testing.T) {
 
 			want: []githttp.Event{
 				(githttp.Event)(githttp.Event{
-					Type:    (githttp.EventType)(githttp.FETCH),
-					Commit:  (string)("a647ec2ea40ee9ca35d32232dc28de22b1537e00"),
-					Dir:     (string)(""),
-					Tag:     (string)(""),
-					Last:    (string)(""),
-					Branch:  (string)(""),
-					Error:   (error)(nil),
-					Request: (*http.Request)(nil),
+					Type:         (githttp.EventType)(githttp.FETCH),
+					Commit:       (string)("a647ec2ea40ee9ca35d32232dc28de22b1537e00"),
+					Dir:          (string)(""),
+					Tag:          (string)(""),
+					Last:         (string)(""),
+					Branch:       (string)(""),
+					Capabilities: []string{"multi_ack_detailed", "side-band-64k", "thin-pack", "include-tag", "ofs-delta", "agent=git/2.5.4.(Apple.Git-61)"},
+					Error:        (error)(nil),
+					Request:      (*http.Request)(nil),
 				}),
 			},
 		},
@@ -138,14 +209,96 @@ func TestRpcReader(t *testing.T) {
 
 			want: []githttp.Event{
 				(githttp.Event)(githttp.Event{
-					Type:    (githttp.EventType)(githttp.FETCH),
-					Commit:  (string)("92eef6dcb9cc198bc3ac6010c108fa482773f116"),
-					Dir:     (string)(""),
-					Tag:     (string)(""),
-					Last:    (string)(""),
-					Branch:  (string)(""),
-					Error:   (error)(nil),
-					Request: (*http.Request)(nil),
+					Type:         (githttp.EventType)(githttp.FETCH),
+					Commit:       (string)("92eef6dcb9cc198bc3ac6010c108fa482773f116"),
+					Dir:          (string)(""),
+					Tag:          (string)(""),
+					Last:         (string)(""),
+					Branch:       (string)(""),
+					Capabilities: []string{"multi_ack_detailed", "side-band-64k", "thin-pack", "ofs-delta", "agent=git/2.5.4.(Apple.Git-61)"},
+					Error:        (error)(nil),
+					Request:      (*http.Request)(nil),
+				}),
+			},
+		},
+
+		// Protocol v2 fetch command with multiple wants.
+		{
+			rpc:     "upload-pack",
+			file:    "upload-pack.2",
+			version: 2,
+
+			want: []githttp.Event{
+				(githttp.Event)(githttp.Event{
+					Type:         (githttp.EventType)(githttp.FETCH),
+					Commit:       (string)("92eef6dcb9cc198bc3ac6010c108fa482773f116"),
+					Dir:          (string)(""),
+					Tag:          (string)(""),
+					Last:         (string)(""),
+					Branch:       (string)(""),
+					Capabilities: []string{"agent=git/2.39.5", "object-format=sha1"},
+					Error:        (error)(nil),
+					Request:      (*http.Request)(nil),
+				}),
+				(githttp.Event)(githttp.Event{
+					Type:         (githttp.EventType)(githttp.FETCH),
+					Commit:       (string)("3da295397738f395c2ca5fd5570f01a9fcea3be3"),
+					Dir:          (string)(""),
+					Tag:          (string)(""),
+					Last:         (string)(""),
+					Branch:       (string)(""),
+					Capabilities: []string{"agent=git/2.39.5", "object-format=sha1"},
+					Error:        (error)(nil),
+					Request:      (*http.Request)(nil),
+				}),
+			},
+		},
+
+		// Protocol v2 ls-refs command, no objects are transferred.
+		{
+			rpc:     "upload-pack",
+			file:    "upload-pack.3",
+			version: 2,
+
+			want: nil,
+		},
+		// SHA-256 repository.
+		{
+			rpc:  "receive-pack",
+			file: "receive-pack.5",
+
+			want: []githttp.Event{
+				(githttp.Event)(githttp.Event{
+					Type:         (githttp.EventType)(githttp.PUSH),
+					Commit:       (string)("6d8cf4a1b9e8fd4c9a2b64e8e7c1d2b37ab7f2c4a9e3d1f0b5c6a7e8d9f0a1b2"),
+					Dir:          (string)(""),
+					Tag:          (string)(""),
+					Last:         (string)("0000000000000000000000000000000000000000000000000000000000000000"),
+					Branch:       (string)("main"),
+					Update:       &githttp.RefUpdate{Old: "0000000000000000000000000000000000000000000000000000000000000000", New: "6d8cf4a1b9e8fd4c9a2b64e8e7c1d2b37ab7f2c4a9e3d1f0b5c6a7e8d9f0a1b2", Ref: "refs/heads/main", Kind: githttp.REF_CREATE},
+					Capabilities: []string{"report-status-v2", "side-band-64k", "object-format=sha256", "agent=git/2.39.5"},
+					Error:        (error)(nil),
+					Request:      (*http.Request)(nil),
+				}),
+			},
+		},
+
+		{
+			rpc:     "upload-pack",
+			file:    "upload-pack.4",
+			version: 2,
+
+			want: []githttp.Event{
+				(githttp.Event)(githttp.Event{
+					Type:         (githttp.EventType)(githttp.FETCH),
+					Commit:       (string)("0f1e2d3c4b5a69788796a5b4c3d2e1f00112233445566778899aabbccddeeff0"),
+					Dir:          (string)(""),
+					Tag:          (string)(""),
+					Last:         (string)(""),
+					Branch:       (string)(""),
+					Capabilities: []string{"agent=git/2.39.5", "object-format=sha256"},
+					Error:        (error)(nil),
+					Request:      (*http.Request)(nil),
 				}),
 			},
 		},
@@ -160,8 +313,9 @@ func TestRpcReader(t *testing.T) {
 		r := fragmentedReader{f}
 
 		rr := &githttp.RpcReader{
-			Reader: r,
-			Rpc:    tt.rpc,
+			Reader:          r,
+			Rpc:             tt.rpc,
+			ProtocolVersion: tt.version,
 		}
 
 		_, err = io.Copy(ioutil.Discard, rr)
@@ -0,0 +1,291 @@
+package githttp
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage holds the files of repositories: their HEAD and config,
+// refs, loose objects and packs. Files are named by slash separated
+// paths in the repo, as laid out in a git directory (e.g.
+// "refs/heads/master" or "objects/pack/pack-<id>.idx"), repos by
+// the dir their resolver returned.
+//
+// Repos kept anywhere but on disk are served by a GoBackend,
+// git only knowing about directories.
+type Storage interface {
+	// Open opens a file for reading, failing with an
+	// error wrapping fs.ErrNotExist if there's no such file
+	Open(dir string, name string) (File, error)
+
+	// List returns the names of the files under the directory
+	// name (e.g. "refs"), recursively, sorted
+	List(dir string, name string) ([]string, error)
+
+	// Write creates or replaces a file with the content of r,
+	// the new content only showing once it's complete
+	Write(dir string, name string, r io.Reader) error
+
+	// Remove removes a file, if it exists
+	Remove(dir string, name string) error
+
+	// Lock takes the lock on a file that is about to be updated,
+	// failing with an error wrapping fs.ErrExist if it's taken
+	Lock(dir string, name string) (unlock func(), err error)
+}
+
+// File is a file of a Storage opened for reading
+type File interface {
+	io.ReadSeeker
+	io.ReaderAt
+	io.Closer
+	Stat() (fs.FileInfo, error)
+}
+
+// onDisk reports whether the repos of s are directories on the local disk
+func onDisk(s Storage) bool {
+	_, ok := s.(FileStorage)
+	return ok
+}
+
+// readFile returns the content of a file of a Storage
+func readFile(s Storage, dir string, name string) ([]byte, error) {
+	f, err := s.Open(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// fileExists reports whether a file of a Storage exists
+func fileExists(s Storage, dir string, name string) bool {
+	f, err := s.Open(dir, name)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// initRepo creates an empty bare repo, as "git init --bare" would
+// without template, HEAD pointing to branch ("master" if empty)
+func initRepo(s Storage, dir string, branch string) error {
+	if branch == "" {
+		branch = "master"
+	}
+	config := "[core]\n\trepositoryformatversion = 0\n\tfilemode = true\n\tbare = true\n"
+	if err := s.Write(dir, "config", strings.NewReader(config)); err != nil {
+		return err
+	}
+	return s.Write(dir, "HEAD", strings.NewReader("ref: refs/heads/"+branch+"\n"))
+}
+
+// FileStorage keeps repos on the local disk, the dir of a repo being
+// its directory. It's the Storage used when GitHttp has none. Files
+// are locked the way git does, with "<name>.lock" files.
+type FileStorage struct{}
+
+func (FileStorage) Open(dir string, name string) (File, error) {
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (FileStorage) List(dir string, name string) ([]string, error) {
+	var names []string
+	root := filepath.Join(dir, filepath.FromSlash(name))
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(p, ".lock") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		names = append(names, path.Join(name, filepath.ToSlash(rel)))
+		return nil
+	})
+	return names, err
+}
+
+func (FileStorage) Write(dir string, name string, r io.Reader) error {
+	file := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	// Git takes neither dot files ending in ".lock" for refs or
+	// objects, nor for the lock of a ref, and List leaves them out
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+"-*.lock")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	// Objects are read-only, as git makes them
+	_, err = io.Copy(tmp, r)
+	if err == nil && strings.HasPrefix(name, "objects/") {
+		err = tmp.Chmod(0444)
+	} else if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+func (FileStorage) Remove(dir string, name string) error {
+	err := os.Remove(filepath.Join(dir, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (FileStorage) Lock(dir string, name string) (func(), error) {
+	lock := filepath.Join(dir, filepath.FromSlash(name)) + ".lock"
+	if err := os.MkdirAll(filepath.Dir(lock), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return func() { os.Remove(lock) }, nil
+}
+
+// MemoryStorage keeps repos in memory, e.g. for tests
+type MemoryStorage struct {
+	mu    sync.Mutex
+	files map[storageKey]memoryFile
+	locks map[storageKey]bool
+}
+
+type storageKey struct {
+	dir  string
+	name string
+}
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		files: map[storageKey]memoryFile{},
+		locks: map[storageKey]bool{},
+	}
+}
+
+func (s *MemoryStorage) Open(dir string, name string) (File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.files[storageKey{dir, name}]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memoryReader{bytes.NewReader(f.data), memoryFileInfo{path.Base(name), f}}, nil
+}
+
+func (s *MemoryStorage) List(dir string, name string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var names []string
+	for key := range s.files {
+		if key.dir == dir && strings.HasPrefix(key.name, name+"/") {
+			names = append(names, key.name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *MemoryStorage) Write(dir string, name string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[storageKey{dir, name}] = memoryFile{data, time.Now()}
+	return nil
+}
+
+func (s *MemoryStorage) Remove(dir string, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, storageKey{dir, name})
+	return nil
+}
+
+func (s *MemoryStorage) Lock(dir string, name string) (func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := storageKey{dir, name}
+	if s.locks[key] {
+		return nil, &fs.PathError{Op: "lock", Path: name, Err: fs.ErrExist}
+	}
+	s.locks[key] = true
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			delete(s.locks, key)
+			s.mu.Unlock()
+		})
+	}, nil
+}
+
+// memoryReader reads a file of a MemoryStorage
+type memoryReader struct {
+	*bytes.Reader
+	info memoryFileInfo
+}
+
+func (r *memoryReader) Close() error {
+	return nil
+}
+
+func (r *memoryReader) Stat() (fs.FileInfo, error) {
+	return r.info, nil
+}
+
+type memoryFileInfo struct {
+	name string
+	file memoryFile
+}
+
+func (fi memoryFileInfo) Name() string       { return fi.name }
+func (fi memoryFileInfo) Size() int64        { return int64(len(fi.file.data)) }
+func (fi memoryFileInfo) Mode() fs.FileMode  { return 0444 }
+func (fi memoryFileInfo) ModTime() time.Time { return fi.file.modTime }
+func (fi memoryFileInfo) IsDir() bool        { return false }
+func (fi memoryFileInfo) Sys() any           { return nil }
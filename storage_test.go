@@ -0,0 +1,149 @@
+package githttp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestStorages(t *testing.T) {
+	storages := map[string]Storage{
+		"file":   FileStorage{},
+		"memory": NewMemoryStorage(),
+	}
+
+	for name, s := range storages {
+		dir := t.TempDir()
+
+		for _, file := range []string{"refs/heads/master", "refs/tags/v1", "HEAD"} {
+			if err := s.Write(dir, file, strings.NewReader(file+"\n")); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		data, err := readFile(s, dir, "refs/heads/master")
+		if err != nil || string(data) != "refs/heads/master\n" {
+			t.Errorf("%s: got %q, %v", name, data, err)
+		}
+		if _, err := s.Open(dir, "refs/heads/missing"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: got %v for a missing file", name, err)
+		}
+
+		unlock, err := s.Lock(dir, "refs/heads/master")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := s.Lock(dir, "refs/heads/master"); !errors.Is(err, fs.ErrExist) {
+			t.Errorf("%s: got %v locking twice", name, err)
+		}
+
+		// Locks aren't files
+		names, err := s.List(dir, "refs")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if strings.Join(names, " ") != "refs/heads/master refs/tags/v1" {
+			t.Errorf("%s: listed %v", name, names)
+		}
+		unlock()
+
+		if err := s.Remove(dir, "refs/tags/v1"); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := s.Remove(dir, "refs/tags/v1"); err != nil {
+			t.Errorf("%s: removing twice: %v", name, err)
+		}
+		if names, _ := s.List(dir, "refs"); len(names) != 1 {
+			t.Errorf("%s: listed %v", name, names)
+		}
+
+		// Files being written don't show, nor do those that failed to
+		var listed []string
+		err = s.Write(dir, "refs/heads/new", &failingReader{func() {
+			listed, _ = s.List(dir, "refs")
+		}})
+		if err == nil {
+			t.Errorf("%s: writing succeeded", name)
+		}
+		if strings.Join(listed, " ") != "refs/heads/master" {
+			t.Errorf("%s: listed %v while writing", name, listed)
+		}
+		if names, _ := s.List(dir, "refs"); len(names) != 1 {
+			t.Errorf("%s: listed %v after writing", name, names)
+		}
+	}
+}
+
+// failingReader calls read then fails
+type failingReader struct {
+	read func()
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	r.read()
+	return 0, errors.New("read failed")
+}
+
+func TestMemoryStorageServing(t *testing.T) {
+	src := makeTestRepo(t)
+
+	s := NewMemoryStorage()
+	g := &GitHttp{
+		Storage:     s,
+		UploadPack:  true,
+		ReceivePack: true,
+		AutoCreate:  true,
+	}
+
+	// The repo is created by the first push
+	r := httptest.NewRequest("GET", "/org/repo.git/info/refs?service=git-receive-pack", nil)
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	if w.Code != 200 || !isBareRepo(s, "/org/repo.git") {
+		t.Fatalf("got %d %q", w.Code, w.Body)
+	}
+
+	objects := []string{src.blobA, src.blobB, src.tree1, src.tree2, src.commit1, src.commit2}
+	push := pushRequest(t, src.dir, []string{zeroId + " " + src.commit2 + " refs/heads/master\x00report-status"}, objects)
+	r = httptest.NewRequest("POST", "/org/repo.git/git-receive-pack", bytes.NewReader(push))
+	r.Header.Set("Content-Type", "application/x-git-receive-pack-request")
+	w = httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), "ok refs/heads/master\n") {
+		t.Fatalf("got %d %q", w.Code, w.Body)
+	}
+
+	// Fetches are served from the storage
+	fetch := fetchRequest("want "+src.commit2, "", "done")
+	r = httptest.NewRequest("POST", "/org/repo.git/git-upload-pack", bytes.NewReader(fetch))
+	r.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	w = httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	body, _ := io.ReadAll(w.Body)
+	nak := string(packetWrite("NAK\n"))
+	if !strings.HasPrefix(string(body), nak) {
+		t.Fatalf("got %d %q", w.Code, body)
+	}
+	got := readPackIds(t, body[len(nak):])
+	sort.Strings(got)
+	sort.Strings(objects)
+	if strings.Join(got, " ") != strings.Join(objects, " ") {
+		t.Errorf("got objects %v, want %v", got, objects)
+	}
+
+	// And so are the files of the dumb protocol
+	w = httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest("GET", "/org/repo.git/HEAD", nil))
+	if w.Code != 200 || w.Body.String() != "ref: refs/heads/master\n" {
+		t.Errorf("got %d %q", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest("GET", "/org/other.git/HEAD", nil))
+	if w.Code != 404 {
+		t.Errorf("got %d for a missing repo", w.Code)
+	}
+}
@@ -0,0 +1,191 @@
+package githttp
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// treeChange is a file changed between two trees, along
+// with its id, the old one for deleted files
+type treeChange struct {
+	FileChange
+	id string
+}
+
+// diffTrees returns the files added (A), modified (M) or deleted (D)
+// from the tree old to new, either being empty for no tree, in path
+// order like "git diff-tree -r --name-status". With renames, files
+// deleted and added back unchanged elsewhere are listed once as renamed
+// (R), only exact renames being detected.
+func (db *objectDB) diffTrees(ctx context.Context, old string, new string, renames bool) ([]FileChange, error) {
+	var changes []treeChange
+	if err := db.diffTree(ctx, old, new, "", 0, &changes); err != nil {
+		return nil, err
+	}
+
+	deleted := map[string][]int{}
+	if renames {
+		for i, c := range changes {
+			if c.Status == "D" {
+				deleted[c.id] = append(deleted[c.id], i)
+			}
+		}
+	}
+
+	renamed := map[int]bool{}
+	result := make([]FileChange, 0, len(changes))
+	for _, c := range changes {
+		if c.Status == "A" && len(deleted[c.id]) > 0 {
+			i := deleted[c.id][0]
+			deleted[c.id] = deleted[c.id][1:]
+			renamed[i] = true
+			c.Status = "R"
+			c.OldPath = changes[i].Path
+		}
+		result = append(result, c.FileChange)
+	}
+	if len(renamed) == 0 {
+		return result, nil
+	}
+
+	// Drop the deletions of renamed files
+	kept := result[:0]
+	for i, c := range result {
+		if !renamed[i] {
+			kept = append(kept, c)
+		}
+	}
+	return kept, nil
+}
+
+// Deepest tree nesting diffed, as git's core.maxTreeDepth
+// allows by default, pushed trees nested deeper being refused
+const maxTreeDepth = 2048
+
+func (db *objectDB) diffTree(ctx context.Context, old string, new string, prefix string, depth int, changes *[]treeChange) error {
+	if old == new {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if depth > maxTreeDepth {
+		return fmt.Errorf("trees under %s are nested too deep", prefix)
+	}
+
+	oldEntries, err := db.treeEntries(old)
+	if err != nil {
+		return err
+	}
+	newEntries, err := db.treeEntries(new)
+	if err != nil {
+		return err
+	}
+
+	// Sort like paths, trees as if their names ended with a slash
+	keys := map[string]string{}
+	for name, e := range oldEntries {
+		keys[name] = sortKey(e)
+	}
+	for name, e := range newEntries {
+		if _, ok := keys[name]; !ok || e.isTree() {
+			keys[name] = sortKey(e)
+		}
+	}
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return keys[names[i]] < keys[names[j]] })
+
+	for _, name := range names {
+		o, inOld := oldEntries[name]
+		n, inNew := newEntries[name]
+		path := prefix + name
+
+		switch {
+		case inOld && inNew && o.id == n.id && o.mode == n.mode:
+		case inOld && inNew && o.isTree() && n.isTree():
+			if err := db.diffTree(ctx, o.id, n.id, path+"/", depth+1, changes); err != nil {
+				return err
+			}
+		case inOld && inNew && !o.isTree() && !n.isTree():
+			*changes = append(*changes, treeChange{FileChange{Status: "M", Path: path}, n.id})
+		default:
+			// Files replaced by directories or the other
+			// way around are deleted then added
+			if inOld {
+				if err := db.treeFiles(ctx, o, path, "D", depth, changes); err != nil {
+					return err
+				}
+			}
+			if inNew {
+				if err := db.treeFiles(ctx, n, path, "A", depth, changes); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// treeFiles lists a file, or the files under a tree, with status
+func (db *objectDB) treeFiles(ctx context.Context, e treeEntry, path string, status string, depth int, changes *[]treeChange) error {
+	if !e.isTree() {
+		*changes = append(*changes, treeChange{FileChange{Status: status, Path: path}, e.id})
+		return nil
+	}
+	if status == "A" {
+		return db.diffTree(ctx, "", e.id, path+"/", depth+1, changes)
+	}
+	return db.diffTree(ctx, e.id, "", path+"/", depth+1, changes)
+}
+
+func sortKey(e treeEntry) string {
+	if e.isTree() {
+		return e.name + "/"
+	}
+	return e.name
+}
+
+// treeEntries reads the entries of a tree by name, none for no tree
+func (db *objectDB) treeEntries(id string) (map[string]treeEntry, error) {
+	entries := map[string]treeEntry{}
+	if id == "" {
+		return entries, nil
+	}
+	data, err := db.readType(id, objTree)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := parseTree(data, db.format.HexSize()/2)
+	if err != nil {
+		return nil, fmt.Errorf("tree %s: %v", id, err)
+	}
+	for _, e := range parsed {
+		entries[e.name] = e
+	}
+	return entries, nil
+}
+
+// commitChanges returns the files c changed compared to its parent,
+// none for merges as with "git log"
+func (db *objectDB) commitChanges(ctx context.Context, c *walkCommit, renames bool) ([]FileChange, error) {
+	if len(c.parents) > 1 {
+		return nil, nil
+	}
+	parentTree := ""
+	if len(c.parents) == 1 {
+		data, err := db.readType(c.parents[0], objCommit)
+		if err != nil {
+			return nil, err
+		}
+		parent, err := parseCommit(data)
+		if err != nil {
+			return nil, fmt.Errorf("commit %s: %v", c.parents[0], err)
+		}
+		parentTree = parent.tree
+	}
+	return db.diffTrees(ctx, parentTree, c.tree, renames)
+}
@@ -1,11 +1,13 @@
 package githttp
 
 import (
+	"bytes"
 	"compress/flate"
 	"compress/gzip"
 	"fmt"
 	"io"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -38,6 +40,42 @@ func getServiceType(r *http.Request) string {
 	return strings.Replace(service_type, "git-", "", 1)
 }
 
+// gitProtocolRegex limits the Git-Protocol header to
+// colon separated key=value parameters, as it ends up in git's environment
+var gitProtocolRegex = regexp.MustCompile(`^[0-9A-Za-z._=:-]+$`)
+
+// gitProtocol returns the Git-Protocol header of the request,
+// or an empty string if it is missing or malformed
+func gitProtocol(r *http.Request) string {
+	proto := r.Header.Get("Git-Protocol")
+	if !gitProtocolRegex.MatchString(proto) {
+		return ""
+	}
+	return proto
+}
+
+// protocolVersion extracts the requested protocol version
+// from a Git-Protocol header value (e.g. "version=2")
+func protocolVersion(proto string) int {
+	version := 0
+	for _, param := range strings.Split(proto, ":") {
+		if !strings.HasPrefix(param, "version=") {
+			continue
+		}
+		v, err := strconv.Atoi(strings.TrimPrefix(param, "version="))
+		if err == nil && v > version {
+			version = v
+		}
+	}
+	return version
+}
+
+// isV2Advertisement reports whether an --advertise-refs output
+// is a protocol v2 capability advertisement
+func isV2Advertisement(refs []byte) bool {
+	return bytes.HasPrefix(refs, packetWrite("version 2\n"))
+}
+
 // HTTP error response handling functions
 
 func renderMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
@@ -50,6 +88,11 @@ func renderMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func renderBadRequest(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte("Bad Request"))
+}
+
 func renderNotFound(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusNotFound)
 	w.Write([]byte("Not Found"))
@@ -60,6 +103,18 @@ func renderNoAccess(w http.ResponseWriter) {
 	w.Write([]byte("Forbidden"))
 }
 
+func renderTimeout(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusGatewayTimeout)
+	w.Write([]byte("Gateway Timeout"))
+}
+
+func renderBusy(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte("Service Unavailable"))
+}
+
 // Packet-line handling function
 
 func packetFlush() []byte {
@@ -0,0 +1,378 @@
+// Package webhook POSTs go-git-http events as JSON to an HTTP endpoint.
+//
+// Every event is sent as a Payload in the body of a POST request, with
+// the following headers:
+//
+//	Content-Type: application/json
+//	X-Githttp-Event: <event type, e.g. push>
+//	X-Githttp-Delivery: <payload id>
+//	X-Githttp-Signature-256: sha256=<hex HMAC-SHA256 of the body>
+//
+// The signature header is only set when the Dispatcher has a Secret.
+// Receivers should compare it to Sign(secret, body) in constant time.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/AaronO/go-git-http"
+	"github.com/AaronO/go-git-http/auth"
+)
+
+// Payload is the JSON document describing an event
+type Payload struct {
+	// Unique id of the payload, identical across retries
+	Id string `json:"id"`
+
+	// One of push/push-force/tag/fetch/create
+	Type string `json:"type"`
+
+	// repo component of URL, without leading slash
+	// (e.g. "org/project.git")
+	Repo string `json:"repo"`
+
+	// Full name of the ref pushed, and its short branch or tag name
+	Ref    string `json:"ref,omitempty"`
+	Branch string `json:"branch,omitempty"`
+	Tag    string `json:"tag,omitempty"`
+
+	// SHAs of the ref before and after a push, After is
+	// the commit fetched for fetches
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+
+	// Set for deleted refs and non-fast-forward branch updates
+	Deleted bool `json:"deleted,omitempty"`
+	Forced  bool `json:"forced,omitempty"`
+
+	// Commits introduced by a push, if listed by GitHttp
+	Commits []githttp.Commit `json:"commits,omitempty"`
+
+	// Who triggered the event
+	Pusher Pusher `json:"pusher"`
+
+	// Error message if the operation failed
+	Error string `json:"error,omitempty"`
+
+	// Time the payload was created
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type Pusher struct {
+	// Username as GitHttp.RequestAuthInfo tells it, empty if anonymous
+	Username string `json:"username,omitempty"`
+
+	RemoteAddr string `json:"remote_addr,omitempty"`
+}
+
+// NewPayload builds the payload of an event
+func NewPayload(e githttp.Event) *Payload {
+	p := &Payload{
+		Id:        e.Id,
+		Type:      e.Type.String(),
+		Repo:      strings.TrimPrefix(e.Repo, "/"),
+		Branch:    e.Branch,
+		Tag:       e.Tag,
+		Before:    e.Last,
+		After:     e.Commit,
+		Commits:   e.Commits,
+		Timestamp: time.Now().UTC(),
+	}
+
+	if u := e.Update; u != nil {
+		p.Ref = u.Ref
+		p.Deleted = u.Kind == githttp.REF_DELETE
+		p.Forced = u.Forced
+	}
+
+	if e.Error != nil {
+		p.Error = e.Error.Error()
+	}
+
+	if p.Id == "" {
+		p.Id = newId()
+	}
+
+	// Events published by GitHttp already have their user and remote
+	// address set, others may not. Basic auth usernames nobody checked
+	// aren't trusted.
+	p.Pusher = Pusher{e.User, e.RemoteAddr}
+	if r := e.Request; r != nil && p.Pusher.RemoteAddr == "" {
+		p.Pusher.RemoteAddr = r.RemoteAddr
+	}
+	if r := e.Request; r != nil && p.Pusher.Username == "" {
+		if info, ok := auth.FromContext(r.Context()); ok {
+			p.Pusher.Username = info.Username
+		}
+	}
+
+	return p
+}
+
+// Dispatcher delivers events to a webhook endpoint. Its Handle method
+// can be used as GitHttp's EventHandler; as it retries failed deliveries,
+// it's best wrapped in a githttp.EventBus:
+//
+//	hook := webhook.New("https://ci.example.com/hook", secret)
+//	bus := githttp.NewEventBus(hook.Handle, githttp.EventBusConfig{})
+//	git.EventHandler = bus.Publish
+type Dispatcher struct {
+	// Endpoint to POST payloads to
+	URL string
+
+	// Key to sign payloads with, unsigned if empty
+	Secret string
+
+	// Event types to deliver, all if empty
+	Types []githttp.EventType
+
+	// Client to deliver with, http.DefaultClient if nil
+	Client *http.Client
+
+	// Number of delivery attempts per payload (5 if zero).
+	// The delay between attempts starts at Backoff (1s if zero)
+	// and doubles with every attempt, up to MaxBackoff (1m if zero).
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+
+	// Directory to store payloads that couldn't be delivered in,
+	// they are dropped if empty. See Redeliver.
+	SpoolDir string
+
+	// Called with payloads that were given up on, if set
+	OnError func(p *Payload, err error)
+}
+
+// New returns a Dispatcher for url, signing payloads with secret
+func New(url string, secret string) *Dispatcher {
+	return &Dispatcher{
+		URL:    url,
+		Secret: secret,
+	}
+}
+
+// Handle delivers an event, retrying on failure.
+// It implements the GitHttp.EventHandler signature.
+func (d *Dispatcher) Handle(e githttp.Event) {
+	if !d.wants(e.Type) {
+		return
+	}
+
+	p := NewPayload(e)
+	if err := d.Deliver(context.Background(), p); err != nil {
+		d.fail(p, err)
+	}
+}
+
+func (d *Dispatcher) wants(t githttp.EventType) bool {
+	if len(d.Types) == 0 {
+		return true
+	}
+	for _, wanted := range d.Types {
+		if wanted == t {
+			return true
+		}
+	}
+	return false
+}
+
+// fail spools a payload that couldn't be delivered
+func (d *Dispatcher) fail(p *Payload, err error) {
+	if _, ok := err.(*ErrorRejected); !ok && d.SpoolDir != "" {
+		if spoolErr := d.spool(p); spoolErr != nil {
+			err = fmt.Errorf("%v (spooling failed: %v)", err, spoolErr)
+		}
+	}
+	if d.OnError != nil {
+		d.OnError(p, err)
+	}
+}
+
+// Deliver POSTs a payload, retrying with exponential backoff
+// on network errors and 5xx or 429 responses
+func (d *Dispatcher) Deliver(ctx context.Context, p *Payload) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	attempts := d.MaxAttempts
+	if attempts <= 0 {
+		attempts = 5
+	}
+	backoff := d.Backoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	maxBackoff := d.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = time.Minute
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = d.post(ctx, p, body)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*ErrorRejected); ok || attempt >= attempts {
+			return err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (d *Dispatcher) post(ctx context.Context, p *Payload, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", d.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-git-http-webhook/"+githttp.VERSION)
+	req.Header.Set("X-Githttp-Event", p.Type)
+	req.Header.Set("X-Githttp-Delivery", p.Id)
+	if d.Secret != "" {
+		req.Header.Set("X-Githttp-Signature-256", Sign([]byte(d.Secret), body))
+	}
+
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode < 300:
+		return nil
+	case res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("webhook %s responded with %s", d.URL, res.Status)
+	}
+	return &ErrorRejected{res.StatusCode}
+}
+
+// ErrorRejected is returned for payloads the endpoint refused
+// with a 4xx status, those aren't retried
+type ErrorRejected struct {
+	StatusCode int
+}
+
+func (e *ErrorRejected) Error() string {
+	return fmt.Sprintf("webhook rejected payload with status %d", e.StatusCode)
+}
+
+// Sign returns the signature header value of a payload body
+func Sign(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// spool stores a payload in SpoolDir
+func (d *Dispatcher) spool(p *Payload) error {
+	if err := os.MkdirAll(d.SpoolDir, 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so Redeliver
+	// never picks up partially written payloads
+	f, err := os.CreateTemp(d.SpoolDir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(d.SpoolDir, p.Id+".json"))
+}
+
+// Redeliver tries to deliver the payloads stored in SpoolDir again,
+// removing the ones that were delivered or rejected. It returns
+// the number of payloads delivered and the first error encountered.
+func (d *Dispatcher) Redeliver(ctx context.Context) (int, error) {
+	if d.SpoolDir == "" {
+		return 0, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(d.SpoolDir, "*.json"))
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	var firstErr error
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		p := &Payload{}
+		if err := json.Unmarshal(data, p); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %v", file, err)
+			}
+			continue
+		}
+
+		err = d.Deliver(ctx, p)
+		if _, ok := err.(*ErrorRejected); ok || err == nil {
+			os.Remove(file)
+		}
+		if err == nil {
+			delivered++
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return delivered, firstErr
+}
+
+// newId returns a random payload id
+func newId() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
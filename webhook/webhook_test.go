@@ -0,0 +1,137 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AaronO/go-git-http"
+	"github.com/AaronO/go-git-http/auth"
+)
+
+func pushEvent() githttp.Event {
+	req := httptest.NewRequest("POST", "/org/repo.git/git-receive-pack", nil)
+	req = req.WithContext(auth.NewContext(req.Context(), auth.AuthInfo{Username: "jane", Repo: "org/repo.git", Push: true}))
+
+	return githttp.Event{
+		Type:   githttp.PUSH,
+		Repo:   "/org/repo.git",
+		Branch: "master",
+		Last:   "92eef6dcb9cc198bc3ac6010c108fa482773f116",
+		Commit: "3da295397738f395c2ca5fd5570f01a9fcea3be3",
+		Update: &githttp.RefUpdate{
+			Old:  "92eef6dcb9cc198bc3ac6010c108fa482773f116",
+			New:  "3da295397738f395c2ca5fd5570f01a9fcea3be3",
+			Ref:  "refs/heads/master",
+			Kind: githttp.REF_UPDATE,
+		},
+		Request: req,
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	var got Payload
+	var failures int32 = 2
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			http.Error(w, "unavailable", 503)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		if sig := r.Header.Get("X-Githttp-Signature-256"); sig != Sign([]byte("secret"), body) {
+			t.Errorf("bad signature %q", sig)
+		}
+		if e := r.Header.Get("X-Githttp-Event"); e != "push" {
+			t.Errorf("got event header %q", e)
+		}
+		json.Unmarshal(body, &got)
+	}))
+	defer srv.Close()
+
+	d := New(srv.URL, "secret")
+	d.Backoff = time.Millisecond
+	d.Handle(pushEvent())
+
+	if got.Type != "push" || got.Repo != "org/repo.git" || got.Ref != "refs/heads/master" ||
+		got.After != "3da295397738f395c2ca5fd5570f01a9fcea3be3" || got.Pusher.Username != "jane" {
+		t.Errorf("got payload %+v", got)
+	}
+}
+
+func TestSpool(t *testing.T) {
+	var up int32
+	var delivered int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			http.Error(w, "down", 502)
+			return
+		}
+		atomic.AddInt32(&delivered, 1)
+	}))
+	defer srv.Close()
+
+	spool := t.TempDir()
+	d := New(srv.URL, "")
+	d.Backoff = time.Millisecond
+	d.MaxAttempts = 2
+	d.SpoolDir = spool
+
+	var failed error
+	d.OnError = func(p *Payload, err error) { failed = err }
+	d.Handle(pushEvent())
+
+	files, _ := filepath.Glob(filepath.Join(spool, "*.json"))
+	if failed == nil || len(files) != 1 {
+		t.Fatalf("got error %v and %d spooled payloads", failed, len(files))
+	}
+
+	atomic.StoreInt32(&up, 1)
+	n, err := d.Redeliver(context.Background())
+	if err != nil || n != 1 || delivered != 1 {
+		t.Errorf("got %d, %v redelivering", n, err)
+	}
+	if entries, _ := os.ReadDir(spool); len(entries) != 0 {
+		t.Errorf("spool not emptied: %v", entries)
+	}
+}
+
+func TestRejected(t *testing.T) {
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		http.Error(w, "bad request", 400)
+	}))
+	defer srv.Close()
+
+	d := New(srv.URL, "")
+	d.Backoff = time.Millisecond
+	d.SpoolDir = t.TempDir()
+
+	err := d.Deliver(context.Background(), NewPayload(pushEvent()))
+	if _, ok := err.(*ErrorRejected); !ok || attempts != 1 {
+		t.Errorf("got %v after %d attempts", err, attempts)
+	}
+}
+
+func TestPusher(t *testing.T) {
+	e := pushEvent()
+	if p := NewPayload(e); p.Pusher.Username != "jane" {
+		t.Errorf("authenticated pusher: got %+v", p.Pusher)
+	}
+
+	// Basic auth usernames nobody checked aren't trusted
+	e.Request = httptest.NewRequest("POST", "/org/repo.git/git-receive-pack", nil)
+	e.Request.SetBasicAuth("jane", "forged")
+	if p := NewPayload(e); p.Pusher.Username != "" || p.Pusher.RemoteAddr == "" {
+		t.Errorf("unauthenticated pusher: got %+v", p.Pusher)
+	}
+}